@@ -3,12 +3,21 @@
 
 "use strict";
 
+const child_process = require("child_process");
+const crypto = require("crypto");
 const fs = require("fs");
 const program = require("commander");
 const querystring = require("querystring");
+const http = require("http");
 const https = require("https");
 const moment = require("moment");
+const net = require("net");
+const os = require("os");
+const path = require("path");
 const readline = require("readline");
+const tls = require("tls");
+const url = require("url");
+const util = require("util");
 
 /*
    _
@@ -19,6 +28,106 @@ const readline = require("readline");
 |__/
 */
 
+// Function receiving debug records, which are objects describing an event,
+// e.g. an http request, or null to discard them (the default)
+let json_logger = null;
+
+// Set the function receiving debug records, or null to discard them
+function json_set_logger(logger) {
+    json_logger = logger;
+}
+
+// Milliseconds of inactivity after which requests fail, or zero to wait
+// forever, so that a hung connection does not freeze the program
+let json_timeout = 30000;
+
+// Set the milliseconds of inactivity after which requests fail
+function json_set_timeout(timeout) {
+    json_timeout = timeout;
+}
+
+// Pass a debug record describing event with fields to the logger, if any
+function json_log(event, fields) {
+    if (json_logger) {
+        json_logger(Object.assign({event : event}, fields));
+    }
+}
+
+// Query parameters, sent by weekly, whose values are logged as they are;
+// the values of any other parameter may be secret and are thus redacted
+const json_logged_params = [ "maxResults", "pageToken", "timeMax", "timeMin" ];
+
+// Return the path of a request with the values of the query parameters not
+// in json_logged_params redacted, for logging
+function json_redact_path(request_path) {
+    const index = request_path.indexOf("?");
+    if (index < 0) {
+        return request_path;
+    }
+    let query = querystring.parse(request_path.slice(index + 1));
+    Object.keys(query).forEach(function(key) {
+        if (json_logged_params.indexOf(key) < 0) {
+            query[key] = "<redacted>";
+        }
+    });
+    return request_path.slice(0, index + 1) + querystring.stringify(query);
+}
+
+// Log the outcome of the request sent with options at start (in ms since
+// the epoch), which is either the response status code or an error
+function json_log_request(options, start, outcome) {
+    let fields = {
+        method : options.method,
+        host : options.hostname + ":" + options.port,
+        path : json_redact_path(options.path || "/"),
+        ms : Date.now() - start,
+    };
+    if (outcome instanceof Error) {
+        fields.error = outcome.message;
+    } else {
+        fields.status = outcome;
+    }
+    json_log("http", fields);
+}
+
+// Fields of the json responses that weekly reads, whose values are recorded
+// as they are; the values of any other field may be secret, e.g. tokens and
+// codes, and are thus redacted
+const json_recorded_fields = [
+    "attendees", "colorId", "creator", "date", "dateTime", "email", "end",
+    "error", "errors", "expires_in", "id", "interval", "items", "location",
+    "message", "nextPageToken", "reason", "responseStatus", "self", "start",
+    "status", "summary", "timeZone", "verification_url"
+];
+
+// Return the json body of a response with the values of the fields not in
+// json_recorded_fields redacted, or body itself, when it is not json (e.g.
+// the iCalendar data of CalDAV responses)
+function json_redact_body(body) {
+    const redact = function(value) {
+        if (Array.isArray(value)) {
+            return value.map(redact);
+        }
+        if (!value || typeof value !== "object") {
+            return value;
+        }
+        let result = {};
+        Object.keys(value).forEach(function(key) {
+            result[key] = (json_recorded_fields.indexOf(key) >= 0)
+                              ? redact(value[key])
+                              : "<redacted>";
+        });
+        return result;
+    };
+    let result = body;
+    json_monad(body, function(error, data) {
+        if (!error) {
+            result = JSON.stringify(redact(data));
+        }
+    });
+    return result;
+}
+
 // Transform try..catch json code into a monad
 function json_monad(data, callback) {
     try {
@@ -44,22 +153,289 @@ function json_write_file(path, data, callback) {
     fs.writeFile(path, JSON.stringify(data, undefined, 4) + "\n", callback);
 }
 
-// Make an https request expecting a json response
+// Requests exceeding the rate limit are retried once, unless the server asks
+// to wait for longer than this number of seconds
+const json_max_retry_after = 30;
+
+// Make an https request expecting a json response; for testing, requests
+// are sent to the server at WEEKLY_API_URL instead, when it is set. Requests
+// exceeding the rate limit are retried once (see json_max_retry_after) and
+// errors get hints depending on their reason (see json_status_error).
 function json_request(options, callback, request_body) {
-    let request = https.request(options, function(response) {
-        if (response.statusCode !== 200) {
-            response.resume();
-            if (response.statusCode === 401) {
-                callback(new Error("json-request-unauthorized"));
+    let client = https;
+    if (process.env.WEEKLY_API_URL) {
+        const server = url.parse(process.env.WEEKLY_API_URL);
+        client = (server.protocol === "http:") ? http : https;
+        options = Object.assign({}, options, {
+            hostname : server.hostname,
+            port : server.port || ((client === http) ? 80 : 443),
+        });
+    }
+    const hints = {
+        auth : "Try running 'node index.js --refresh'",
+        rate_limited : "Wait a bit and try again",
+        quota_exceeded : "Wait for the quota to reset or raise it in the " +
+                             "Google Cloud console",
+    };
+    const send = function(retries) {
+        json_send(client, options, function(error, response, headers) {
+            const delay = error && (error.retry_after || 0);
+            if (error && error.reason === "rate_limited" && retries > 0 &&
+                delay <= json_max_retry_after) {
+                json_log("retry", {reason : error.reason, seconds : delay});
+                setTimeout(function() { send(retries - 1); }, delay * 1000);
+                return;
+            }
+            if (error && hints[error.reason]) {
+                error.hint = hints[error.reason];
+            }
+            if (error && error.timeout) {
+                error.message = "calendar API " + error.message;
+            }
+            callback(error, response, headers);
+        }, request_body);
+    };
+    send(1);
+}
+
+// Make a request to the json API at the https address, whose path prefixes
+// request_path, using the user:password credentials for basic
+// authentication and sending body, if any, as json; plain http is refused,
+// so that nobody on the path can read the credentials
+function json_basic_request(address, credentials, method, request_path, body,
+                            callback) {
+    const parsed = url.parse(address);
+    if (parsed.protocol !== "https:") {
+        callback(weekly_error("config",
+                              "refusing to send credentials to '" + address +
+                                  "' without https",
+                              "Use an https url"));
+        return;
+    }
+    let headers = {
+        "Accept" : "application/json",
+        "Authorization" :
+            "Basic " + Buffer.from(credentials).toString("base64"),
+    };
+    if (body !== undefined) {
+        headers["Content-Type"] = "application/json";
+    }
+    json_send(https, {
+        hostname : parsed.hostname,
+        port : parsed.port || 443,
+        method : method,
+        path : (parsed.pathname || "/").replace(/\/$/, "") + request_path,
+        headers : headers,
+    }, callback, (body !== undefined) ? JSON.stringify(body) : undefined);
+}
+
+// Fetch the json document at the given https address; plain http is
+// refused, so that nobody on the path can tamper with the document
+function json_get_url(address, callback) {
+    const parsed = url.parse(address);
+    if (parsed.protocol !== "https:") {
+        callback(weekly_error("usage",
+                              "refusing to fetch '" + address + "' " +
+                                  "without https",
+                              "Use an https url"));
+        return;
+    }
+    json_send(https, {
+        hostname : parsed.hostname,
+        port : parsed.port || 443,
+        method : "GET",
+        path : parsed.path,
+    }, callback);
+}
+
+// Create the error corresponding to a response with the given status,
+// headers, and body, whose reason field tells apart authorization failures
+// (auth), missing resources (not_found), requests exceeding the rate limit
+// (rate_limited), whose retry_after field contains the seconds to wait
+// suggested by the server, if any, and the exhausted quota (quota_exceeded)
+function json_status_error(status, headers, body) {
+    let details = [];
+    json_monad(body, function(error, data) {
+        if (!error && data && data.error && data.error.errors) {
+            details = data.error.errors;
+        }
+    });
+    const detail = (details.length > 0) ? details[0].reason : "";
+    let error;
+    if (status === 401) {
+        error = weekly_error("auth", "you are not authorized");
+        error.reason = "auth";
+    } else if (status === 404) {
+        error = weekly_error("api", "not found");
+        error.reason = "not_found";
+    } else if (status === 429 || /^(user)?rateLimitExceeded$/.test(detail)) {
+        const retry_after = parseInt(headers["retry-after"], 10);
+        error = weekly_error("api", "too many requests");
+        error.reason = "rate_limited";
+        if (!isNaN(retry_after)) {
+            error.retry_after = retry_after;
+        }
+    } else if (/^(quota|dailyLimit)Exceeded$/.test(detail)) {
+        error = weekly_error("api", "quota exceeded");
+        error.reason = "quota_exceeded";
+    } else {
+        error = weekly_error("api", "request failed with status " + status);
+    }
+    error.status = status;
+    return error;
+}
+
+// Pass to callback the parsed json body of a response with the given
+// successful status code, an empty object for 204 (No Content), or the error
+// corresponding to the status, headers, and body (see json_status_error)
+function json_parse_response(status, headers, body, callback) {
+    if (status === 204) {
+        callback(null, {});
+        return;
+    }
+    if (status < 200 || status >= 300) {
+        callback(json_status_error(status, headers, body));
+        return;
+    }
+    json_monad(body, callback);
+}
+
+// Append the response to the request sent with options to the fixture file
+// named by WEEKLY_RECORD, as a json line containing the method and path of
+// the request and the status, the retry-after header, if any, and the body
+// of the response, where secrets are redacted (see json_redact_path and
+// json_redact_body), so that fixtures can be shared
+function json_record(options, status, headers, body) {
+    let record = {
+        method : options.method,
+        path : json_redact_path(options.path || "/"),
+        status : status,
+        body : json_redact_body(body),
+    };
+    if (headers["retry-after"] !== undefined) {
+        record.retry_after = headers["retry-after"];
+    }
+    try {
+        fs.appendFileSync(process.env.WEEKLY_RECORD,
+                          JSON.stringify(record) + "\n");
+    } catch (error) {
+        console.error("warning: cannot record response: " + error.message);
+    }
+}
+
+// Records of the fixture file named by WEEKLY_REPLAY not yet replayed, or
+// null until the file is read
+let json_replay_records = null;
+
+// Parse the records of a fixture file (see json_record), one per line,
+// ignoring empty lines, and throw an error telling the first invalid line
+function json_parse_fixture(text) {
+    let records = [];
+    text.split("\n").forEach(function(line, index) {
+        if (line.trim() === "") {
+            return;
+        }
+        let record = null;
+        json_monad(line, function(error, data) {
+            if (!error) {
+                record = data;
             }
-            callback(new Error("json-request-failed"));
+        });
+        if (record === null || typeof record !== "object" ||
+            typeof record.method !== "string" ||
+            typeof record.path !== "string" ||
+            typeof record.status !== "number" ||
+            typeof record.body !== "string") {
+            throw new Error("line " + (index + 1) +
+                            ": expected a recorded response");
+        }
+        records.push(record);
+    });
+    return records;
+}
+
+// Pass to callback the response recorded (see json_record) for the request
+// sent with options, i.e. the first record not yet replayed with the same
+// method and path, parsed with parse (see json_send), without accessing the
+// network, failing when there is none
+function json_replay(options, callback, parse) {
+    const file = process.env.WEEKLY_REPLAY;
+    if (json_replay_records === null) {
+        try {
+            json_replay_records =
+                json_parse_fixture(fs.readFileSync(file, "utf8"));
+        } catch (error) {
+            callback(weekly_error("config", "invalid fixture '" + file +
+                                                "': " + error.message,
+                                  "Record it again using WEEKLY_RECORD"));
             return;
         }
+    }
+    const request_path = json_redact_path(options.path || "/");
+    const index = json_replay_records.findIndex(function(record) {
+        return record.method === options.method && record.path === request_path;
+    });
+    if (index < 0) {
+        callback(weekly_error("api",
+                              "no recorded response for " + options.method +
+                                  " " + request_path,
+                              "Record it again using WEEKLY_RECORD"));
+        return;
+    }
+    const record = json_replay_records.splice(index, 1)[0];
+    json_log("replay", {method : record.method, path : record.path});
+    const headers = (record.retry_after !== undefined)
+                        ? {"retry-after" : record.retry_after}
+                        : {};
+    setImmediate(function() {
+        (parse || json_parse_response)(
+            record.status, headers, record.body, function(error, data) {
+                callback(error, data, headers);
+            });
+    });
+}
+
+// Send request using client (i.e. http or https) and pass the response,
+// parsed with parse (by default, json_parse_response), which receives the
+// status code, the headers, the body, and a callback, to callback along
+// with the response headers, failing when the connection is inactive for
+// longer than json_timeout. For testing and demos, responses are recorded
+// into the fixture file named by WEEKLY_RECORD or replayed from the one
+// named by WEEKLY_REPLAY, when set.
+function json_send(client, options, callback, request_body, parse) {
+    if (process.env.WEEKLY_REPLAY) {
+        json_replay(options, callback, parse);
+        return;
+    }
+    const start = Date.now();
+    let request = client.request(options, function(response) {
+        json_log_request(options, start, response.statusCode);
         let response_body = "";
         response.on("data", function(data) { response_body += data; });
-        response.on("end", function() { json_monad(response_body, callback); });
+        response.on("end", function() {
+            if (process.env.WEEKLY_RECORD) {
+                json_record(options, response.statusCode, response.headers,
+                            response_body);
+            }
+            (parse || json_parse_response)(
+                response.statusCode, response.headers, response_body,
+                function(error, data) {
+                    callback(error, data, response.headers);
+                });
+        });
+    });
+    request.setTimeout(json_timeout, function() {
+        let error = weekly_error("api",
+                                 "timed out after " + json_timeout / 1000 +
+                                     " seconds",
+                                 "Use --timeout to wait longer");
+        error.timeout = true;
+        request.destroy(error);
+    });
+    request.on("error", function(error) {
+        json_log_request(options, start, error);
+        callback(error.kind ? error : weekly_error("api", error.message));
     });
-    request.on("error", function(error) { callback(error); });
     if (request_body) {
         request.end(request_body);
     } else {
@@ -75,8 +451,12 @@ function json_request(options, callback, request_body) {
  \___/ \__,_|\__,_|\__|_| |_|_____|
 */
 
-// Obtain device authentication code from client-id and scope
-function oauth2_obtain_user_code(app_path, callback) {
+// Scopes requested by default, which only allow reading calendars
+const oauth2_scopes = [ "https://www.googleapis.com/auth/calendar.readonly" ];
+
+// Obtain device authentication code from client-id and scopes (by default,
+// oauth2_scopes)
+function oauth2_obtain_user_code(app_path, callback, scopes) {
     json_read_file(app_path, function(error, auth) {
         if (error) {
             callback(error);
@@ -94,7 +474,7 @@ function oauth2_obtain_user_code(app_path, callback) {
             },
             callback, querystring.stringify({
                 "client_id" : auth.client_id,
-                "scope" : "https://www.googleapis.com/auth/calendar.readonly",
+                "scope" : (scopes || oauth2_scopes).join(" "),
             }));
     });
 }
@@ -191,8 +571,8 @@ function calendar_list(tokens_path, callback) {
     });
 }
 
-// Get calendar events
-function calendar_events(tokens_path, calendar_path, callback) {
+// Get the metadata of the selected calendar, including its time zone
+function calendar_get(tokens_path, calendar_path, callback) {
     json_read_file(tokens_path, function(error, tokens_info) {
         if (error) {
             callback(error);
@@ -203,13 +583,107 @@ function calendar_events(tokens_path, calendar_path, callback) {
                 callback(error);
                 return;
             }
-            const path =
-                "/calendar/v3/calendars/" + calendar_info + "/events" + "?" +
-                querystring.stringify({
-                    timeMin :
-                        moment().locale("it").startOf('week').toISOString(),
-                    maxResults : 2500,
-                });
+            const options = {
+                hostname : "www.googleapis.com",
+                port : 443,
+                method : "GET",
+                path : "/calendar/v3/calendars/" + calendar_info,
+                headers : {
+                    "Authorization" : "Bearer " + tokens_info.access_token,
+                },
+            };
+            json_request(options, callback);
+        });
+    });
+}
+
+// Send a request with the given method to the events of the selected
+// calendar or, unless id is undefined, to the event with the given id, using
+// tokens allowing to write events and sending resource, unless undefined
+function calendar_write_event(tokens_path, calendar_path, method, id,
+                              resource, callback) {
+    json_read_file(tokens_path, function(error, tokens_info) {
+        if (error) {
+            callback(error);
+            return;
+        }
+        json_read_file(calendar_path, function(error, calendar_info) {
+            if (error) {
+                callback(error);
+                return;
+            }
+            let headers = {
+                "Authorization" : "Bearer " + tokens_info.access_token,
+            };
+            if (resource !== undefined) {
+                headers["Content-Type"] = "application/json";
+            }
+            const options = {
+                hostname : "www.googleapis.com",
+                port : 443,
+                method : method,
+                path : "/calendar/v3/calendars/" + calendar_info + "/events" +
+                           ((id !== undefined) ? "/" + encodeURIComponent(id)
+                                               : ""),
+                headers : headers,
+            };
+            json_request(options, callback,
+                         (resource !== undefined) ? JSON.stringify(resource)
+                                                  : undefined);
+        });
+    });
+}
+
+// Insert resource, in the format of the Calendar API, into the selected
+// calendar, using tokens allowing to write events
+function calendar_insert_event(tokens_path, calendar_path, resource,
+                               callback) {
+    calendar_write_event(tokens_path, calendar_path, "POST", undefined,
+                         resource, callback);
+}
+
+// Update the fields of the event with the given id in the selected calendar
+// with those of resource, using tokens allowing to write events
+function calendar_update_event(tokens_path, calendar_path, id, resource,
+                               callback) {
+    calendar_write_event(tokens_path, calendar_path, "PATCH", id, resource,
+                         callback);
+}
+
+// Delete the event with the given id from the selected calendar, using tokens
+// allowing to write events
+function calendar_delete_event(tokens_path, calendar_path, id, callback) {
+    calendar_write_event(tokens_path, calendar_path, "DELETE", id, undefined,
+                         callback);
+}
+
+// Get a page of at most max_results calendar events starting within window
+// (whose end is optional), starting from page_token, when set; if more
+// events are available, the response contains the nextPageToken
+function calendar_events_page(tokens_path, calendar_path, window, page_token,
+                              max_results, callback) {
+    json_read_file(tokens_path, function(error, tokens_info) {
+        if (error) {
+            callback(error);
+            return;
+        }
+        json_read_file(calendar_path, function(error, calendar_info) {
+            if (error) {
+                callback(error);
+                return;
+            }
+            let query = {
+                timeMin : window.start.toISOString(),
+                maxResults : max_results,
+            };
+            if (window.end) {
+                query.timeMax = window.end.toISOString();
+            }
+            if (page_token) {
+                query.pageToken = page_token;
+            }
+            const path = "/calendar/v3/calendars/" + calendar_info +
+                         "/events" + "?" + querystring.stringify(query);
             const options = {
                 hostname : "www.googleapis.com",
                 port : 443,
@@ -224,6 +698,364 @@ function calendar_events(tokens_path, calendar_path, callback) {
     });
 }
 
+// Get calendar events starting within window (whose end is optional),
+// following the pages of the response until there are no more events or
+// max_events (by default unlimited) events have been fetched. The response
+// contains the items and, if more events are available, a nextPageToken.
+function calendar_events_chunk(tokens_path, calendar_path, window, callback,
+                               max_events) {
+    let items = [];
+    const next = function(page_token) {
+        const max_results = Math.min(2500, (max_events || Infinity) -
+                                               items.length);
+        calendar_events_page(tokens_path, calendar_path, window, page_token,
+                             max_results, function(error, response) {
+            if (error) {
+                callback(error);
+                return;
+            }
+            items = items.concat(response.items);
+            const more = items.length < (max_events || Infinity);
+            let decision = "fetching next page";
+            if (!response.nextPageToken) {
+                decision = "stopping, no more pages";
+            } else if (!more) {
+                decision = "stopping, reached max events";
+            }
+            json_log("page", {
+                items : response.items.length,
+                total : items.length,
+                decision : decision,
+            });
+            if (response.nextPageToken && more) {
+                next(response.nextPageToken);
+                return;
+            }
+            callback(null, {
+                items : items,
+                nextPageToken : response.nextPageToken,
+            });
+        });
+    };
+    next();
+}
+
+// Windows spanning more days than this are fetched one month at a time,
+// since the API behaves oddly with very large windows
+const calendar_chunk_days = 365;
+
+// Like calendar_events_chunk but splitting large windows into monthly chunks
+// (see weekly_split_window) fetched by at most concurrency (by default 1)
+// requests at a time, where max_events applies to the events of all chunks.
+// Since the API also returns the events overlapping the start of a chunk,
+// only the events starting within each chunk are kept, so that events
+// crossing chunks are not repeated. After the first error, no more chunks
+// are fetched and the errors of all the failed chunks are joined (see
+// weekly_join_errors). The response is truncated, when the events are more
+// than max_events, and, in such case, it also contains truncated set to true.
+function calendar_events(tokens_path, calendar_path, window, callback,
+                         max_events, concurrency) {
+    const chunks = weekly_split_window(window, calendar_chunk_days);
+    const limit = max_events || Infinity;
+    let responses = [];
+    let errors = [];
+    let fetched = 0;
+    let started = 0;
+    let running = 0;
+    let finished = false;
+    const stopped = function() {
+        return errors.length > 0 || fetched >= limit ||
+               responses.some(function(response) {
+                   return response && response.nextPageToken;
+               });
+    };
+    const finish = function() {
+        finished = true;
+        if (errors.length > 0) {
+            callback(weekly_join_errors(errors));
+            return;
+        }
+        let items = [];
+        let truncated = false;
+        responses.forEach(function(response) {
+            truncated = truncated || items.length >= limit;
+            if (!truncated) {
+                items = items.concat(response.items);
+                truncated = Boolean(response.nextPageToken);
+            }
+        });
+        let result = {items : items.slice(0, limit)};
+        if (truncated || items.length > limit) {
+            result.truncated = true;
+        }
+        callback(null, result);
+    };
+    const fetch = function(index) {
+        const chunk = chunks[index];
+        if (chunks.length > 1) {
+            json_log("chunk", {
+                start : chunk.start.toISOString(),
+                end : chunk.end.toISOString(),
+            });
+        }
+        running += 1;
+        calendar_events_chunk(tokens_path, calendar_path, chunk,
+                              function(error, response) {
+            running -= 1;
+            if (error) {
+                errors.push(error);
+            } else {
+                response.items = response.items.filter(function(item) {
+                    const start = item.start.dateTime || item.start.date;
+                    return index === 0 || !moment(start).isBefore(chunk.start);
+                });
+                responses[index] = response;
+                fetched += response.items.length;
+            }
+            next();
+        }, max_events && max_events - fetched);
+    };
+    const next = function() {
+        while (running < (concurrency || 1) && started < chunks.length &&
+               !stopped()) {
+            fetch(started++);
+        }
+        if (running === 0 && !finished) {
+            finish();
+        }
+    };
+    next();
+}
+
+// Get the events starting within window from the CalDAV calendar described
+// by the json file at config_path, which contains the https url of the
+// calendar, the username, and the (application) password, which is never
+// sent without TLS
+function calendar_caldav_events(config_path, window, callback) {
+    json_read_file(config_path, function(error, config) {
+        if (error) {
+            callback(error);
+            return;
+        }
+        const format = function(time) {
+            return moment(time).toISOString().replace(/[-:]|\.\d+/g, "");
+        };
+        const body = [
+            "<?xml version=\"1.0\" encoding=\"utf-8\"?>",
+            "<C:calendar-query xmlns:D=\"DAV:\" " +
+                "xmlns:C=\"urn:ietf:params:xml:ns:caldav\">",
+            "<D:prop><C:calendar-data/></D:prop>",
+            "<C:filter><C:comp-filter name=\"VCALENDAR\">",
+            "<C:comp-filter name=\"VEVENT\">",
+            "<C:time-range start=\"" + format(window.start) + "\"" +
+                (window.end ? " end=\"" + format(window.end) + "\"" : "") +
+                "/>",
+            "</C:comp-filter></C:comp-filter></C:filter>",
+            "</C:calendar-query>", ""
+        ].join("\n");
+        const parsed = url.parse(config.url || "");
+        if (parsed.protocol !== "https:") {
+            callback(weekly_error("config",
+                                  "refusing to send the CalDAV password " +
+                                      "without https",
+                                  "Use an https url in '" + config_path +
+                                      "'"));
+            return;
+        }
+        const credentials = Buffer.from(config.username + ":" +
+                                        config.password).toString("base64");
+        json_send(https, {
+            hostname : parsed.hostname,
+            port : parsed.port || 443,
+            method : "REPORT",
+            path : parsed.path,
+            headers : {
+                "Authorization" : "Basic " + credentials,
+                "Content-Type" : "application/xml; charset=utf-8",
+                "Depth" : "1",
+            },
+        }, callback, body, function(status, headers, response_body,
+                                    callback) {
+            if (status === 401) {
+                callback(weekly_error("auth", "you are not authorized",
+                                      "Check the username and password in '" +
+                                          config_path + "'"));
+                return;
+            }
+            if (status !== 207) {
+                callback(weekly_error("api", "request failed with status " +
+                                                 status));
+                return;
+            }
+            callback(null, response_body);
+        });
+    });
+}
+
+/*
+     _               _
+ ___| |__   ___  ___| |_ ___
+/ __| '_ \ / _ \/ _ \ __/ __|
+\__ \ | | |  __/  __/ |_\__ \
+|___/_| |_|\___|\___|\__|___/
+*/
+
+// Make a request for the values of the spreadsheet whose id is given,
+// where path follows the values collection (e.g., a range), and body, if
+// any, is sent as json
+function sheets_values_request(tokens_path, id, method, path, body,
+                               callback) {
+    json_read_file(tokens_path, function(error, tokens_info) {
+        if (error) {
+            callback(error);
+            return;
+        }
+        let headers = {
+            "Authorization" : "Bearer " + tokens_info.access_token,
+        };
+        if (body !== undefined) {
+            headers["Content-Type"] = "application/json";
+        }
+        const options = {
+            hostname : "sheets.googleapis.com",
+            port : 443,
+            method : method,
+            path : "/v4/spreadsheets/" + encodeURIComponent(id) + "/values/" +
+                       path,
+            headers : headers,
+        };
+        json_request(options, callback,
+                     (body !== undefined) ? JSON.stringify(body) : undefined);
+    });
+}
+
+// Get the values within range (in A1 notation) of the spreadsheet whose id
+// is given; the response lacks values when the range is empty
+function sheets_get_values(tokens_path, id, range, callback) {
+    sheets_values_request(tokens_path, id, "GET", encodeURIComponent(range),
+                          undefined, callback);
+}
+
+// Append rows, each a list of values, after the table found within range
+// (in A1 notation) of the spreadsheet whose id is given, parsing the values
+// as if typed by the user, e.g. converting "1.50" to a number
+function sheets_append_values(tokens_path, id, range, rows, callback) {
+    const query = querystring.stringify({
+        valueInputOption : "USER_ENTERED",
+        insertDataOption : "INSERT_ROWS",
+    });
+    sheets_values_request(tokens_path, id, "POST",
+                          encodeURIComponent(range) + ":append?" + query,
+                          {values : rows}, callback);
+}
+
+/*
+   _ _
+  (_|_)_ __ __ _
+  | | | '__/ _` |
+  | | | | | (_| |
+ _/ |_|_|  \__,_|
+|__/
+*/
+
+// Make a request to the Jira REST API described by the json file at
+// config_path, which contains the url of the Jira site, the email of the
+// user, and an API token, sending body, if any, as json. The url must use
+// https, so that nobody on the path can read the token.
+function jira_request(config_path, method, request_path, body, callback) {
+    json_read_file(config_path, function(error, config) {
+        if (error) {
+            callback(error);
+            return;
+        }
+        json_basic_request(config.url || "", config.email + ":" + config.token,
+                           method, request_path, body,
+                           function(error, response) {
+            if (error && error.reason === "auth") {
+                error.hint = "Check the email and API token in '" +
+                             config_path + "'";
+            }
+            callback(error, response);
+        });
+    });
+}
+
+// Get the worklogs of the Jira issue whose key is given
+function jira_worklogs(config_path, issue, callback) {
+    jira_request(config_path, "GET",
+                 "/rest/api/2/issue/" + encodeURIComponent(issue) + "/worklog",
+                 undefined, callback);
+}
+
+// Add worklog (see weekly_make_worklogs) to its Jira issue
+function jira_add_worklog(config_path, worklog, callback) {
+    jira_request(config_path, "POST",
+                 "/rest/api/2/issue/" + encodeURIComponent(worklog.issue) +
+                     "/worklog",
+                 {
+                     started : worklog.started,
+                     timeSpentSeconds : worklog.seconds,
+                     comment : worklog.comment,
+                 },
+                 callback);
+}
+
+/*
+  _                    _
+ | |_ ___   __ _  __ _| |
+ | __/ _ \ / _` |/ _` | |
+ | || (_) | (_| | (_| | |
+  \__\___/ \__, |\__, |_|
+           |___/ |___/
+*/
+
+// Make a request to the Toggl Track API using the json file at config_path,
+// which contains the API token and, optionally, the https url of the API
+// (by default, https://api.track.toggl.com), sending body, if any, as json
+function toggl_request(config_path, method, request_path, body, callback) {
+    json_read_file(config_path, function(error, config) {
+        if (error) {
+            callback(error);
+            return;
+        }
+        json_basic_request(config.url || "https://api.track.toggl.com",
+                           config.token + ":api_token", method,
+                           "/api/v9" + request_path, body,
+                           function(error, response) {
+            if (error && (error.reason === "auth" || error.status === 403)) {
+                error.hint = "Check the API token in '" + config_path + "'";
+            }
+            callback(error, response);
+        });
+    });
+}
+
+// Get the time entries of the user starting within window
+function toggl_time_entries(config_path, window, callback) {
+    const query = querystring.stringify({
+        start_date : window.start.toISOString(),
+        end_date : (window.end || moment()).toISOString(),
+    });
+    toggl_request(config_path, "GET", "/me/time_entries?" + query, undefined,
+                  callback);
+}
+
+// Add entry (see weekly_make_time_entries) to the workspace whose id is
+// given
+function toggl_add_time_entry(config_path, workspace_id, entry, callback) {
+    toggl_request(config_path, "POST",
+                  "/workspaces/" + workspace_id + "/time_entries", {
+                      created_with : "weekly",
+                      description : entry.description,
+                      duration : entry.duration,
+                      project_id : entry.project_id,
+                      start : entry.start,
+                      tags : entry.tags,
+                      workspace_id : workspace_id,
+                  },
+                  callback);
+}
+
 /*
                    _    _
 __      _____  ___| | _| |_   _
@@ -233,6 +1065,41 @@ __      _____  ___| | _| |_   _
                           |___/
 */
 
+// Kinds of errors reported to the user, with the exit code of each kind
+const weekly_error_kinds = {
+    internal : 1,
+    usage : 2,
+    auth : 3,
+    config : 4,
+    api : 5,
+};
+
+// Create an error of the given kind (see weekly_error_kinds) with a message
+// for the user and an optional hint telling how to fix it
+function weekly_error(kind, message, hint) {
+    let error = new Error(message);
+    error.kind = kind;
+    error.hint = hint;
+    return error;
+}
+
+// Join the errors of concurrent operations into a single error, having
+// the kind, hint, and reason of the first error, and listing all the
+// messages
+function weekly_join_errors(errors) {
+    if (errors.length === 1) {
+        return errors[0];
+    }
+    let error = weekly_error(errors[0].kind,
+                             errors.length + " requests failed: " +
+                                 errors.map(function(error) {
+                                     return error.message;
+                                 }).join("; "),
+                             errors[0].hint);
+    error.reason = errors[0].reason;
+    return error;
+}
+
 // Filter available calendars to only return interesting fields
 function weekly_filter_calendars(calendars) {
     let result = [];
@@ -246,20 +1113,1298 @@ function weekly_filter_calendars(calendars) {
     return result;
 }
 
-// Filter calendar events to only return interesting fields
+// Filter calendar events to only return interesting fields, including the
+// id, the link to the Calendar page, the description, and the status of the
+// event (e.g. cancelled), the emails of the attendees and of the creator, the
+// color id, and the response of the user to the invitation (e.g. declined),
+// if any
 function weekly_filter_events(events) {
     let result = [];
     for (let index = 0; index < events.items.length; ++index) {
         const current = events.items[index];
+        const self = (current.attendees || []).find(function(attendee) {
+            return attendee.self;
+        });
         result.push({
+            id : current.id,
             summary : current.summary,
             start : current.start.dateTime,
             end : current.end.dateTime,
+            location : current.location,
+            description : current.description,
+            link : current.htmlLink,
+            attendees : current.attendees &&
+                            current.attendees.map(function(attendee) {
+                                return attendee.email;
+                            }),
+            color : current.colorId,
+            creator : current.creator && current.creator.email,
+            status : current.status,
+            response : self && self.responseStatus,
         });
     }
     return result;
 }
 
+// Return the offset from UTC, in minutes, of the IANA time zone named zone
+// at the given time in milliseconds; throw an error for unknown zones
+function weekly_zone_offset(zone, millis) {
+    let format;
+    try {
+        format = new Intl.DateTimeFormat("en-US", {
+            timeZone : zone,
+            hourCycle : "h23",
+            year : "numeric",
+            month : "numeric",
+            day : "numeric",
+            hour : "numeric",
+            minute : "numeric",
+            second : "numeric",
+        });
+    } catch (error) {
+        throw new Error("unknown time zone: '" + zone + "'");
+    }
+    let parts = {};
+    format.formatToParts(new Date(millis)).forEach(function(part) {
+        parts[part.type] = parseInt(part.value, 10);
+    });
+    const wall = Date.UTC(parts.year, parts.month - 1, parts.day, parts.hour,
+                          parts.minute, parts.second);
+    return Math.round((wall - Math.floor(millis / 1000) * 1000) / 60000);
+}
+
+// Tell whether the event was cancelled or the user declined it
+function weekly_is_declined(evt) {
+    return evt.status === "cancelled" || evt.response === "declined";
+}
+
+// Return the key identifying the event when merging calendars, i.e. its id
+// and start, since the instances of recurring events may share the id, or
+// its summary, start, and end for events without id
+function weekly_event_key(evt) {
+    const fields = (evt.id !== undefined) ? [ evt.id, evt.start ]
+                                          : [ evt.summary, evt.start, evt.end ];
+    return JSON.stringify(fields);
+}
+
+// Make the Jira worklogs of the events with a tag naming an issue (e.g.
+// #proj-123), using the first of them, where each worklog contains the
+// issue key, the start, the seconds spent, and a comment with the summary
+// and a marker identifying the event (see weekly_event_key), such that the
+// worklogs already added can be recognized
+function weekly_make_worklogs(events) {
+    const issue = /^[a-z][a-z0-9_]*-\d+$/;
+    let worklogs = [];
+    events.forEach(function(evt) {
+        const key = weekly_parse_summary(evt.summary).tags.map(function(tag) {
+            return tag.substr(weekly_sigils.tag.length);
+        }).find(function(tag) { return issue.test(tag); });
+        if (key === undefined) {
+            return;
+        }
+        const marker = "weekly:" + crypto.createHash("sha256")
+                                       .update(weekly_event_key(evt))
+                                       .digest("hex")
+                                       .slice(0, 12);
+        worklogs.push({
+            issue : key.toUpperCase(),
+            started :
+                moment(evt.start).format("YYYY-MM-DD[T]HH:mm:ss[.000]ZZ"),
+            seconds : Math.round(
+                moment(evt.end).diff(moment(evt.start), "seconds", true)),
+            comment : evt.summary + " [" + marker + "]",
+            marker : marker,
+        });
+    });
+    return worklogs;
+}
+
+// Make the Toggl time entries of events, where each entry contains the
+// start, the duration in seconds, the project as description, the tags,
+// and the id of the project in Toggl, taken from projects, which maps
+// project names to ids, if any
+function weekly_make_time_entries(events, projects) {
+    return events.map(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        return {
+            start : moment(evt.start).toISOString(),
+            duration : Math.round(
+                moment(evt.end).diff(moment(evt.start), "seconds", true)),
+            description : parsed.project,
+            tags : parsed.tags.map(function(tag) {
+                return tag.substr(weekly_sigils.tag.length);
+            }),
+            project_id : projects[parsed.project],
+        };
+    });
+}
+
+// Parse an iCalendar date-time such as "20250101T090000Z" into an ISO
+// string, where times without "Z" are taken to be in the time zone named
+// zone (e.g. the TZID parameter) or, without zone, in the local time zone,
+// returning undefined for dates (i.e. all-day events) and invalid values;
+// throw an error when zone is unknown
+function weekly_parse_ics_time(value, zone) {
+    const regexp = /^(\d{4})(\d{2})(\d{2})T(\d{2})(\d{2})(\d{2})(Z?)$/;
+    const match = regexp.exec(value);
+    if (!match) {
+        return undefined;
+    }
+    if (zone && !match[7]) {
+        const fields = match.slice(1, 7).map(function(field) {
+            return parseInt(field, 10);
+        });
+        const wall = Date.UTC(fields[0], fields[1] - 1, fields[2], fields[3],
+                              fields[4], fields[5]);
+        // The offset at the wall time itself may differ from the offset at
+        // the resulting time around daylight saving time changes
+        let millis = wall - weekly_zone_offset(zone, wall) * 60000;
+        millis = wall - weekly_zone_offset(zone, millis) * 60000;
+        return moment(new Date(millis).toISOString()).format();
+    }
+    return moment(match[1] + "-" + match[2] + "-" + match[3] + "T" + match[4] +
+                  ":" + match[5] + ":" + match[6] + match[7])
+        .format();
+}
+
+// Parse an iCalendar duration such as "PT1H30M" into seconds
+function weekly_parse_ics_duration(value) {
+    const regexp = new RegExp("^([+-])?P(?:(\\d+)W)?(?:(\\d+)D)?" +
+                              "(?:T(?:(\\d+)H)?(?:(\\d+)M)?(?:(\\d+)S)?)?$");
+    const match = regexp.exec(value);
+    if (!match) {
+        return NaN;
+    }
+    const units = [ 604800, 86400, 3600, 60, 1 ];
+    let seconds = 0;
+    units.forEach(function(unit, index) {
+        seconds += unit * parseInt(match[index + 2] || "0", 10);
+    });
+    return (match[1] === "-") ? -seconds : seconds;
+}
+
+// Parse the VEVENTs of an iCalendar file into events having the same fields
+// returned by weekly_filter_events. As with Google Calendar, all-day events
+// have no start and end time; recurring events are not expanded. Times with
+// a TZID parameter are in the named IANA time zone, and an error is thrown
+// when the zone is unknown.
+function weekly_parse_ics(text) {
+    const unescape = function(value) {
+        return value.replace(/\\([\\;,nN])/g, function(all, which) {
+            return (which === "n" || which === "N") ? "\n" : which;
+        });
+    };
+    const time = function(name) {
+        const zone = /;TZID=(?:"([^"]*)"|([^:;"]*))/i.exec(params[name] || "");
+        return weekly_parse_ics_time(current[name] || "",
+                                     zone ? zone[1] || zone[2] : undefined);
+    };
+    let result = [];
+    let current = null;
+    let params = {};
+    // Long lines are folded by inserting a newline and a space or a tab
+    text.replace(/\r?\n[ \t]/g, "").split(/\r?\n/).forEach(function(line) {
+        const match = /^([^:;]+)((?:;[^:;=]+=(?:"[^"]*"|[^:;"]*))*):(.*)$/
+                          .exec(line);
+        if (!match) {
+            return;
+        }
+        const name = match[1].toUpperCase();
+        const value = match[3];
+        if (name === "BEGIN" && value === "VEVENT") {
+            current = {};
+            params = {};
+        } else if (name === "END" && value === "VEVENT" && current) {
+            let end = time("DTEND");
+            const start = time("DTSTART");
+            if (!end && start && current.DURATION) {
+                end = moment(start)
+                          .add(weekly_parse_ics_duration(current.DURATION),
+                               "seconds")
+                          .format();
+            }
+            result.push({
+                id : current.UID && unescape(current.UID),
+                summary : unescape(current.SUMMARY || ""),
+                start : start,
+                end : end,
+                location : current.LOCATION && unescape(current.LOCATION),
+                description :
+                    current.DESCRIPTION && unescape(current.DESCRIPTION),
+                status : current.STATUS && current.STATUS.toLowerCase(),
+            });
+            current = null;
+        } else if (current && current[name] === undefined) {
+            current[name] = value;
+            params[name] = match[2];
+        }
+    });
+    return result;
+}
+
+// Replace the character and entity references of xml text
+function weekly_xml_unescape(text) {
+    const entities = {amp : "&", lt : "<", gt : ">", quot : "\"", apos : "'"};
+    return text.replace(/&(#x?[0-9a-fA-F]+|\w+);/g, function(all, name) {
+        if (name[0] !== "#") {
+            return entities[name] || all;
+        }
+        return String.fromCharCode((name[1] === "x")
+                                       ? parseInt(name.slice(2), 16)
+                                       : parseInt(name.slice(1), 10));
+    });
+}
+
+// Parse the events contained in the calendar-data elements of the response
+// to a CalDAV calendar-query, see weekly_parse_ics
+function weekly_parse_caldav(xml) {
+    const regexp = new RegExp("<(?:[\\w-]+:)?calendar-data[^>]*>([\\s\\S]*?)" +
+                                  "</(?:[\\w-]+:)?calendar-data>",
+                              "g");
+    let result = [];
+    let match;
+    while ((match = regexp.exec(xml)) !== null) {
+        const cdata = /^\s*<!\[CDATA\[([\s\S]*)\]\]>\s*$/.exec(match[1]);
+        result = result.concat(weekly_parse_ics(
+            cdata ? cdata[1] : weekly_xml_unescape(match[1])));
+    }
+    return result;
+}
+
+// Parse comma separated values, where cells may be enclosed in double
+// quotes (doubled inside the cell), into an array of rows of cells
+function weekly_parse_csv(text) {
+    let rows = [];
+    let row = [];
+    let cell = "";
+    let quoted = false;
+    for (let index = 0; index < text.length; ++index) {
+        const c = text[index];
+        if (quoted && c === "\"" && text[index + 1] === "\"") {
+            cell += c;
+            ++index;
+        } else if (c === "\"") {
+            quoted = !quoted;
+        } else if (quoted || (c !== "," && c !== "\n" && c !== "\r")) {
+            cell += c;
+        } else if (c === ",") {
+            row.push(cell);
+            cell = "";
+        } else if (c === "\n") {
+            row.push(cell);
+            rows.push(row);
+            row = [];
+            cell = "";
+        }
+    }
+    if (cell !== "" || row.length > 0) {
+        row.push(cell);
+        rows.push(row);
+    }
+    return rows;
+}
+
+// Convert comma separated values, whose header names the project, activity,
+// tags (separated by spaces), start (e.g. 2025-01-15 09:00), and duration
+// (see weekly_parse_duration) columns, into events, where only activity and
+// tags are optional, and return them along with the list of problems found
+function weekly_import_csv(text) {
+    const rows = weekly_parse_csv(text);
+    const header = (rows[0] || []).map(function(name) {
+        return name.trim().toLowerCase();
+    });
+    let result = {events : [], problems : []};
+    const missing = [ "project", "start", "duration" ].filter(function(name) {
+        return header.indexOf(name) < 0;
+    });
+    if (missing.length > 0) {
+        result.problems.push("row 1: missing columns: " + missing.join(", "));
+        return result;
+    }
+    rows.slice(1).forEach(function(row, index) {
+        const where = "row " + (index + 2) + ": ";
+        if (row.join("").trim() === "") {
+            return;
+        }
+        let cells = {};
+        header.forEach(function(name, column) {
+            cells[name] = (row[column] || "").trim();
+        });
+        const start = moment(cells.start, "YYYY-MM-DD HH:mm", true);
+        const duration = weekly_parse_duration(cells.duration);
+        if (cells.project === "") {
+            result.problems.push(where + "missing project");
+            return;
+        }
+        if (!start.isValid()) {
+            result.problems.push(where + "invalid start: '" + cells.start +
+                                 "'");
+            return;
+        }
+        if (!(duration > 0)) {
+            result.problems.push(where + "invalid duration: '" +
+                                 cells.duration + "'");
+            return;
+        }
+        const tags = (cells.tags || "").split(/\s+/).filter(function(tag) {
+            return tag !== "";
+        }).map(function(tag) {
+            return tag.startsWith(weekly_sigils.tag) ? tag
+                                                     : weekly_sigils.tag + tag;
+        });
+        result.events.push({
+            summary : [ cells.project, cells.activity || "" ]
+                          .concat(tags)
+                          .filter(function(word) { return word !== ""; })
+                          .join(" "),
+            start : start.format(),
+            end : start.clone().add(duration, "minutes").format(),
+        });
+    });
+    return result;
+}
+
+// Convert the json printed by "timew export" into events, where the first
+// tag of each interval without prefix (see weekly_sigils) is the project,
+// the following ones are tags, and the tags with a prefix, e.g. @alice, are
+// kept as they are, and return them along with the list of problems found
+function weekly_import_timewarrior(text) {
+    let result = {events : [], problems : []};
+    let intervals;
+    try {
+        intervals = JSON.parse(text);
+    } catch (error) {
+        result.problems.push("invalid json: " + error.message);
+        return result;
+    }
+    if (!Array.isArray(intervals)) {
+        result.problems.push("expected a list of intervals");
+        return result;
+    }
+    const prefixes = [ weekly_sigils.tag, weekly_sigils.person,
+                       weekly_sigils.field ];
+    intervals.forEach(function(interval, index) {
+        const where = "interval " + (index + 1) + ": ";
+        const start = weekly_parse_ics_time(interval.start);
+        const end = weekly_parse_ics_time(interval.end);
+        if (start === undefined) {
+            result.problems.push(where + "invalid start: '" + interval.start +
+                                 "'");
+            return;
+        }
+        if (interval.end === undefined) {
+            result.problems.push(where + "still open, stop it first");
+            return;
+        }
+        if (end === undefined) {
+            result.problems.push(where + "invalid end: '" + interval.end +
+                                 "'");
+            return;
+        }
+        let project;
+        let words = [];
+        (interval.tags || []).forEach(function(tag) {
+            let prefix = prefixes.find(function(prefix) {
+                return tag.startsWith(prefix);
+            });
+            if (prefix === undefined && project === undefined) {
+                project = tag;
+                return;
+            }
+            if (prefix === undefined) {
+                prefix = weekly_sigils.tag;
+                tag = prefix + tag;
+            }
+            const rest = tag.substr(prefix.length);
+            words.push(/\s/.test(rest) ? prefix + "\"" + rest + "\"" : tag);
+        });
+        if (project === undefined) {
+            result.problems.push(where + "missing project");
+            return;
+        }
+        result.events.push({
+            summary : [ project ].concat(words).join(" "),
+            start : start,
+            end : end,
+        });
+    });
+    return result;
+}
+
+// Only keep the events with a start time within window
+function weekly_filter_window(events, window) {
+    return events.filter(function(evt) {
+        const start = moment(evt.start);
+        return evt.start && !start.isBefore(window.start) &&
+               (!window.end || start.isBefore(window.end));
+    });
+}
+
+// Split window into consecutive windows, each within a calendar month, when
+// the window spans more than days days, and return it unchanged otherwise,
+// including when the window has no end
+function weekly_split_window(window, days) {
+    if (!window.end || window.end.diff(window.start, "days", true) <= days) {
+        return [ window ];
+    }
+    let result = [];
+    let start = window.start.clone();
+    while (start.isBefore(window.end)) {
+        let end = start.clone().startOf("month").add(1, "month");
+        if (end.isAfter(window.end)) {
+            end = window.end.clone();
+        }
+        result.push({start : start, end : end});
+        start = end;
+    }
+    return result;
+}
+
+// Compare events by start time and then by end time and summary, such that
+// sorting events always produces the same order
+function weekly_compare_events(left, right) {
+    return moment(left.start).diff(moment(right.start)) ||
+           moment(left.end).diff(moment(right.end)) ||
+           (left.summary || "").localeCompare(right.summary || "");
+}
+
+// Parse a duration such as "90m", "1.5h", "1h30", "1:30", or "90" (which
+// is taken to be in minutes) into minutes, returning NaN on failure
+function weekly_parse_duration(value) {
+    value = value.trim().toLowerCase();
+    const clock = /^(\d+):([0-5]\d)$/.exec(value);
+    if (clock) {
+        return parseInt(clock[1], 10) * 60 + parseInt(clock[2], 10);
+    }
+    const regexp = /^(?:(\d*\.?\d+)\s*h)?\s*(?:(\d*\.?\d+)\s*(?:m|min)?)?$/;
+    const match = regexp.exec(value);
+    if (!match || (match[1] === undefined && match[2] === undefined)) {
+        return NaN;
+    }
+    return parseFloat(match[1] || "0") * 60 + parseFloat(match[2] || "0");
+}
+
+// Return the duration of the event in minutes
+function weekly_event_minutes(evt) {
+    return moment(evt.end).diff(moment(evt.start), "minutes", true);
+}
+
+// Return a copy of evt where the field named by edit, in the field=value
+// form, is set to value: summary, start (keeping the duration), end, or
+// duration; throw an error when edit is not valid
+function weekly_edit_event(evt, edit) {
+    const index = edit.indexOf("=");
+    const field = edit.slice(0, Math.max(index, 0)).trim();
+    const value = edit.slice(index + 1).trim();
+    let result = Object.assign({}, evt);
+    if (field === "summary" && value !== "") {
+        result.summary = value;
+        return result;
+    }
+    if (field === "duration") {
+        const minutes = weekly_parse_duration(value);
+        if (!(minutes > 0)) {
+            throw new Error("invalid duration: '" + value + "'");
+        }
+        result.end = moment(evt.start).add(minutes, "minutes").format();
+        return result;
+    }
+    if (field === "start" || field === "end") {
+        const date = moment(value, "YYYY-MM-DD HH:mm", true);
+        if (!date.isValid()) {
+            throw new Error("invalid " + field + ": '" + value + "'");
+        }
+        if (field === "start") {
+            result.start = date.format();
+            result.end = date.clone()
+                             .add(weekly_event_minutes(evt), "minutes")
+                             .format();
+        } else if (date.isAfter(evt.start)) {
+            result.end = date.format();
+        } else {
+            throw new Error("the end must follow the start");
+        }
+        return result;
+    }
+    throw new Error("expected summary=, start=, end=, or duration=");
+}
+
+// Format the events of day (YYYY-MM-DD) as lines to edit (see
+// weekly_parse_day), each with the id of the event, if any, its start and
+// end times, and its summary, where all-day events, which have no start
+// time, are only listed as comments, since they cannot be edited
+function weekly_format_day(events, day) {
+    return "# Events of " + day + ", one per line, as in\n" +
+           "#   [id] HH:mm-HH:mm summary\n" +
+           "# Edit or remove lines to update or delete events, and add " +
+           "lines\n# without id to add events.\n" +
+           events.map(function(evt) {
+               if (evt.start === undefined) {
+                   return "# all day, cannot be edited: " + evt.summary + "\n";
+               }
+               return ((evt.id !== undefined) ? evt.id + " " : "") +
+                      moment(evt.start).format("HH:mm") + "-" +
+                      moment(evt.end).format("HH:mm") + " " + evt.summary +
+                      "\n";
+           }).join("");
+}
+
+// Parse the lines formatted by weekly_format_day for day (YYYY-MM-DD), where
+// empty lines and lines starting with # are ignored and an end before the
+// start means the next day, into the events and the problems found
+function weekly_parse_day(text, day) {
+    const regexp = /^(?:(\S+)\s+)?(\d\d?:\d\d)-(\d\d?:\d\d)\s+(\S.*)$/;
+    let result = {events : [], problems : []};
+    text.split("\n").forEach(function(line, index) {
+        line = line.trim();
+        if (line === "" || line[0] === "#") {
+            return;
+        }
+        const where = "line " + (index + 1) + ": ";
+        const match = regexp.exec(line);
+        if (!match) {
+            result.problems.push(where + "expected [id] HH:mm-HH:mm summary");
+            return;
+        }
+        const start = moment(day + " " + match[2], "YYYY-MM-DD H:mm", true);
+        let end = moment(day + " " + match[3], "YYYY-MM-DD H:mm", true);
+        if (!start.isValid() || !end.isValid() || end.isSame(start)) {
+            result.problems.push(where + "invalid times '" + match[2] + "-" +
+                                 match[3] + "'");
+            return;
+        }
+        if (end.isBefore(start)) {
+            end.add(1, "days");
+        }
+        let evt = {
+            summary : match[4],
+            start : start.format(),
+            end : end.format(),
+        };
+        if (match[1] !== undefined) {
+            evt = Object.assign({id : match[1]}, evt);
+        }
+        result.events.push(evt);
+    });
+    return result;
+}
+
+// Compare the events of a day before and after editing them, returning the
+// events to create, which have no id, to update, and to remove, and the
+// problems found, i.e. ids not among those of the events before editing or
+// appearing more than once
+function weekly_diff_day(before, after) {
+    let result = {create : [], update : [], remove : [], problems : []};
+    let seen = {};
+    after.forEach(function(evt) {
+        if (evt.id === undefined) {
+            result.create.push(evt);
+            return;
+        }
+        const old = before.filter(function(item) {
+            return item.id === evt.id;
+        })[0];
+        if (!old || seen[evt.id]) {
+            result.problems.push((old ? "duplicate" : "unknown") + " id '" +
+                                 evt.id + "'");
+            return;
+        }
+        seen[evt.id] = true;
+        if (old.summary !== evt.summary ||
+            !moment(old.start).isSame(evt.start) ||
+            !moment(old.end).isSame(evt.end)) {
+            result.update.push(evt);
+        }
+    });
+    result.remove = before.filter(function(evt) {
+        return evt.id !== undefined && !seen[evt.id];
+    });
+    return result;
+}
+
+// Return the events, to be written to a calendar containing the existing
+// events, and the conflicts found, i.e. the pairs of an event and an event it
+// overlaps, either existing or previously in events, except for the existing
+// events with the id that events get (see weekly_event_id), which are the
+// same events; with the shift policy, events are moved after the events they
+// overlap, keeping their duration
+function weekly_resolve_conflicts(events, existing, policy) {
+    const ids = events.map(weekly_event_id);
+    let result = {events : [], conflicts : []};
+    let taken = existing.filter(function(other) {
+        return ids.indexOf(other.id) < 0;
+    });
+    events.forEach(function(evt) {
+        const overlapping = function() {
+            return taken.filter(function(other) {
+                return moment(evt.start).isBefore(other.end) &&
+                       moment(other.start).isBefore(evt.end);
+            });
+        };
+        let others = overlapping();
+        others.forEach(function(other) {
+            result.conflicts.push({event : evt, other : other});
+        });
+        while (policy === "shift" && others.length > 0) {
+            let end = moment(others[0].end);
+            others.forEach(function(other) {
+                if (moment(other.end).isAfter(end)) {
+                    end = moment(other.end);
+                }
+            });
+            const minutes = weekly_event_minutes(evt);
+            evt = Object.assign({}, evt, {
+                start : end.format(),
+                end : end.clone().add(minutes, "minutes").format(),
+            });
+            others = overlapping();
+        }
+        taken.push(evt);
+        result.events.push(evt);
+    });
+    return result;
+}
+
+// Return the id of the calendar event created for evt, which is derived from
+// its summary, start, and end, so that adding the same event again, e.g.
+// when replaying a journal, is refused by the calendar rather than creating
+// a duplicate; only digits and the letters a-f are used, as required by the
+// Calendar API
+function weekly_event_id(evt) {
+    const key = JSON.stringify([
+        evt.summary, moment(evt.start).toISOString(),
+        moment(evt.end).toISOString()
+    ]);
+    return crypto.createHash("sha256").update(key).digest("hex").slice(0, 32);
+}
+
+// Parse events stored as json lines, as in the journal of the events to add
+// to a calendar and in the file of the local source, where each line
+// contains an object with the summary, start, end, and, optionally, the
+// description of an event, and throw an error telling the line of the
+// first invalid event
+function weekly_parse_journal(text) {
+    let events = [];
+    text.split("\n").forEach(function(line, index) {
+        if (line.trim() === "") {
+            return;
+        }
+        const fail = function(message) {
+            throw new Error("line " + (index + 1) + ": " + message);
+        };
+        let evt;
+        try {
+            evt = JSON.parse(line);
+        } catch (error) {
+            fail("invalid json");
+        }
+        if (evt === null || typeof evt !== "object" ||
+            typeof evt.summary !== "string") {
+            fail("expected an object with a summary");
+        }
+        const start = moment(String(evt.start), moment.ISO_8601, true);
+        const end = moment(String(evt.end), moment.ISO_8601, true);
+        if (typeof evt.start !== "string" || typeof evt.end !== "string" ||
+            !start.isValid() || !end.isValid()) {
+            fail("invalid start or end");
+        }
+        if (end.isBefore(start)) {
+            fail("end before start");
+        }
+        if (evt.description !== undefined &&
+            typeof evt.description !== "string") {
+            fail("invalid description");
+        }
+        events.push({
+            summary : evt.summary,
+            start : evt.start,
+            end : evt.end,
+            description : evt.description,
+        });
+    });
+    return events;
+}
+
+// Parse events in the format of the Calendar API stored as json lines, as
+// in the items of weekly_filter_events, where start and end are objects
+// containing either the dateTime of timed events or the date of all-day
+// events, and throw an error telling the line of the first invalid event
+function weekly_parse_raw_events(text) {
+    let items = [];
+    text.split("\n").forEach(function(line, index) {
+        if (line.trim() === "") {
+            return;
+        }
+        const fail = function(message) {
+            throw new Error("line " + (index + 1) + ": " + message);
+        };
+        let item;
+        try {
+            item = JSON.parse(line);
+        } catch (error) {
+            fail("invalid json");
+        }
+        if (item === null || typeof item !== "object" ||
+            (item.summary !== undefined && typeof item.summary !== "string")) {
+            fail("expected an object with an optional string summary");
+        }
+        const time = function(value) {
+            if (value === null || typeof value !== "object") {
+                return undefined;
+            }
+            if (typeof value.dateTime === "string") {
+                return moment(value.dateTime, moment.ISO_8601, true);
+            }
+            if (typeof value.date === "string") {
+                return moment(value.date, "YYYY-MM-DD", true);
+            }
+            return undefined;
+        };
+        const start = time(item.start);
+        const end = time(item.end);
+        if (!start || !end || !start.isValid() || !end.isValid() ||
+            typeof item.start.dateTime !== typeof item.end.dateTime) {
+            fail("expected start and end with either dateTime or date");
+        }
+        if (end.isBefore(start)) {
+            fail("end before start");
+        }
+        items.push(item);
+    });
+    return items;
+}
+
+// Return the Calendar API resource of evt, in the given IANA time zone, if
+// any
+function weekly_calendar_resource(evt, zone) {
+    let resource = {
+        summary : evt.summary,
+        start : {dateTime : moment(evt.start).format()},
+        end : {dateTime : moment(evt.end).format()},
+    };
+    if (zone) {
+        resource.start.timeZone = zone;
+        resource.end.timeZone = zone;
+    }
+    return resource;
+}
+
+// Check custom fields of events against schema, which maps each field name
+// to its type (string, integer, number, or date) and optional list of allowed
+// values, and return the list of problems found
+function weekly_check_fields(events, schema) {
+    const types = {
+        string : /^.*$/,
+        integer : /^-?\d+$/,
+        number : /^-?\d+(\.\d+)?$/,
+        date : /^\d{4}-\d{2}-\d{2}$/,
+    };
+    let problems = [];
+    events.forEach(function(evt) {
+        const fields = weekly_parse_summary(evt.summary).fields;
+        const where = moment(evt.start).format("YYYY-MM-DD HH:mm") + " '" +
+                      evt.summary + "': ";
+        Object.keys(fields).forEach(function(key) {
+            const rule = schema[key];
+            if (!rule) {
+                problems.push(where + "unknown field '" + key + "'");
+                return;
+            }
+            const type = rule.type || "string";
+            if (!types[type] || !types[type].test(fields[key])) {
+                problems.push(where + "field '" + key + "' is not " + type +
+                              ": '" + fields[key] + "'");
+                return;
+            }
+            if (rule.values && rule.values.indexOf(fields[key]) < 0) {
+                problems.push(where + "field '" + key + "' must be one of " +
+                              rule.values.join(", ") + ": '" + fields[key] +
+                              "'");
+            }
+        });
+    });
+    return problems;
+}
+
+// Merge team settings into local settings, where objects are merged
+// recursively and the team values replace local values with the same key,
+// so that a team shares the same projects, fields, and rates, while each
+// member may still have additional settings
+function weekly_merge_config(local, team) {
+    const is_object = function(value) {
+        return value !== null && typeof value === "object" &&
+               !Array.isArray(value);
+    };
+    if (!is_object(local) || !is_object(team)) {
+        return team;
+    }
+    let result = Object.assign({}, local);
+    Object.keys(team).forEach(function(key) {
+        result[key] = weekly_merge_config(local[key], team[key]);
+    });
+    return result;
+}
+
+// Tell whether the custom fields of the event have all the given values
+function weekly_match_fields(evt, fields) {
+    const parsed = weekly_parse_summary(evt.summary);
+    return Object.keys(fields).every(function(key) {
+        return parsed.fields[key] === fields[key];
+    });
+}
+
+// Tell whether the event has any of the given keys of dimension (see
+// weekly_dimension_keys), e.g. any of the given projects or tags
+function weekly_match_any(evt, dimension, keys) {
+    return weekly_dimension_keys(evt, dimension).some(function(key) {
+        return keys.indexOf(key) >= 0;
+    });
+}
+
+// Tell whether any of the keys of dimension of the event (see
+// weekly_dimension_keys) matches regexp, where tags have no leading prefix
+function weekly_match_regexp(evt, dimension, regexp) {
+    return weekly_dimension_keys(evt, dimension).some(function(key) {
+        return regexp.test((dimension === "tag")
+                               ? key.substr(weekly_sigils.tag.length)
+                               : key);
+    });
+}
+
+// Tell whether evt matches all the terms of query, ignoring case, where each
+// term must be within the summary, which includes tags and persons, or the
+// description, and terms within double quotes may contain spaces
+function weekly_search_event(evt, query) {
+    const text = ((evt.summary || "") + "\n" + (evt.description || ""))
+                     .toLowerCase();
+    return weekly_split_summary(query).every(function(term) {
+        return text.indexOf(term.replace(/"/g, "").toLowerCase()) >= 0;
+    });
+}
+
+// Names available to --filter expressions (see weekly_parse_filter), besides
+// fields.<key>, which is the value of the custom field key
+const weekly_filter_names = [
+    "attendees", "color", "creator", "date", "description", "duration",
+    "location", "persons", "project", "summary", "tags", "weekday"
+];
+
+// Split the --filter expression text into tokens, each with its kind
+// (string, number, operator, or name), its value, and its offset in text,
+// where numbers with a unit, e.g. 1h30, are durations in minutes
+function weekly_tokenize_filter(text) {
+    const patterns = [
+        [ "string", /^"(?:[^"\\]|\\.)*"/ ],
+        [ "number", /^\d*\.?\d+(?:h\d*|min|m)?/ ],
+        [ "operator", /^(?:&&|\|\||==|!=|<=|>=|[<>!()])/ ],
+        [ "name", /^[A-Za-z_][\w.]*/ ],
+    ];
+    let tokens = [];
+    let offset = 0;
+    while (offset < text.length) {
+        const space = /^\s*/.exec(text.slice(offset))[0].length;
+        offset += space;
+        if (offset >= text.length) {
+            break;
+        }
+        const rest = text.slice(offset);
+        const pattern = patterns.find(function(pattern) {
+            return pattern[1].test(rest);
+        });
+        if (!pattern && rest[0] === "\"") {
+            throw new Error("unterminated string at offset " + offset);
+        }
+        if (!pattern) {
+            throw new Error("unexpected '" + rest[0] + "' at offset " + offset);
+        }
+        const match = pattern[1].exec(rest)[0];
+        let value = match;
+        if (pattern[0] === "string") {
+            value = JSON.parse(match);
+        } else if (pattern[0] === "number") {
+            value = /[hm]/.test(match) ? weekly_parse_duration(match)
+                                       : parseFloat(match);
+        }
+        tokens.push({kind : pattern[0], value : value, offset : offset});
+        offset += match.length;
+    }
+    return tokens;
+}
+
+// Parse a --filter expression, such as 'project == "nexa" && duration > 1h
+// && "neubot" in tags', into a tree to be evaluated with weekly_eval_filter,
+// throwing an error telling where the expression is not valid. Expressions
+// compare names (see weekly_filter_names), strings, numbers, and durations
+// using ==, !=, <, <=, >, >=, and in (for lists and substrings), and combine
+// comparisons using !, &&, ||, and parentheses.
+function weekly_parse_filter(text) {
+    const tokens = weekly_tokenize_filter(text);
+    let index = 0;
+    const peek = function() { return tokens[index]; };
+    const where = function() {
+        return peek() ? "at offset " + peek().offset : "at end of filter";
+    };
+    const accept = function(value) {
+        const token = peek();
+        if (token && (token.kind === "operator" || token.kind === "name") &&
+            token.value === value) {
+            index += 1;
+            return true;
+        }
+        return false;
+    };
+    let expression;
+    const primary = function() {
+        const token = peek();
+        if (!token) {
+            throw new Error("unexpected end of filter");
+        }
+        if (accept("(")) {
+            const node = expression();
+            if (!accept(")")) {
+                throw new Error("expected ')' " + where());
+            }
+            return node;
+        }
+        index += 1;
+        if (token.kind === "string" || token.kind === "number") {
+            return {value : token.value};
+        }
+        if (token.kind === "name" &&
+            (weekly_filter_names.indexOf(token.value) >= 0 ||
+             /^fields\.[^.]+$/.test(token.value))) {
+            return {name : token.value};
+        }
+        if (token.kind === "name" && token.value !== "in") {
+            throw new Error("unknown name '" + token.value + "' at offset " +
+                            token.offset);
+        }
+        throw new Error("unexpected '" + token.value + "' at offset " +
+                        token.offset);
+    };
+    const comparison = function() {
+        const left = primary();
+        const operator = [ "==", "!=", "<=", ">=", "<", ">", "in" ].find(
+            function(operator) { return accept(operator); });
+        if (!operator) {
+            return left;
+        }
+        return {operator : operator, left : left, right : primary()};
+    };
+    const unary = function() {
+        if (accept("!")) {
+            return {operator : "!", left : unary()};
+        }
+        return comparison();
+    };
+    const binary = function(operator, operand) {
+        return function() {
+            let node = operand();
+            while (accept(operator)) {
+                node = {operator : operator, left : node, right : operand()};
+            }
+            return node;
+        };
+    };
+    expression = binary("||", binary("&&", unary));
+    const tree = expression();
+    if (peek()) {
+        throw new Error("unexpected '" + peek().value + "' " + where());
+    }
+    return tree;
+}
+
+// Tell whether the event matches the tree returned by weekly_parse_filter,
+// where tags and persons are lists without the leading # and @
+function weekly_eval_filter(tree, evt) {
+    const parsed = weekly_parse_summary(evt.summary);
+    const start = moment(evt.start);
+    const names = {
+        attendees : evt.attendees || [],
+        color : evt.color || "",
+        creator : evt.creator || "",
+        date : start.format("YYYY-MM-DD"),
+        description : evt.description || "",
+        duration : weekly_event_minutes(evt),
+        location : evt.location || "",
+        persons : parsed.persons.map(function(person) {
+            return person.substr(weekly_sigils.person.length);
+        }),
+        project : parsed.project,
+        summary : evt.summary || "",
+        tags : parsed.tags.map(function(tag) {
+            return tag.substr(weekly_sigils.tag.length);
+        }),
+        weekday : start.format("dddd"),
+    };
+    const truthy = function(value) {
+        return Array.isArray(value) ? value.length > 0 : Boolean(value);
+    };
+    const evaluate = function(node) {
+        if (node.name !== undefined) {
+            return node.name.startsWith("fields.")
+                       ? parsed.fields[node.name.substr(7)] || ""
+                       : names[node.name];
+        }
+        if (node.operator === undefined) {
+            return node.value;
+        }
+        const left = evaluate(node.left);
+        switch (node.operator) {
+        case "!":
+            return !truthy(left);
+        case "&&":
+            return truthy(left) && truthy(evaluate(node.right));
+        case "||":
+            return truthy(left) || truthy(evaluate(node.right));
+        }
+        const right = evaluate(node.right);
+        switch (node.operator) {
+        case "==":
+            return left === right;
+        case "!=":
+            return left !== right;
+        case "<":
+            return left < right;
+        case "<=":
+            return left <= right;
+        case ">":
+            return left > right;
+        case ">=":
+            return left >= right;
+        }
+        if (Array.isArray(right)) {
+            const item = String(left);
+            const prefix = [ weekly_sigils.tag, weekly_sigils.person ].find(
+                function(sigil) { return item.startsWith(sigil); });
+            return right.indexOf(prefix ? item.substr(prefix.length) : item) >=
+                   0;
+        }
+        return String(right).indexOf(String(left)) >= 0;
+    };
+    return truthy(evaluate(tree));
+}
+
+// Rename the project of the event according to aliases, which maps alias
+// names to canonical project names, after lowercasing it, and the aliases,
+// when lowercase is true (see weekly_rename_project)
+function weekly_alias_event(evt, aliases, lowercase) {
+    const parsed = weekly_parse_summary(evt.summary);
+    const normalize = function(name) {
+        return lowercase ? name.toLowerCase() : name;
+    };
+    let canonical = {};
+    Object.keys(aliases).forEach(function(alias) {
+        canonical[normalize(alias)] = aliases[alias];
+    });
+    let project = normalize(parsed.project);
+    if (Object.prototype.hasOwnProperty.call(canonical, project)) {
+        project = canonical[project];
+    }
+    return weekly_rename_project(evt, project);
+}
+
+// Roll the project of the event up to its top level, e.g. the client of the
+// client/project sub-project, such that reports show the client
+function weekly_rollup_event(evt) {
+    const project = weekly_parse_summary(evt.summary).project;
+    return weekly_rename_project(evt, project.split("/")[0]);
+}
+
+// Return the event with project as the project of its summary, keeping the
+// #tags, @persons, !key=value fields, and billable marker of the summary
+function weekly_rename_project(evt, project) {
+    if (project === weekly_parse_summary(evt.summary).project) {
+        return evt;
+    }
+    const words = weekly_split_summary(evt.summary).filter(function(word) {
+        return weekly_parse_summary(word).project === "";
+    });
+    return Object.assign({}, evt, {
+        summary : [ project ].concat(words).join(" "),
+    });
+}
+
+// Tell whether the time of the event is billable, according to the marker
+// in its summary (see weekly_billable_markers) or, without marker, to the
+// billable setting of its project in projects, by default false
+function weekly_is_billable(evt, projects) {
+    const parsed = weekly_parse_summary(evt.summary);
+    if (parsed.billable !== undefined) {
+        return parsed.billable;
+    }
+    const project = projects[parsed.project];
+    return Boolean(project && project.billable);
+}
+
+// Tell whether the summary of the event contains the ~ignore marker, which
+// excludes the event from all reports without deleting it from the calendar
+function weekly_is_ignored(evt) {
+    return (evt.summary || "").split(/\s+/).indexOf("~ignore") >= 0;
+}
+
+// Round the duration of the event to a multiple of the given number of
+// minutes, according to policy, by moving the end of the event
+function weekly_round_event(evt, minutes, policy) {
+    const rounders = {
+        up : Math.ceil,
+        down : Math.floor,
+        nearest : Math.round,
+    };
+    const increment = minutes * 60 * 1000;
+    const start = moment(evt.start);
+    const diff = moment(evt.end).diff(start);
+    const rounded = rounders[policy](diff / increment) * increment;
+    return Object.assign({}, evt, {
+        end : start.add(rounded, "milliseconds").toISOString(),
+    });
+}
+
+// Pass each event through stages, in order, where a stage returns the
+// event, possibly modified, a list of events, each passed through the next
+// stages, or undefined to drop it. Events are processed one at a time, so
+// long histories do not need an intermediate list for each stage.
+function weekly_run_stages(events, stages) {
+    let result = [];
+    const run = function(evt, stage) {
+        for (; stage < stages.length && evt && !Array.isArray(evt); ++stage) {
+            evt = stages[stage](evt);
+        }
+        if (Array.isArray(evt)) {
+            evt.forEach(function(piece) { run(piece, stage); });
+        } else if (evt) {
+            result.push(evt);
+        }
+    };
+    for (let index = 0; index < events.length; ++index) {
+        run(events[index], 0);
+    }
+    return result;
+}
+
+// Merge the events of the same project (or, without project, with the same
+// summary) that follow each other with at most gap minutes between them,
+// including overlapping ones, into a single event spanning from the start
+// of the first to the end of the last and keeping the summary of the first,
+// such that the gaps are counted, unless another event sits in the gap,
+// returning the events sorted by start time
+function weekly_coalesce_events(events, gap) {
+    const key = function(evt) {
+        const project = weekly_parse_summary(evt.summary).project;
+        return project ? "project:" + project : "summary:" + evt.summary;
+    };
+    let result = [];
+    let last = {};
+    let seen = [];
+    events.slice().sort(weekly_compare_events).forEach(function(evt) {
+        const previous = last[key(evt)];
+        const busy = previous && seen.some(function(other) {
+            return key(other) !== key(evt) &&
+                   moment(other.start).isBefore(evt.start) &&
+                   moment(other.end).isAfter(previous.end);
+        });
+        seen.push(evt);
+        if (previous && !busy &&
+            moment(evt.start).diff(moment(previous.end), "minutes", true) <=
+                gap) {
+            if (moment(evt.end).isAfter(moment(previous.end))) {
+                previous.end = evt.end;
+            }
+            return;
+        }
+        last[key(evt)] = Object.assign({}, evt);
+        result.push(last[key(evt)]);
+    });
+    return result;
+}
+
+// Split the event at local midnight, when it spans more than one day, into
+// a list of events with the same fields, one for each day
+function weekly_split_days(evt) {
+    let start = moment(evt.start);
+    const end = moment(evt.end);
+    let midnight = start.clone().startOf("day").add(1, "day");
+    if (!midnight.isBefore(end)) {
+        return evt;
+    }
+    let result = [];
+    while (start.isBefore(end)) {
+        const stop = midnight.isBefore(end) ? midnight : end;
+        result.push(Object.assign({}, evt, {
+            start : start.format(),
+            end : stop.format(),
+        }));
+        start = stop.clone();
+        midnight = midnight.clone().add(1, "day");
+    }
+    return result;
+}
+
+// Return the headers of a request to the Amazon S3 API (or to an S3
+// compatible API) signed using the AWS signature version 4, given the
+// method, the host, the already encoded path, the region, the extra headers
+// to sign, and the body of the request, the credentials (access_key,
+// secret_key, and, optionally, session_token), and the current date
+function weekly_s3_headers(request, credentials, now) {
+    const hash = function(data) {
+        return crypto.createHash("sha256").update(data).digest("hex");
+    };
+    const hmac = function(key, data) {
+        return crypto.createHmac("sha256", key).update(data).digest();
+    };
+    const amz_date = now.toISOString().replace(/[-:]|\.\d+/g, "");
+    const scope = amz_date.slice(0, 8) + "/" + request.region +
+                  "/s3/aws4_request";
+    let headers = {
+        "host" : request.host,
+        "x-amz-content-sha256" : hash(request.body),
+        "x-amz-date" : amz_date,
+    };
+    if (credentials.session_token) {
+        headers["x-amz-security-token"] = credentials.session_token;
+    }
+    Object.keys(request.headers || {}).forEach(function(name) {
+        headers[name.toLowerCase()] = String(request.headers[name]).trim();
+    });
+    const names = Object.keys(headers).sort();
+    const canonical = [
+        request.method, request.path, "",
+        names.map(function(name) {
+            return name + ":" + headers[name] + "\n";
+        }).join(""),
+        names.join(";"), headers["x-amz-content-sha256"]
+    ].join("\n");
+    const signed = [ "AWS4-HMAC-SHA256", amz_date, scope, hash(canonical) ]
+                       .join("\n");
+    let key = "AWS4" + credentials.secret_key;
+    [ amz_date.slice(0, 8), request.region, "s3", "aws4_request" ].forEach(
+        function(part) { key = hmac(key, part); });
+    headers["authorization"] = "AWS4-HMAC-SHA256 Credential=" +
+                               credentials.access_key + "/" + scope +
+                               ", SignedHeaders=" + names.join(";") +
+                               ", Signature=" +
+                               hmac(key, signed).toString("hex");
+    return headers;
+}
+
+// Format the footnotes telling how many events were excluded from a report
+// and why, given the number of events excluded for each reason, so that
+// totals are never silently smaller than the calendar suggests
+function weekly_format_footnotes(excluded) {
+    const reasons = Object.keys(excluded).sort();
+    let total = 0;
+    reasons.forEach(function(reason) { total += excluded[reason]; });
+    if (total === 0) {
+        return "";
+    }
+    let result = "Note: " + total + " event" + ((total > 1) ? "s" : "") +
+                 " excluded from this report:\n";
+    reasons.forEach(function(reason) {
+        result += "  " + excluded[reason] + " " + reason + "\n";
+    });
+    return result;
+}
+
 // Aggregate calendar events to produce statistics
 function weekly_aggregate_events(events) {
     let res = {
@@ -267,178 +2412,6070 @@ function weekly_aggregate_events(events) {
         percentage: {},
         total: 0.0,
     };
-    for (let index = 0; index < events.length; ++index) {
-        const evt = events[index];
-        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
-        res.total += diff;
-        res.details[evt.summary] = (res.details[evt.summary] | 0.0) + diff;
+    for (let index = 0; index < events.length; ++index) {
+        const evt = events[index];
+        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+        res.total += diff;
+        res.details[evt.summary] = (res.details[evt.summary] || 0.0) + diff;
+    }
+    Object.keys(res.details).forEach(function (key) {
+        // Without tracked time, every summary has a zero share
+        res.percentage[key] =
+            (res.total > 0) ? (res.details[key] / res.total) * 100.0 : 0.0;
+    });
+    return res;
+}
+
+// Convert aggregated statistics into a table with one row per summary,
+// including the budget of the project of each summary when options.budgets
+// maps some project to its budget in hours (see weekly_budget_hours), and
+// the billable hours when options.projects is the projects configuration
+// (see weekly_is_billable)
+function weekly_make_table(stats, options) {
+    const budgets = options.budgets || {};
+    const with_budget = Object.keys(budgets).length > 0;
+    let table = {
+        header : [ "summary", "hours" ],
+        rows : [],
+    };
+    if (options.percent) {
+        table.header.push("percent");
+    }
+    if (with_budget) {
+        table.header.push("budget");
+    }
+    if (options.projects) {
+        table.header.push("billable");
+    }
+    Object.keys(stats.details).sort().forEach(function(key) {
+        let row = [ key, stats.details[key].toFixed(2) ];
+        if (options.percent) {
+            row.push(stats.percentage[key].toFixed(2));
+        }
+        if (with_budget) {
+            const budget = budgets[weekly_parse_summary(key).project];
+            row.push((budget !== undefined) ? budget.toFixed(2) : "");
+        }
+        if (options.projects) {
+            const billable = weekly_is_billable({summary : key},
+                                                options.projects);
+            row.push(billable ? stats.details[key].toFixed(2) : "0.00");
+        }
+        table.rows.push(row);
+    });
+    return table;
+}
+
+// Return the budget in hours of each project within window, given the
+// monthly budget of each project, where windows shorter than a month get
+// the budget of a month and longer windows the one of their whole months
+function weekly_budget_hours(monthly, window) {
+    const end = window.end || moment();
+    const months = Math.max(1, Math.round(end.diff(window.start, "months",
+                                                   true)));
+    let result = {};
+    Object.keys(monthly).forEach(function(project) {
+        result[project] = monthly[project] * months;
+    });
+    return result;
+}
+
+// Build a table with the hours consumed by each project having a budget
+// (see weekly_budget_hours), the remaining hours, which are negative when
+// over budget, and the consumed percentage of the budget
+function weekly_make_budget_table(events, budgets) {
+    let consumed = {};
+    events.forEach(function(evt) {
+        const project = weekly_parse_summary(evt.summary).project;
+        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+        consumed[project] = (consumed[project] || 0.0) + diff;
+    });
+    return {
+        header : [ "project", "budget", "consumed", "remaining", "percent" ],
+        rows : Object.keys(budgets).sort().map(function(project) {
+            const hours = consumed[project] || 0.0;
+            return [
+                project, budgets[project].toFixed(2), hours.toFixed(2),
+                (budgets[project] - hours).toFixed(2),
+                (hours / budgets[project] * 100.0).toFixed(2)
+            ];
+        }),
+    };
+}
+
+// Return the start of the week containing the moment m, where week_start is
+// the day starting weeks (0 for Sunday, 1 for Monday)
+function weekly_start_of_week(m, week_start) {
+    return m.clone().startOf("day").subtract((m.day() - week_start + 7) % 7,
+                                             "days");
+}
+
+// Periods by which events may be aggregated, each returning the label of the
+// period containing the moment m, where week_start is the day starting weeks
+// (see weekly_start_of_week). Weeks are labeled using the ISO week of their
+// Monday, such that weeks starting on Sunday are labeled like the ISO week
+// starting on the next day.
+const weekly_periods = {
+    daily : function(m) { return m.format("YYYY-MM-DD"); },
+    weekly : function(m, week_start) {
+        const start = weekly_start_of_week(m, week_start);
+        if (week_start === 0) {
+            start.add(1, "day");
+        }
+        return start.format("GGGG-[W]WW");
+    },
+    monthly : function(m) { return m.format("YYYY-MM"); },
+};
+
+// Make a table with the hours spent on each summary in each period (see
+// weekly_periods), sorted by period and summary, or with the hours spent in
+// each period across all summaries, when total is true
+function weekly_make_period_table(events, period, week_start, total) {
+    let hours = {};
+    events.forEach(function(evt) {
+        const label = weekly_periods[period](moment(evt.start), week_start);
+        const key = total ? label : label + "\u0000" + evt.summary;
+        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+        hours[key] = (hours[key] || 0.0) + diff;
+    });
+    return {
+        header : total ? [ "period", "hours" ]
+                       : [ "period", "summary", "hours" ],
+        rows : Object.keys(hours).sort().map(function(key) {
+            return key.split("\u0000").concat(hours[key].toFixed(2));
+        }),
+    };
+}
+
+// Parse a template where {{name}} is replaced by the value of name (which
+// may be a dotted path), {{#name}}..{{/name}} is rendered once for each item
+// when name is a list or once when it is true, {{^name}}..{{/name}} is
+// rendered when name is false or empty, and {{.}} is the current item
+function weekly_parse_template(template) {
+    const regexp = /\{\{\s*([#^\/]?)\s*([\w.]+)\s*\}\}/g;
+    let root = {
+        children : [],
+    };
+    let stack = [ root ];
+    let offset = 0;
+    let match;
+    while ((match = regexp.exec(template)) !== null) {
+        let current = stack[stack.length - 1];
+        current.children.push(template.substring(offset, match.index));
+        offset = regexp.lastIndex;
+        if (match[1] === "/") {
+            if (stack.length <= 1 || current.name !== match[2]) {
+                throw new Error("unexpected {{/" + match[2] + "}}");
+            }
+            stack.pop();
+        } else if (match[1] !== "") {
+            let section = {
+                name : match[2],
+                inverted : (match[1] === "^"),
+                children : [],
+            };
+            current.children.push(section);
+            stack.push(section);
+        } else {
+            current.children.push({
+                name : match[2],
+            });
+        }
+    }
+    if (stack.length > 1) {
+        throw new Error("missing {{/" + stack[stack.length - 1].name + "}}");
+    }
+    root.children.push(template.substring(offset));
+    return root;
+}
+
+// Render each string within the JSON value template as a template (see
+// weekly_parse_template) using view, returning the resulting value
+function weekly_make_payload(template, view) {
+    if (typeof template === "string") {
+        return weekly_render_template(weekly_parse_template(template), view);
+    }
+    if (Array.isArray(template)) {
+        return template.map(function(item) {
+            return weekly_make_payload(item, view);
+        });
+    }
+    if (template !== null && typeof template === "object") {
+        let result = {};
+        Object.keys(template).forEach(function(key) {
+            result[key] = weekly_make_payload(template[key], view);
+        });
+        return result;
+    }
+    return template;
+}
+
+// Build an email message, with CRLF line endings, from message, which
+// contains the from address, the list of to addresses, the subject, the
+// content type (e.g. text/html), the text, and the date
+function weekly_make_email(message) {
+    const encode = function(text) {
+        return /^[\x20-\x7e]*$/.test(text)
+                   ? text
+                   : "=?UTF-8?B?" + Buffer.from(text).toString("base64") + "?=";
+    };
+    const body = Buffer.from(message.text).toString("base64");
+    let lines = [
+        "From: " + message.from,
+        "To: " + message.to.join(", "),
+        "Subject: " + encode(message.subject),
+        "Date: " + moment(message.date).format("ddd, DD MMM YYYY HH:mm:ss ZZ"),
+        "MIME-Version: 1.0",
+        "Content-Type: " + message.type + "; charset=utf-8",
+        "Content-Transfer-Encoding: base64",
+        "",
+    ];
+    for (let offset = 0; offset < body.length; offset += 76) {
+        lines.push(body.substr(offset, 76));
+    }
+    return lines.join("\r\n") + "\r\n";
+}
+
+// Render template parsed by weekly_parse_template using view
+function weekly_render_template(template, view) {
+    const lookup = function(stack, name) {
+        if (name === ".") {
+            return stack[stack.length - 1];
+        }
+        const path = name.split(".");
+        for (let index = stack.length - 1; index >= 0; --index) {
+            let value = stack[index];
+            if (value === null || typeof value !== "object" ||
+                !(path[0] in value)) {
+                continue;
+            }
+            path.forEach(function(key) {
+                value = (value === null || value === undefined) ? undefined
+                                                                : value[key];
+            });
+            return value;
+        }
+        return undefined;
+    };
+    const render = function(node, stack) {
+        return node.children.map(function(child) {
+            if (typeof child === "string") {
+                return child;
+            }
+            const value = lookup(stack, child.name);
+            if (child.children === undefined) {
+                return (value === null || value === undefined) ? ""
+                                                               : String(value);
+            }
+            const items = Array.isArray(value) ? value
+                                               : (value ? [ value ] : []);
+            if (child.inverted) {
+                return (items.length === 0) ? render(child, stack) : "";
+            }
+            return items.map(function(item) {
+                return render(child, stack.concat([ item ]));
+            }).join("");
+        }).join("");
+    };
+    return render(template, [ view ]);
+}
+
+// Tell whether each column of the table only contains numbers
+function weekly_numeric_columns(table) {
+    return table.header.map(function(name, index) {
+        return table.rows.some(function(row) {
+            return row[index] !== "";
+        }) && table.rows.every(function(row) {
+            return row[index] === "" || /^-?\d+(\.\d+)?$/.test(row[index]);
+        });
+    });
+}
+
+// Prefixes marking the #tags, @persons, and !key=value custom fields of
+// summaries, which may be changed using weekly_set_sigils
+let weekly_sigils = {
+    tag : "#",
+    person : "@",
+    field : "!",
+};
+
+// Change the prefixes of summaries (see weekly_sigils) to the ones given in
+// sigils, e.g. {tag : "+"}, keeping the others unchanged
+function weekly_set_sigils(sigils) {
+    weekly_sigils = Object.assign({}, weekly_sigils, sigils);
+}
+
+// Markers telling whether the time of an event is billable, which follow the
+// prefix of custom fields, e.g. !billable and !internal
+const weekly_billable_markers = {
+    billable : true,
+    internal : false,
+};
+
+// Split summary into words separated by spaces, where the spaces within
+// double quotes, as in #"code review" or @"John Smith", do not separate words
+function weekly_split_summary(summary) {
+    return (summary || "").match(/(?:[^\s"]|"[^"]*"|")+/g) || [];
+}
+
+// Split summary into #tags, @persons, !key=value custom fields, the billable
+// marker (see weekly_billable_markers), and the remaining words, which are
+// taken to be the name of the project, using the prefixes of weekly_sigils.
+// Tags, persons, and values of custom fields may contain spaces when they
+// are quoted (see weekly_split_summary), and their quotes are removed.
+function weekly_parse_summary(summary) {
+    let result = {
+        project : "",
+        tags : [],
+        persons : [],
+        fields : {},
+        billable : undefined,
+    };
+    const sigils = weekly_sigils;
+    const unquote = function(word) { return word.replace(/"/g, ""); };
+    const marked = function(word, prefix) {
+        return unquote(word).length > prefix.length && word.startsWith(prefix);
+    };
+    let words = [];
+    weekly_split_summary(summary).forEach(function(word) {
+        const rest = word.substr(sigils.field.length);
+        const equal = rest.indexOf("=");
+        if (marked(word, sigils.field) && equal > 0) {
+            result.fields[rest.substr(0, equal)] =
+                unquote(rest.substr(equal + 1));
+        } else if (marked(word, sigils.field) &&
+                   Object.prototype.hasOwnProperty.call(
+                       weekly_billable_markers, rest)) {
+            result.billable = weekly_billable_markers[rest];
+        } else if (marked(word, sigils.tag)) {
+            result.tags.push(unquote(word).toLowerCase());
+        } else if (marked(word, sigils.person)) {
+            result.persons.push(unquote(word).toLowerCase());
+        } else if (word.length > 0) {
+            words.push(word);
+        }
+    });
+    result.project = words.join(" ");
+    return result;
+}
+
+// Columns of the events table shown unless others are selected
+const weekly_events_columns = [ "date", "start", "end", "hours", "summary" ];
+
+// Build a table listing events sorted by start time, including all the
+// available columns (see weekly_select_columns)
+function weekly_make_events_table(events) {
+    let table = {
+        header : [
+            "date", "start", "end", "hours", "summary", "project", "tags",
+            "persons", "location", "attendees", "color", "creator",
+            "description", "id", "link"
+        ],
+        rows : [],
+    };
+    events.slice().sort(function(left, right) {
+        return weekly_compare_events(left, right);
+    }).forEach(function(evt) {
+        const start = moment(evt.start);
+        const end = moment(evt.end);
+        const parsed = weekly_parse_summary(evt.summary);
+        table.rows.push([
+            start.format("YYYY-MM-DD"), start.format("HH:mm"),
+            end.format("HH:mm"), end.diff(start, "hours", true).toFixed(2),
+            evt.summary || "", parsed.project, parsed.tags.join(" "),
+            parsed.persons.join(" "), evt.location || "",
+            (evt.attendees || []).join(" "), evt.color || "", evt.creator || "",
+            evt.description || "", evt.id || "", evt.link || ""
+        ]);
+    });
+    return table;
+}
+
+// Return a table only containing the named columns in the given order
+function weekly_select_columns(table, names) {
+    const indexes = names.map(function(name) {
+        const index = table.header.indexOf(name);
+        if (index < 0) {
+            throw new Error("unknown column '" + name + "'");
+        }
+        return index;
+    });
+    return {
+        header : indexes.map(function(index) { return table.header[index]; }),
+        rows : table.rows.map(function(row) {
+            return indexes.map(function(index) { return row[index]; });
+        }),
+    };
+}
+
+// Build a person by project table containing the hours spent with each
+// collaborator, i.e. the @persons mentioned in the events summary
+function weekly_make_collab_table(events) {
+    let matrix = {};
+    let projects = {};
+    events.forEach(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+        projects[parsed.project] = true;
+        parsed.persons.forEach(function(person) {
+            matrix[person] = matrix[person] || {};
+            matrix[person][parsed.project] =
+                (matrix[person][parsed.project] || 0.0) + diff;
+        });
+    });
+    const columns = Object.keys(projects).sort().filter(function(project) {
+        return Object.keys(matrix).some(function(person) {
+            return matrix[person][project] !== undefined;
+        });
+    });
+    let table = {
+        header : [ "person" ].concat(columns, [ "total" ]),
+        rows : [],
+    };
+    Object.keys(matrix).sort().forEach(function(person) {
+        let total = 0.0;
+        let row = [ person ];
+        columns.forEach(function(project) {
+            const hours = matrix[person][project] || 0.0;
+            total += hours;
+            row.push(hours.toFixed(2));
+        });
+        row.push(total.toFixed(2));
+        table.rows.push(row);
+    });
+    return table;
+}
+
+// Build a table listing each project of events, most worked on first, with
+// the hours spent on it, the date of its most recent event, and the number
+// of its events
+function weekly_make_projects_table(events) {
+    return weekly_make_seen_table(events, "project");
+}
+
+// Build a table listing each value of dimension, which is project, tag, or
+// person, seen in events, most worked on first, with the hours spent on it,
+// the date of its most recent event, and the number of its events
+function weekly_make_seen_table(events, dimension) {
+    let seen = {};
+    events.forEach(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        const names = (dimension === "project") ? [ parsed.project ]
+                                                : parsed[dimension + "s"];
+        const start = moment(evt.start);
+        const hours = moment(evt.end).diff(start, "hours", true);
+        names.forEach(function(name) {
+            seen[name] = seen[name] || {hours : 0.0, last : start, count : 0};
+            seen[name].hours += hours;
+            seen[name].count += 1;
+            if (start.isAfter(seen[name].last)) {
+                seen[name].last = start;
+            }
+        });
+    });
+    return {
+        header : [ dimension, "hours", "last", "events" ],
+        rows : Object.keys(seen).sort(function(left, right) {
+            return seen[right].hours - seen[left].hours ||
+                   left.localeCompare(right);
+        }).map(function(name) {
+            return [
+                name, seen[name].hours.toFixed(2),
+                seen[name].last.format("YYYY-MM-DD"), String(seen[name].count)
+            ];
+        }),
+    };
+}
+
+// Build invoice grouping projects by client and applying the per-project
+// rates; projects without a rate, or whose rate is not a number, are not
+// billed and are returned separately
+function weekly_make_invoice(events, rates) {
+    let hours = {};
+    events.forEach(function(evt) {
+        const project = weekly_parse_summary(evt.summary).project;
+        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+        hours[project] = (hours[project] || 0.0) + diff;
+    });
+    let invoice = {
+        currency : rates.currency || "",
+        clients : [],
+        unbilled : [],
+        net : 0.0,
+        vat_rate : rates.vat || 0.0,
+        vat : 0.0,
+        total : 0.0,
+    };
+    let clients = {};
+    Object.keys(hours).sort().forEach(function(project) {
+        const info = (rates.projects || {})[project];
+        if (!info || typeof info.rate !== "number" || !isFinite(info.rate)) {
+            invoice.unbilled.push(project);
+            return;
+        }
+        const name = info.client || project;
+        if (!clients[name]) {
+            clients[name] = {
+                client : name,
+                items : [],
+                subtotal : 0.0,
+            };
+            invoice.clients.push(clients[name]);
+        }
+        const amount = hours[project] * info.rate;
+        clients[name].items.push({
+            project : project,
+            hours : hours[project],
+            rate : info.rate,
+            amount : amount,
+        });
+        clients[name].subtotal += amount;
+        invoice.net += amount;
+    });
+    invoice.clients.sort(function(left, right) {
+        return left.client.localeCompare(right.client);
+    });
+    invoice.vat = invoice.net * invoice.vat_rate / 100.0;
+    invoice.total = invoice.net + invoice.vat;
+    return invoice;
+}
+
+// Convert invoice into a table with line items, subtotals, and totals
+function weekly_make_invoice_table(invoice) {
+    let table = {
+        header : [ "client", "project", "hours", "rate", "amount" ],
+        rows : [],
+    };
+    invoice.clients.forEach(function(client) {
+        client.items.forEach(function(item) {
+            table.rows.push([
+                client.client, item.project, item.hours.toFixed(2),
+                item.rate.toFixed(2), item.amount.toFixed(2)
+            ]);
+        });
+        table.rows.push([
+            client.client, "subtotal", "", "", client.subtotal.toFixed(2)
+        ]);
+    });
+    table.rows.push([ "", "net", "", "", invoice.net.toFixed(2) ]);
+    table.rows.push([
+        "", "vat " + invoice.vat_rate + "%", "", "", invoice.vat.toFixed(2)
+    ]);
+    table.rows.push([
+        "", "total " + invoice.currency, "", "", invoice.total.toFixed(2)
+    ]);
+    return table;
+}
+
+// Dimensions by which events can be grouped, besides field:<key>
+const weekly_dimensions = [ "project", "tag", "person", "summary" ];
+
+// Return the keys under which event is accounted when grouping by the
+// given dimension, i.e. project, tag, person, or summary
+function weekly_dimension_keys(evt, dimension) {
+    const parsed = weekly_parse_summary(evt.summary);
+    switch (dimension) {
+    case "project":
+        return [ parsed.project ];
+    case "tag":
+        return parsed.tags;
+    case "person":
+        return parsed.persons;
+    case "summary":
+        return [ evt.summary || "" ];
+    }
+    if (dimension.startsWith("field:")) {
+        const value = parsed.fields[dimension.substr("field:".length)];
+        return (value !== undefined) ? [ value ] : [];
+    }
+    throw new Error("weekly-unknown-dimension");
+}
+
+// Build a table with the count keys of dimension that consumed more time
+// within window, including percentage of total and a sparkline trend, which
+// are zero, and flat, when no time was tracked
+function weekly_make_top_table(events, dimension, count, window) {
+    const sparks = "\u2581\u2582\u2583\u2584\u2585\u2586\u2587\u2588";
+    const start = window.start.valueOf();
+    const span = (window.end || moment()).valueOf() - start;
+    const buckets = Math.max(1, Math.min(12, Math.ceil(span / 86400000)));
+    let totals = {};
+    let trends = {};
+    let total = 0.0;
+    events.forEach(function(evt) {
+        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+        const offset = moment(evt.start).valueOf() - start;
+        const bucket =
+            (span > 0) ? Math.min(buckets - 1,
+                                  Math.max(0, Math.floor(offset / span *
+                                                         buckets)))
+                       : 0;
+        total += diff;
+        weekly_dimension_keys(evt, dimension).forEach(function(key) {
+            totals[key] = (totals[key] || 0.0) + diff;
+            trends[key] = trends[key] || new Array(buckets).fill(0.0);
+            trends[key][bucket] += diff;
+        });
+    });
+    let table = {
+        header : [ "rank", dimension, "hours", "percent", "trend" ],
+        rows : [],
+    };
+    Object.keys(totals).sort(function(left, right) {
+        return (totals[right] - totals[left]) || left.localeCompare(right);
+    }).slice(0, count).forEach(function(key, index) {
+        const max = Math.max.apply(null, trends[key]);
+        table.rows.push([
+            String(index + 1), key, totals[key].toFixed(2),
+            ((total > 0) ? totals[key] / total * 100.0 : 0.0).toFixed(2),
+            trends[key].map(function(hours) {
+                const level = (max > 0) ? hours / max : 0.0;
+                return sparks[Math.round(level * (sparks.length - 1))];
+            }).join("")
+        ]);
+    });
+    return table;
+}
+
+// Hours of a working day, used to compute the tracked ratio of --stats
+const weekly_working_day_hours = 8;
+
+// Build a table with summary statistics of events within window, which are
+// meant for retrospectives: the average hours of days with events, the
+// busiest weekday, the longest event, the number of distinct projects, tags,
+// and persons, and the ratio of tracked hours to working days hours
+function weekly_make_stats_table(events, window) {
+    const end = window.end || moment();
+    let working_days = 0;
+    for (let day = window.start.clone().startOf("day"); day.isBefore(end);
+         day.add(1, "day")) {
+        if (day.isoWeekday() <= 5) {
+            working_days += 1;
+        }
+    }
+    let total = 0.0;
+    let days = {};
+    let weekdays = {};
+    let longest;
+    let longest_hours = 0.0;
+    let distinct = {projects : {}, tags : {}, persons : {}};
+    events.forEach(function(evt) {
+        const start = moment(evt.start);
+        const diff = moment(evt.end).diff(start, "hours", true);
+        const parsed = weekly_parse_summary(evt.summary);
+        total += diff;
+        days[start.format("YYYY-MM-DD")] = true;
+        weekdays[start.format("dddd")] =
+            (weekdays[start.format("dddd")] || 0.0) + diff;
+        if (longest === undefined || diff > longest_hours) {
+            longest = evt;
+            longest_hours = diff;
+        }
+        distinct.projects[parsed.project] = true;
+        parsed.tags.forEach(function(tag) { distinct.tags[tag] = true; });
+        parsed.persons.forEach(function(person) {
+            distinct.persons[person] = true;
+        });
+    });
+    const busiest = Object.keys(weekdays).sort(function(left, right) {
+        return weekdays[right] - weekdays[left];
+    })[0];
+    const tracked_days = Object.keys(days).length;
+    const ratio = working_days > 0
+                      ? total / (working_days * weekly_working_day_hours)
+                      : 0.0;
+    return {
+        header : [ "statistic", "value" ],
+        rows : [
+            [ "hours", total.toFixed(2) ],
+            [
+                "hours per tracked day",
+                (tracked_days > 0 ? total / tracked_days : 0.0).toFixed(2)
+            ],
+            [ "busiest weekday", busiest || "" ],
+            [
+                "longest event",
+                longest ? longest.summary + " (" + longest_hours.toFixed(2) +
+                              " hours)"
+                        : ""
+            ],
+            [ "projects", String(Object.keys(distinct.projects).length) ],
+            [ "tags", String(Object.keys(distinct.tags).length) ],
+            [ "persons", String(Object.keys(distinct.persons).length) ],
+            [ "working days", String(working_days) ],
+            [ "tracked percent", (ratio * 100.0).toFixed(2) ],
+        ],
+    };
+}
+
+// Build a table comparing, for each key of dimension, the hours spent in
+// the before and after events, with the difference and a marker telling
+// whether time increased or decreased, sorted by decreasing difference
+function weekly_make_diff_table(before, after, dimension) {
+    let hours = {};
+    const add = function(events, index) {
+        events.forEach(function(evt) {
+            const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+            weekly_dimension_keys(evt, dimension).forEach(function(key) {
+                hours[key] = hours[key] || [ 0.0, 0.0 ];
+                hours[key][index] += diff;
+            });
+        });
+    };
+    add(before, 0);
+    add(after, 1);
+    const delta = function(key) {
+        return Number((hours[key][1] - hours[key][0]).toFixed(2));
+    };
+    return {
+        header : [ dimension, "before", "after", "delta", "change" ],
+        rows : Object.keys(hours).sort(function(left, right) {
+            return (delta(right) - delta(left)) || left.localeCompare(right);
+        }).map(function(key) {
+            return [
+                key, hours[key][0].toFixed(2), hours[key][1].toFixed(2),
+                delta(key).toFixed(2),
+                (delta(key) > 0) ? "\u25b2" : (delta(key) < 0) ? "\u25bc" : ""
+            ];
+        }),
+    };
+}
+
+// Build a table listing the events tagged with any of the given tags, with
+// dates and durations formatted as usually required by expense claims
+function weekly_make_expenses_table(events, tags) {
+    let table = {
+        header : [ "date", "start", "end", "hours", "tag", "summary",
+                   "location" ],
+        rows : [],
+    };
+    events.slice().sort(function(left, right) {
+        return weekly_compare_events(left, right);
+    }).forEach(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        const tag = tags.find(function(tag) {
+            return parsed.tags.indexOf(tag.toLowerCase()) >= 0;
+        });
+        if (!tag) {
+            return;
+        }
+        const start = moment(evt.start);
+        const end = moment(evt.end);
+        table.rows.push([
+            start.format("YYYY-MM-DD"), start.format("HH:mm"),
+            end.format("HH:mm"), end.diff(start, "hours", true).toFixed(2),
+            tag, evt.summary, evt.location || ""
+        ]);
+    });
+    return table;
+}
+
+// Colors that can be assigned to projects, with their ANSI and HTML codes
+const weekly_colors = {
+    red : {ansi : 31, html : "#c0392b"},
+    green : {ansi : 32, html : "#27ae60"},
+    yellow : {ansi : 33, html : "#b7950b"},
+    blue : {ansi : 34, html : "#2e86c1"},
+    magenta : {ansi : 35, html : "#8e44ad"},
+    cyan : {ansi : 36, html : "#17a589"},
+};
+
+// Return the color and the label of project according to projects, which
+// maps projects to their optional color and label; when the color is not
+// configured, it is chosen by hashing the project name, so that it does not
+// change across runs and outputs
+function weekly_project_style(project, projects) {
+    const config = (projects || {})[project] || {};
+    let color = config.color;
+    if (!color) {
+        const names = Object.keys(weekly_colors);
+        let hash = 5381;
+        for (let index = 0; index < project.length; ++index) {
+            hash = ((hash * 33) ^ project.charCodeAt(index)) >>> 0;
+        }
+        color = names[hash % names.length];
+    }
+    return {
+        color : weekly_colors[color],
+        label : config.label || "",
+    };
+}
+
+// Return the index of the column identifying the project of each row, i.e.
+// the project column or, failing that, the summary column or the first
+// text column, or -1 if there is no such column
+function weekly_project_column(table) {
+    const index = [ "project", "summary" ].map(function(name) {
+        return table.header.indexOf(name);
+    }).find(function(index) { return index >= 0; });
+    return (index !== undefined) ? index
+                                 : weekly_numeric_columns(table).indexOf(false);
+}
+
+// Return the style of the project of row (see weekly_project_style) or
+// undefined if the row contains totals or no project
+function weekly_row_style(table, row, column, projects) {
+    if (column < 0 || weekly_is_total_row(row)) {
+        return undefined;
+    }
+    const project = (table.header[column] === "project")
+                        ? row[column]
+                        : weekly_parse_summary(row[column]).project;
+    return project ? weekly_project_style(project, projects) : undefined;
+}
+
+// Return a copy of row where the project cell is prefixed with the label of
+// the project, if any
+function weekly_label_row(row, column, style) {
+    if (!style || !style.label) {
+        return row;
+    }
+    return row.map(function(cell, index) {
+        return (index === column) ? style.label + " " + cell : cell;
+    });
+}
+
+// Tell whether a table row contains totals rather than data
+function weekly_is_total_row(row) {
+    return row.some(function(cell) {
+        return /^(total|subtotal|net|vat)\b/.test(cell);
+    });
+}
+
+// Format table as a box drawn with ASCII characters, where projects are
+// labeled according to options.projects; when options.color is set, rows
+// are colored by project and the header and totals are bold
+function weekly_format_box(table, options) {
+    const numeric = weekly_numeric_columns(table);
+    const column = weekly_project_column(table);
+    const styles = table.rows.map(function(row) {
+        return weekly_row_style(table, row, column, options.projects);
+    });
+    const rows = table.rows.map(function(row, index) {
+        return weekly_label_row(row, column, styles[index]);
+    });
+    const widths = table.header.map(function(name, index) {
+        let width = name.length;
+        rows.forEach(function(row) {
+            width = Math.max(width, row[index].length);
+        });
+        return width;
+    });
+    const border = "+" + widths.map(function(width) {
+        return "-".repeat(width + 2);
+    }).join("+") + "+\n";
+    const line = function(row, style) {
+        return "| " + row.map(function(cell, index) {
+            cell = numeric[index] ? cell.padStart(widths[index])
+                                  : cell.padEnd(widths[index]);
+            return style ? style + cell + "\x1b[0m" : cell;
+        }).join(" | ") + " |\n";
+    };
+    const escape = function(row, index) {
+        if (!options.color) {
+            return "";
+        }
+        if (weekly_is_total_row(row)) {
+            return "\x1b[1m";
+        }
+        return styles[index] ? "\x1b[" + styles[index].color.ansi + "m" : "";
+    };
+    let result = border +
+                 line(table.header, options.color ? "\x1b[1m" : "") + border;
+    rows.forEach(function(row, index) {
+        result += line(row, escape(row, index));
+    });
+    return result + border;
+}
+
+// Format table as comma separated values, optionally preceded by a header
+function weekly_format_csv(table, options) {
+    const quote = function(cell) {
+        if (/[",\r\n]/.test(cell)) {
+            return "\"" + cell.replace(/"/g, "\"\"") + "\"";
+        }
+        return cell;
+    };
+    let result = "";
+    if (options.header) {
+        result += table.header.map(quote).join(",") + "\n";
+    }
+    table.rows.forEach(function(row) {
+        result += row.map(quote).join(",") + "\n";
+    });
+    return result;
+}
+
+// Format table as a markdown table
+function weekly_format_markdown(table) {
+    const numeric = weekly_numeric_columns(table);
+    const line = function(row) {
+        return "| " + row.map(function(cell) {
+            return cell.replace(/\|/g, "\\|");
+        }).join(" | ") + " |\n";
+    };
+    let result = line(table.header);
+    result += "|" + numeric.map(function(isnum) {
+        return isnum ? " ---: " : " --- ";
+    }).join("|") + "|\n";
+    table.rows.forEach(function(row) { result += line(row); });
+    return result;
+}
+
+// Convert table rows into objects whose keys follow the header order and
+// whose numeric values are numbers (or null when empty)
+function weekly_table_objects(table) {
+    const numeric = weekly_numeric_columns(table);
+    return table.rows.map(function(row) {
+        let result = {};
+        row.forEach(function(text, index) {
+            if (numeric[index]) {
+                result[table.header[index]] =
+                    (text !== "") ? parseFloat(text) : null;
+            } else {
+                result[table.header[index]] = text;
+            }
+        });
+        return result;
+    });
+}
+
+// Format table as newline delimited JSON objects
+function weekly_format_json(table, options) {
+    return weekly_table_objects(table).map(function(object) {
+        return JSON.stringify(object, undefined, options.pretty ? 4 : 0) +
+               "\n";
+    }).join("");
+}
+
+// Format table as a single JSON array of objects
+function weekly_format_json_array(table, options) {
+    return JSON.stringify(weekly_table_objects(table), undefined,
+                          options.pretty ? 4 : 0) + "\n";
+}
+
+// Format table as a YAML list of objects whose keys follow the header order
+function weekly_format_yaml(table) {
+    const numeric = weekly_numeric_columns(table);
+    const key = function(name) {
+        return /^[A-Za-z_][\w-]*$/.test(name) ? name : JSON.stringify(name);
+    };
+    const value = function(text, index) {
+        return (numeric[index] && text !== "") ? text : JSON.stringify(text);
+    };
+    if (table.rows.length === 0) {
+        return "[]\n";
+    }
+    let result = "";
+    table.rows.forEach(function(row) {
+        row.forEach(function(text, index) {
+            result += ((index === 0) ? "- " : "  ") +
+                      key(table.header[index]) + ": " + value(text, index) +
+                      "\n";
+        });
+    });
+    return result;
+}
+
+// Format table in the Prometheus text exposition format, e.g. for the
+// textfile collector of node_exporter, where each numeric column is a gauge
+// (the hours column being weekly_tracked_hours) and the other columns are
+// the labels of each row
+function weekly_format_prom(table) {
+    const numeric = weekly_numeric_columns(table);
+    const sanitize = function(name) {
+        return name.replace(/[^A-Za-z0-9_]+/g, "_").replace(/^(?=\d)/, "_");
+    };
+    const escape = function(text) {
+        return text.replace(/\\/g, "\\\\")
+            .replace(/"/g, "\\\"")
+            .replace(/\n/g, "\\n");
+    };
+    let result = "";
+    table.header.forEach(function(name, index) {
+        if (!numeric[index]) {
+            return;
+        }
+        const metric =
+            "weekly_" + ((name === "hours") ? "tracked_hours" : sanitize(name));
+        result += "# HELP " + metric + " The " + name + " column of the " +
+                  "weekly report.\n";
+        result += "# TYPE " + metric + " gauge\n";
+        table.rows.forEach(function(row) {
+            if (row[index] === "") {
+                return;
+            }
+            const labels = table.header.map(function(label, column) {
+                return numeric[column]
+                           ? ""
+                           : sanitize(label) + "=\"" + escape(row[column]) +
+                                 "\"";
+            }).filter(Boolean);
+            result += metric +
+                      (labels.length > 0 ? "{" + labels.join(",") + "}" : "") +
+                      " " + Number(row[index]) + "\n";
+        });
+    });
+    return result;
+}
+
+// Format table as a horizontal bar chart where the first text column labels
+// each bar and the hours, total, or first numeric column sets its
+// length, which is scaled such that the chart fits in options.width
+// characters
+function weekly_format_chart(table, options) {
+    const eighths = [
+        "", "\u258f", "\u258e", "\u258d", "\u258c", "\u258b", "\u258a",
+        "\u2589"
+    ];
+    const numeric = weekly_numeric_columns(table);
+    const column = [ "hours", "total" ].map(function(name) {
+        return table.header.indexOf(name);
+    }).concat([ numeric.indexOf(true) ]).find(function(index) {
+        return index >= 0 && numeric[index];
+    });
+    const label = numeric.indexOf(false);
+    if (column === undefined || label < 0) {
+        throw new Error("cannot chart table without text and numbers");
+    }
+    const project_column = weekly_project_column(table);
+    const styles = table.rows.map(function(row) {
+        return weekly_row_style(table, row, project_column, options.projects);
+    });
+    const rows = table.rows.map(function(row, index) {
+        return weekly_label_row(row, project_column, styles[index]);
+    });
+    const values = rows.map(function(row) {
+        return parseFloat(row[column]) || 0.0;
+    });
+    const max = Math.max.apply(null, values.concat([ 0.0 ]));
+    const label_width = Math.min(30, Math.max.apply(null, [ 0 ].concat(
+        rows.map(function(row) { return row[label].length; }))));
+    const value_width = Math.max.apply(null, [ 0 ].concat(
+        rows.map(function(row) { return row[column].length; })));
+    const bar_width = Math.max(10, (options.width || 80) - label_width -
+                                       value_width - 3);
+    let result = "";
+    rows.forEach(function(row, index) {
+        const length = (max > 0) ? values[index] / max * bar_width : 0;
+        const text = (row[label].length > label_width)
+                         ? row[label].substr(0, label_width - 1) + "\u2026"
+                         : row[label].padEnd(label_width);
+        let bar = "\u2588".repeat(Math.floor(length)) +
+                  eighths[Math.floor((length % 1) * 8)];
+        if (options.color && styles[index]) {
+            bar = "\x1b[" + styles[index].color.ansi + "m" + bar + "\x1b[0m";
+        }
+        result += text + " " + bar + " " + row[column] + "\n";
+    });
+    return result;
+}
+
+// Escape text for safely including it into an HTML page
+function weekly_html_escape(text) {
+    return text.replace(/&/g, "&amp;")
+        .replace(/</g, "&lt;")
+        .replace(/>/g, "&gt;")
+        .replace(/"/g, "&quot;");
+}
+
+// Format table as an HTML table whose rows are sorted by clicking on the
+// header (see the script in weekly_format_html_page)
+function weekly_format_html_table(table, options) {
+    const numeric = weekly_numeric_columns(table);
+    const column = weekly_project_column(table);
+    const cell = function(tag, text, index, style) {
+        return "<" + tag + (numeric[index] ? " class=\"num\"" : "") +
+               (style ? " style=\"border-left: 4px solid " + style.color.html +
+                            "\""
+                      : "") +
+               ">" + weekly_html_escape(text) + "</" + tag + ">";
+    };
+    let result = "<table class=\"sortable\">\n<thead><tr>";
+    table.header.forEach(function(name, index) {
+        result += cell("th", name, index);
+    });
+    result += "</tr></thead>\n<tbody>\n";
+    table.rows.forEach(function(row) {
+        const style = weekly_row_style(table, row, column, options.projects);
+        const cells = weekly_label_row(row, column, style).map(function(text,
+                                                                   index) {
+            return cell("td", text, index, (index === column) ? style : null);
+        });
+        result += "<tr>" + cells.join("") + "</tr>\n";
+    });
+    return result + "</tbody>\n</table>\n";
+}
+
+// Format a standalone HTML page with the given title and body
+function weekly_format_html_page(title, body) {
+    return [
+        "<!DOCTYPE html>",
+        "<html>",
+        "<head>",
+        "<meta charset=\"utf-8\">",
+        "<title>" + weekly_html_escape(title) + "</title>",
+        "<style>",
+        "body { font-family: sans-serif; margin: 2em; color: #222; }",
+        "table { border-collapse: collapse; margin-bottom: 2em; }",
+        "th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; }",
+        "th { background: #eee; cursor: pointer; text-align: left; }",
+        ".num { text-align: right; }",
+        "</style>",
+        "</head>",
+        "<body>",
+        body + "<script>",
+        "document.querySelectorAll('table.sortable th').forEach(function(th) {",
+        "  th.addEventListener('click', function() {",
+        "    var body = th.closest('table').tBodies[0];",
+        "    var index = th.cellIndex;",
+        "    var asc = th.dataset.order !== 'asc';",
+        "    var rows = Array.prototype.slice.call(body.rows);",
+        "    rows.sort(function(a, b) {",
+        "      var x = a.cells[index].textContent;",
+        "      var y = b.cells[index].textContent;",
+        "      var r = (th.classList.contains('num')) ? x - y",
+        "                                             : x.localeCompare(y);",
+        "      return asc ? r : -r;",
+        "    });",
+        "    rows.forEach(function(row) { body.appendChild(row); });",
+        "    th.dataset.order = asc ? 'asc' : 'desc';",
+        "  });",
+        "});",
+        "</script>",
+        "</body>",
+        "</html>",
+        ""
+    ].join("\n");
+}
+
+// Format table as a standalone HTML page
+function weekly_format_html(table, options) {
+    return weekly_format_html_page("weekly",
+                                   weekly_format_html_table(table, options));
+}
+
+// Format a standalone HTML report with a summary header, the aggregated
+// statistics, and the list of events
+function weekly_format_html_report(stats, events, window, options) {
+    const start = window.start.format("YYYY-MM-DD");
+    const end = (window.end || moment()).format("YYYY-MM-DD");
+    const title = "Weekly report from " + start + " to " + end;
+    return weekly_format_html_page(
+        title, "<h1>" + weekly_html_escape(title) + "</h1>\n" +
+                   "<p>Total: " + stats.total.toFixed(2) + " hours in " +
+                   events.length + " events.</p>\n" +
+                   "<h2>Totals</h2>\n" +
+                   weekly_format_html_table(weekly_make_table(stats, options),
+                                            options) +
+                   "<h2>Events</h2>\n" +
+                   weekly_format_html_table(
+                       weekly_select_columns(
+                           weekly_make_events_table(events),
+                           options.columns || weekly_events_columns),
+                       options));
+}
+
+// Format events as hledger/ledger timeclock entries, using the project as
+// the account and the tags as hledger tags in a comment
+function weekly_format_timeclock(events) {
+    let result = "";
+    events.slice().sort(function(left, right) {
+        return weekly_compare_events(left, right);
+    }).forEach(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        // Two or more spaces would end the account name
+        const account = parsed.project.replace(/\s+/g, " ") || "unknown";
+        const comment = parsed.tags.map(function(tag) {
+            return tag.substr(weekly_sigils.tag.length) + ":";
+        }).join(", ");
+        result += "i " + moment(evt.start).format("YYYY-MM-DD HH:mm:ss") +
+                  " " + account + (comment ? "  ; " + comment : "") + "\n";
+        result += "o " + moment(evt.end).format("YYYY-MM-DD HH:mm:ss") + "\n";
+    });
+    return result;
+}
+
+// Format events as org-mode headings, one per project, whose logbook
+// contains a clock line for each event, most recent first
+function weekly_format_org(events) {
+    const timestamp = function(date) {
+        return "[" + date.format("YYYY-MM-DD ddd HH:mm") + "]";
+    };
+    let projects = {};
+    events.forEach(function(evt) {
+        const project = weekly_parse_summary(evt.summary).project || "unknown";
+        projects[project] = projects[project] || [];
+        projects[project].push(evt);
+    });
+    let result = "";
+    Object.keys(projects).sort().forEach(function(project) {
+        result += "* " + project + "\n  :LOGBOOK:\n";
+        projects[project].sort(function(left, right) {
+            return weekly_compare_events(right, left);
+        }).forEach(function(evt) {
+            const start = moment(evt.start);
+            const end = moment(evt.end);
+            const minutes = Math.round(end.diff(start, "minutes", true));
+            const clock = Math.floor(minutes / 60) + ":" +
+                          String(minutes % 60).padStart(2, "0");
+            result += "  CLOCK: " + timestamp(start) + "--" + timestamp(end) +
+                      " => " + clock.padStart(5) + "\n";
+        });
+        result += "  :END:\n";
+    });
+    return result;
+}
+
+// Format events as a heatmap with a row for each weekday and a column for
+// each week, where each day is shaded according to the hours tracked, and
+// all days get the lightest shade when no time was tracked
+function weekly_format_heatmap(events) {
+    const shades = [ "\u00b7", "\u2591", "\u2592", "\u2593", "\u2588" ];
+    let days = {};
+    events.forEach(function(evt) {
+        const key = moment(evt.start).format("YYYY-MM-DD");
+        const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+        days[key] = (days[key] || 0.0) + diff;
+    });
+    const keys = Object.keys(days).sort();
+    if (keys.length === 0) {
+        return "";
+    }
+    const max = Math.max.apply(null, keys.map(function(key) {
+        return days[key];
+    }));
+    const first = moment(keys[0]).startOf("isoWeek");
+    const last = moment(keys[keys.length - 1]);
+    const weeks = Math.floor(last.diff(first, "days") / 7) + 1;
+    let header = "";
+    let month = "";
+    for (let week = 0; week < weeks; ++week) {
+        const name = first.clone().add(week, "weeks").format("MMM");
+        if (name !== month && header.length <= week * 2) {
+            header = header.padEnd(week * 2) + name;
+        }
+        month = name;
+    }
+    let result = "    " + header + "\n";
+    [ "Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun" ].forEach(
+        function(name, weekday) {
+            let line = name + " ";
+            for (let week = 0; week < weeks; ++week) {
+                const day = first.clone().add(week * 7 + weekday, "days");
+                const hours = days[day.format("YYYY-MM-DD")] || 0.0;
+                const shade = (max > 0) ? Math.ceil(hours / max * 4) : 0;
+                line += day.isAfter(last) ? "  " : shades[shade] + " ";
+            }
+            result += line.trimEnd() + "\n";
+        });
+    return result + "\nLess " + shades.join(" ") + " More (max " +
+           max.toFixed(2) + " hours/day)\n";
+}
+
+// Format events as a timeline with a line for each day, where each character
+// is a quarter of an hour, events are marked using the letter assigned to
+// their project, and overlapping events are marked using an asterisk
+function weekly_format_timeline(events) {
+    const step = 15;
+    const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ";
+    let projects = [];
+    let days = {};
+    events.slice().sort(weekly_compare_events).forEach(function(evt) {
+        const project = weekly_parse_summary(evt.summary).project || "unknown";
+        if (projects.indexOf(project) < 0) {
+            projects.push(project);
+        }
+        const mark = letters[projects.indexOf(project) % letters.length];
+        const end = moment(evt.end);
+        for (let cur = moment(evt.start); cur.isBefore(end);
+             cur.add(step, "minutes")) {
+            const day = cur.format("YYYY-MM-DD");
+            const cell = Math.floor((cur.hours() * 60 + cur.minutes()) / step);
+            days[day] = days[day] || {};
+            days[day][cell] = (days[day][cell] === undefined) ? mark : "*";
+        }
+    });
+    const keys = Object.keys(days).sort();
+    if (keys.length === 0) {
+        return "";
+    }
+    const cells = [].concat.apply([], keys.map(function(key) {
+        return Object.keys(days[key]).map(Number);
+    }));
+    const per_hour = 60 / step;
+    const first = Math.floor(Math.min.apply(null, cells) / per_hour);
+    const last = Math.floor(Math.max.apply(null, cells) / per_hour);
+    let result = " ".repeat(11);
+    for (let hour = first; hour <= last; ++hour) {
+        result += String(hour).padStart(2, "0").padEnd(per_hour);
+    }
+    result = result.trimEnd() + "\n";
+    keys.forEach(function(key) {
+        let line = key + " ";
+        for (let cell = first * per_hour; cell < (last + 1) * per_hour;
+             ++cell) {
+            line += days[key][cell] || "\u00b7";
+        }
+        result += line + "\n";
+    });
+    result += "\n";
+    projects.forEach(function(project, index) {
+        result += letters[index % letters.length] + " " + project + "\n";
+    });
+    return result;
+}
+
+// Format the week beginning at start with a column for each day, fitting
+// in width characters, listing the start time and summary of the events of
+// the day or, when aggregate is set, the hours of each project, followed by
+// the hours of the day
+function weekly_format_week(events, start, width, aggregate) {
+    const column = Math.max(10, Math.floor((width - 6) / 7));
+    const fit = function(text) {
+        return (text.length > column) ? text.substr(0, column - 1) + "\u2026"
+                                       : text.padEnd(column);
+    };
+    let days = [];
+    for (let index = 0; index < 7; ++index) {
+        const date = start.clone().add(index, "days");
+        const key = date.format("YYYY-MM-DD");
+        const selected = events.filter(function(evt) {
+            return moment(evt.start).format("YYYY-MM-DD") === key;
+        }).sort(weekly_compare_events);
+        let hours = {};
+        let total = 0.0;
+        selected.forEach(function(evt) {
+            const project = weekly_parse_summary(evt.summary).project;
+            const diff = moment(evt.end).diff(moment(evt.start), "hours", true);
+            hours[project] = (hours[project] || 0.0) + diff;
+            total += diff;
+        });
+        let lines = selected.map(function(evt) {
+            return moment(evt.start).format("HH:mm") + " " +
+                   (evt.summary || "");
+        });
+        if (aggregate) {
+            lines = Object.keys(hours).sort().map(function(name) {
+                return hours[name].toFixed(2) + " " + name;
+            });
+        }
+        days.push({
+            title : date.format("ddd DD"),
+            lines : lines,
+            total : total.toFixed(2) + "h",
+        });
+    }
+    const line = function(cell) {
+        return days.map(cell).map(fit).join(" ").trimEnd() + "\n";
+    };
+    const rule = line(function() { return "\u2500".repeat(column); });
+    let result = line(function(day) { return day.title; }) + rule;
+    const rows = Math.max.apply(null, days.map(function(day) {
+        return day.lines.length;
+    }));
+    for (let row = 0; row < rows; ++row) {
+        result += line(function(day) { return day.lines[row] || ""; });
+    }
+    return result + rule + line(function(day) { return day.total; });
+}
+
+// Format events as a bulleted list, ready to be pasted into a chat, with a
+// line for each project, longest first, telling the hours tracked, the tags,
+// and the persons, e.g. "- mlab: 1h meeting with alice"
+function weekly_format_standup(events) {
+    let projects = {};
+    events.forEach(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        const name = parsed.project || "unknown";
+        projects[name] =
+            projects[name] || {hours : 0.0, tags : [], persons : []};
+        projects[name].hours +=
+            moment(evt.end).diff(moment(evt.start), "hours", true);
+        [ [ "tags", "tag" ], [ "persons", "person" ] ].forEach(function(pair) {
+            parsed[pair[0]].forEach(function(word) {
+                word = word.substr(weekly_sigils[pair[1]].length);
+                if (projects[name][pair[0]].indexOf(word) < 0) {
+                    projects[name][pair[0]].push(word);
+                }
+            });
+        });
+    });
+    const names = Object.keys(projects).sort(function(left, right) {
+        return projects[right].hours - projects[left].hours ||
+               left.localeCompare(right);
+    });
+    if (names.length <= 0) {
+        return "- nothing tracked\n";
+    }
+    return names.map(function(name) {
+        const project = projects[name];
+        return "- " + name + ": " +
+               (Math.round(project.hours * 100) / 100) + "h" +
+               (project.tags.length > 0 ? " " + project.tags.join(", ") : "") +
+               (project.persons.length > 0
+                    ? " with " + project.persons.join(", ")
+                    : "") +
+               "\n";
+    }).join("");
+}
+
+// Format a single line, short enough for a shell prompt, telling what is
+// being tracked at now, i.e. the running timer, if any, or else the event in
+// progress, and for how long, followed by the hours tracked among today's
+// events until now, including the timer, e.g. "nexa #code 0:45, today 5:30"
+function weekly_format_status(events, timer, now) {
+    const clock = function(minutes) {
+        minutes = Math.round(minutes);
+        return Math.floor(minutes / 60) + ":" +
+               String(minutes % 60).padStart(2, "0");
+    };
+    const today = moment(now).startOf("day");
+    const since = function(date) {
+        date = moment(date);
+        return date.isBefore(today) ? today : date;
+    };
+    let total = 0;
+    let current = timer;
+    events.forEach(function(evt) {
+        const start = since(evt.start);
+        const end =
+            moment(evt.end).isAfter(now) ? moment(now) : moment(evt.end);
+        if (end.isAfter(start)) {
+            total += end.diff(start, "minutes", true);
+        }
+        if (!current && !moment(evt.start).isAfter(now) &&
+            moment(evt.end).isAfter(now)) {
+            current = evt;
+        }
+    });
+    if (timer) {
+        total += moment(now).diff(since(timer.start), "minutes", true);
+    }
+    let result = "today " + clock(total);
+    if (current) {
+        result = current.summary + " " +
+                 clock(moment(now).diff(moment(current.start), "minutes",
+                                        true)) +
+                 ", " + result;
+    }
+    return result + "\n";
+}
+
+// Format events as the json printed by "timew export", which "timew import"
+// reads, where the tags of each interval are the project, the tags without
+// their prefix, and the persons and custom fields with their prefix (see
+// weekly_import_timewarrior)
+function weekly_format_timewarrior(events) {
+    const stamp = function(time) {
+        return moment(time).toISOString().replace(/[-:]|\.\d+/g, "");
+    };
+    const intervals = events.slice().sort(function(left, right) {
+        return weekly_compare_events(left, right);
+    }).map(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        let tags = (parsed.project !== "") ? [ parsed.project ] : [];
+        parsed.tags.forEach(function(tag) {
+            tags.push(tag.substr(weekly_sigils.tag.length));
+        });
+        tags = tags.concat(parsed.persons);
+        Object.keys(parsed.fields).forEach(function(key) {
+            tags.push(weekly_sigils.field + key + "=" + parsed.fields[key]);
+        });
+        if (parsed.billable !== undefined) {
+            tags.push(weekly_sigils.field +
+                      (parsed.billable ? "billable" : "internal"));
+        }
+        return JSON.stringify({
+            start : stamp(evt.start),
+            end : stamp(evt.end),
+            tags : tags,
+        });
+    });
+    if (intervals.length <= 0) {
+        return "[\n]\n";
+    }
+    return "[\n" + intervals.join(",\n") + "\n]\n";
+}
+
+// Maps the name of each output format that lists events, rather than
+// printing a table, to the function implementing it
+const weekly_event_formats = {
+    heatmap : weekly_format_heatmap,
+    org : weekly_format_org,
+    standup : weekly_format_standup,
+    timeclock : weekly_format_timeclock,
+    timeline : weekly_format_timeline,
+    timewarrior : weekly_format_timewarrior,
+};
+
+// Maps the name of each output format to the function implementing it
+const weekly_formats = {
+    box : weekly_format_box,
+    chart : weekly_format_chart,
+    csv : weekly_format_csv,
+    html : weekly_format_html,
+    json : weekly_format_json,
+    "json-array" : weekly_format_json_array,
+    markdown : weekly_format_markdown,
+    prom : weekly_format_prom,
+    yaml : weekly_format_yaml,
+};
+
+/*
+                 _
+ _ __ ___   __ _(_)_ __
+| '_ ` _ \ / _` | | '_ \
+| | | | | | (_| | | | | |
+|_| |_| |_|\__,_|_|_| |_|
+*/
+
+// Directory containing the private files, which is "private" unless it
+// is overridden by the WEEKLY_CONFIG_DIR environment variable
+const private_dir = process.env.WEEKLY_CONFIG_DIR || "private";
+const app_path = path.join(private_dir, "app.json");
+const caldav_path = path.join(private_dir, "caldav.json");
+const calendar_path = path.join(private_dir, "calendar.json");
+const config_path = path.join(private_dir, "config.json");
+const device_path = path.join(private_dir, "device.json");
+const events_device_path = path.join(private_dir, "device-events.json");
+const events_tokens_path = path.join(private_dir, "tokens-events.json");
+const doc_url = "https://github.com/bassosimone/weekly#create-privateappjson-using-google-developers-console"
+const fields_path = path.join(private_dir, "fields.json");
+const jira_path = path.join(private_dir, "jira.json");
+const locks_path = path.join(private_dir, "locks.json");
+const projects_path = path.join(private_dir, "projects.json");
+const rates_path = path.join(private_dir, "rates.json");
+const sheets_device_path = path.join(private_dir, "device-sheets.json");
+const sheets_tokens_path = path.join(private_dir, "tokens-sheets.json");
+const smtp_path = path.join(private_dir, "smtp.json");
+const toggl_path = path.join(private_dir, "toggl.json");
+const tokens_path = path.join(private_dir, "tokens.json");
+const webdav_path = path.join(private_dir, "webdav.json");
+const main_private_files = [
+    app_path, caldav_path, calendar_path, config_path, device_path,
+    events_device_path, events_tokens_path, fields_path, jira_path,
+    locks_path, projects_path, rates_path, sheets_device_path,
+    sheets_tokens_path, smtp_path, toggl_path, tokens_path, webdav_path
+];
+const main_package = require("./package.json");
+
+// Hints telling how to create each private file when it is missing
+const main_missing_hints = {
+    [app_path] : "You should create your own app\nSee <" + doc_url +
+                     "> for instructions",
+    [caldav_path] : "You should create it to use --source caldav\n" +
+                        "See README.md for instructions",
+    [calendar_path] : "did you run 'node index.js --step3'?",
+    [device_path] : "did you run 'node index.js --init'?",
+    [events_device_path] :
+        "did you run 'node index.js --init --grant events'?",
+    [events_tokens_path] : "Run 'node index.js --init --grant events' to " +
+                               "let weekly add events",
+    [fields_path] : "You should create it to declare fields\n" +
+                        "See README.md for instructions",
+    [jira_path] : "You should create it to use --push-jira\n" +
+                      "See README.md for instructions",
+    [rates_path] : "You should create it to configure rates\n" +
+                       "See README.md for instructions",
+    [sheets_device_path] :
+        "did you run 'node index.js --init --grant sheets'?",
+    [sheets_tokens_path] : "Run 'node index.js --init --grant sheets' to " +
+                               "let weekly edit spreadsheets",
+    [smtp_path] : "You should create it to use --email\n" +
+                      "See README.md for instructions",
+    [toggl_path] : "You should create it to use --push-toggl\n" +
+                       "See README.md for instructions",
+    [tokens_path] : "did you run 'node index.js --init'?",
+};
+
+// Steps of the setup procedure, in order, with the private file each of
+// them creates and the instructions to perform it
+const main_setup_steps = [
+    {
+        file : app_path,
+        todo : "create '" + app_path + "' with the credentials of your " +
+                   "app\n     (see <" + doc_url + ">)",
+    },
+    {
+        file : device_path,
+        todo : "run 'node index.js --init' and enter the code it prints",
+    },
+    {file : tokens_path, todo : "run 'node index.js --step2'"},
+    {
+        file : calendar_path,
+        todo : "run 'node index.js --step3' to select your calendar",
+    },
+];
+
+// Return a hint telling how to complete the setup, which lists the steps
+// starting from the first one whose file is missing
+function main_setup_hint() {
+    let index = 0;
+    while (index < main_setup_steps.length - 1 &&
+           fs.existsSync(main_setup_steps[index].file)) {
+        index += 1;
+    }
+    let lines = [ "To complete the setup:" ];
+    main_setup_steps.slice(index).forEach(function(step, number) {
+        lines.push("  " + (number + 1) + ". " + step.todo);
+    });
+    if (!program.debug) {
+        lines.push("Run with --debug for details");
+    }
+    return lines.join("\n");
+}
+
+// Report error to the user and exit with the code of its kind (see
+// weekly_error_kinds); file system errors are reported as configuration
+// errors, while other errors are unexpected and thus rethrown. With
+// --json-errors, the error is a single JSON object on the standard error.
+// While serving a request (see main_serve), all errors are thrown, so that
+// the server reports them to the client.
+function main_fatal(error) {
+    if (!error.kind && error.syscall && error.path) {
+        json_log("fatal", {
+            path : error.path,
+            syscall : error.syscall,
+            code : error.code,
+            message : error.message,
+        });
+        const setup = main_setup_steps.some(function(step) {
+            return step.file === error.path;
+        });
+        if (error.code === 'ENOENT' && setup) {
+            error = weekly_error("config", "weekly is not set up yet",
+                                 main_setup_hint());
+        } else if (error.code === 'ENOENT') {
+            error = weekly_error("config",
+                                 "missing file: '" + error.path + "'",
+                                 main_missing_hints[error.path]);
+        } else {
+            error = weekly_error("config", "cannot access '" + error.path +
+                                               "': " + error.message);
+        }
+    }
+    if (!error.kind || main_serving) {
+        throw error;
+    }
+    if (program.jsonErrors) {
+        console.error(JSON.stringify({
+            code : weekly_error_kinds[error.kind],
+            message : error.message,
+            hint : error.hint || null,
+        }));
+        process.exit(weekly_error_kinds[error.kind]);
+    }
+    error.message.split("\n").forEach(function(line) {
+        console.error("fatal: " + line);
+    });
+    if (error.hint) {
+        console.log(error.hint);
+    }
+    process.exit(weekly_error_kinds[error.kind]);
+}
+
+// Return the version metadata written by tools/release-build.js into release
+// binaries, i.e. the commit and date of the build, or null when running
+// from a checkout
+function main_build_info() {
+    try {
+        return require("./build-info.json");
+    } catch (error) {
+        return null;
+    }
+}
+
+// Return version and environment information useful for bug reports
+function main_version_object() {
+    const dependency_version = function(name) {
+        try {
+            return require(name + "/package.json").version;
+        } catch (error) {
+            return null;
+        }
+    };
+    let files = {};
+    main_private_files.forEach(function(file) {
+        files[file] = fs.existsSync(file);
+    });
+    return {
+        version : main_package.version,
+        build : main_build_info(),
+        node : process.versions.node,
+        v8 : process.versions.v8,
+        platform : process.platform,
+        arch : process.arch,
+        dependencies : {
+            commander : dependency_version("commander"),
+            moment : dependency_version("moment"),
+        },
+        formats : Object.keys(weekly_formats).concat(
+            Object.keys(weekly_event_formats)),
+        api_url : process.env.WEEKLY_API_URL || null,
+        files : files,
+    };
+}
+
+// Print version and environment information useful for bug reports as json
+function main_version_info() {
+    console.log(JSON.stringify(main_version_object(), undefined, 4));
+}
+
+// Names of the fields of private files known to contain neither secrets nor
+// identifiers, such as rates and token lifetimes, which are not redacted
+const main_redact_allowed = [
+    "color", "currency", "expires_in", "interval", "rate", "scope",
+    "token_type", "type", "vat"
+];
+
+// Return a copy of data where the values of the fields not named in
+// main_redact_allowed, including the items of arrays within such fields,
+// are redacted, where key is the name of the field containing data, if any
+function main_redact(data, key) {
+    if (data === null || typeof data !== "object") {
+        return (main_redact_allowed.indexOf(key) >= 0) ? data : "<redacted>";
+    }
+    let result = Array.isArray(data) ? [] : {};
+    Object.keys(data).forEach(function(name) {
+        result[name] =
+            main_redact(data[name], Array.isArray(data) ? key : name);
+    });
+    return result;
+}
+
+// Write a bug report containing version information, details about the
+// operating system, and the content of private files with all the values
+// but those known to be safe redacted
+function main_bugreport() {
+    let report = "# weekly bug report\n\n";
+    report += "## version\n\n" +
+              JSON.stringify(main_version_object(), undefined, 4) + "\n\n";
+    report += "## system\n\n" + JSON.stringify({
+        type : os.type(),
+        release : os.release(),
+        locale : Intl.DateTimeFormat().resolvedOptions().locale,
+        timezone : Intl.DateTimeFormat().resolvedOptions().timeZone,
+        utc_offset : moment().format("Z"),
+    }, undefined, 4) + "\n";
+    main_private_files.forEach(function(file) {
+        report += "\n## " + file + "\n\n";
+        let content;
+        try {
+            content = JSON.parse(fs.readFileSync(file, "utf8"));
+        } catch (error) {
+            report += error.code || error.message;
+            report += "\n";
+            return;
+        }
+        report += JSON.stringify(main_redact(content), undefined, 4) + "\n";
+    });
+    report += "\n## log\n\nweekly does not keep a log; please paste the " +
+              "output of the failing command.\n";
+    main_write_output(report);
+    if (program.output) {
+        console.log("Written bug report at '" + program.output + "'");
+        console.log("Please review it before attaching it to an issue");
+    }
+}
+
+// Escape text for use in a roff document
+function main_roff_escape(text) {
+    return text.replace(/\\/g, "\\e").replace(/-/g, "\\-")
+        .replace(/^([.'])/, "\\&$1");
+}
+
+// Return the man page describing the command line options
+function main_man_page() {
+    let page = ".TH WEEKLY 1 \"\" \"weekly " + main_package.version +
+               "\" \"User Commands\"\n";
+    page += ".SH NAME\nweekly \\- track your weekly activities using " +
+            "Google Calendar\n";
+    page += ".SH SYNOPSIS\n.B node index.js\n[\\fIoptions\\fR]\n";
+    page += ".SH DESCRIPTION\nWithout options, prints statistics about " +
+            "the events of the current week.\n";
+    page += ".SH OPTIONS\n";
+    program.options.forEach(function(option) {
+        const flags = main_roff_escape(option.flags)
+            .replace(/<([^>]+)>/, "\\fI$1\\fR");
+        page += ".TP\n.B " + flags + "\n" +
+                main_roff_escape(option.description) + "\n";
+    });
+    page += ".SH FILES\n";
+    main_private_files.forEach(function(file) {
+        page += ".TP\n.I " + main_roff_escape(file) + "\n";
+        page += "See the README for its format.\n";
+    });
+    page += ".SH SEE ALSO\n" + main_roff_escape(main_package.homepage) + "\n";
+    return page;
+}
+
+// Return how shells complete the argument of option, if any: from the list
+// of words, from the file named cache in the completion cache directory
+// (see main_cache_completion), as files or directories, or not at all
+function main_completion_argument(option) {
+    const words = {
+        "--by" : weekly_dimensions.concat("field:"),
+        "--color" : [ "auto", "always", "never" ],
+        "--aggregate" : Object.keys(weekly_periods),
+        "--completion" : Object.keys(main_completion_scripts),
+        "--format" : Object.keys(weekly_formats)
+                         .concat(Object.keys(weekly_event_formats)).sort(),
+        "--from" : Object.keys(main_importers),
+        "--grant" : Object.keys(main_grants),
+        "--on-conflict" : [ "warn", "shift", "fail" ],
+        "--round-policy" : [ "up", "down", "nearest" ],
+        "--total-by" : Object.keys(weekly_periods),
+        "--week-start" : [ "mon", "sun" ],
+    };
+    const cache = {
+        "--add" : "projects",
+        "--expenses" : "tags",
+        "--project" : "projects",
+        "--start-timer" : "projects",
+        "--tag" : "tags",
+    };
+    if (!option.required) {
+        return undefined;
+    }
+    if (words[option.long]) {
+        return {words : words[option.long]};
+    }
+    if (cache[option.long]) {
+        return {cache : cache[option.long]};
+    }
+    if (/<path>/.test(option.flags)) {
+        return {files : true};
+    }
+    if (/<dir>/.test(option.flags)) {
+        return {dirs : true};
+    }
+    return {};
+}
+
+// Shell expression evaluating to the completion cache directory, in bash
+// and zsh, and in fish
+const main_completion_cache = "${XDG_CACHE_HOME:-$HOME/.cache}/weekly";
+const main_completion_cache_fish =
+    "(set -q XDG_CACHE_HOME; and echo $XDG_CACHE_HOME; or echo ~/.cache)" +
+    "/weekly";
+
+// Return the bash completion script, which completes option names and the
+// known values of their arguments
+function main_bash_completion() {
+    let script = "# bash completion for weekly, generated by " +
+                 "'node index.js --completion bash'\n";
+    script += "_weekly() {\n";
+    script += "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n";
+    script += "    local prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n";
+    script += "    case \"$prev\" in\n";
+    let free = [];
+    program.options.forEach(function(option) {
+        const argument = main_completion_argument(option);
+        let words;
+        if (!argument) {
+            return;
+        } else if (argument.words) {
+            words = "-W \"" + argument.words.join(" ") + "\"";
+        } else if (argument.cache) {
+            words = "-W \"$(cat \"" + main_completion_cache + "/" +
+                    argument.cache + "\" 2>/dev/null)\"";
+        } else if (argument.files) {
+            words = "-f";
+        } else if (argument.dirs) {
+            words = "-d";
+        } else {
+            free.push(option.long);
+            return;
+        }
+        script += "        " + option.long + ")\n";
+        if (argument.cache) {
+            script += "            local IFS=$'\\n'\n";
+        }
+        script += "            COMPREPLY=($(compgen " + words +
+                  " -- \"$cur\"))\n";
+        script += "            return;;\n";
+    });
+    if (free.length > 0) {
+        script += "        " + free.join("|") + ")\n";
+        script += "            return;;\n";
+    }
+    script += "    esac\n";
+    script += "    COMPREPLY=($(compgen -W \"" +
+              program.options.map(function(option) {
+                  return option.long;
+              }).concat("--help").join(" ") + "\" -- \"$cur\"))\n";
+    script += "}\n";
+    script += "complete -F _weekly weekly\n";
+    return script;
+}
+
+// Return the zsh completion script, which completes option names, showing
+// their description, and the known values of their arguments
+function main_zsh_completion() {
+    const quote = function(text) {
+        return "'" + text.replace(/'/g, "'\\''") + "'";
+    };
+    let script = "#compdef weekly\n";
+    script += "# zsh completion for weekly, generated by " +
+              "'node index.js --completion zsh'\n";
+    script += "_arguments \\\n";
+    program.options.forEach(function(option) {
+        const argument = main_completion_argument(option);
+        let spec = option.long + "[" +
+                   option.description.replace(/([\[\]:\\])/g, "\\$1") + "]";
+        if (!argument) {
+            // nothing
+        } else if (argument.words) {
+            spec += ":" + option.long.slice(2) + ":(" +
+                    argument.words.join(" ") + ")";
+        } else if (argument.cache) {
+            spec += ":" + argument.cache + ":{local IFS=$'\\n'; " +
+                    "compadd -- $(cat \"" + main_completion_cache + "/" +
+                    argument.cache + "\" 2>/dev/null)}";
+        } else if (argument.files) {
+            spec += ":path:_files";
+        } else if (argument.dirs) {
+            spec += ":dir:_files -/";
+        } else {
+            spec += ":" + option.long.slice(2) + ": ";
+        }
+        script += "    " + quote(spec) + " \\\n";
+    });
+    script += "    '--help[Output usage information]'\n";
+    return script;
+}
+
+// Return the fish completion script, which completes option names, showing
+// their description, and the known values of their arguments
+function main_fish_completion() {
+    const quote = function(text) {
+        return "'" + text.replace(/([\\'])/g, "\\$1") + "'";
+    };
+    let script = "# fish completion for weekly, generated by " +
+                 "'node index.js --completion fish'\n";
+    script += "complete -c weekly -f\n";
+    program.options.forEach(function(option) {
+        const argument = main_completion_argument(option);
+        let line = "complete -c weekly -l " + option.long.slice(2);
+        if (!argument) {
+            // nothing
+        } else if (argument.words) {
+            line += " -x -a " + quote(argument.words.join(" "));
+        } else if (argument.cache) {
+            line += " -x -a " + quote("(cat " + main_completion_cache_fish +
+                                      "/" + argument.cache + " 2>/dev/null)");
+        } else if (argument.files) {
+            line += " -r -F";
+        } else if (argument.dirs) {
+            line += " -x -a '(__fish_complete_directories)'";
+        } else {
+            line += " -x";
+        }
+        script += line + " -d " + quote(option.description) + "\n";
+    });
+    return script;
+}
+
+// Functions returning the completion script of each shell
+const main_completion_scripts = {
+    bash : main_bash_completion,
+    fish : main_fish_completion,
+    zsh : main_zsh_completion,
+};
+
+// Print the completion script of shell
+function main_completion(shell) {
+    if (!main_completion_scripts[shell]) {
+        main_fatal(weekly_error("usage", "unknown shell: '" + shell + "'",
+                                "Available shells: " +
+                                    Object.keys(main_completion_scripts)
+                                        .join(", ")));
+    }
+    main_write_output(main_completion_scripts[shell]());
+}
+
+// Return the directory where weekly caches the values used for completion
+// and the events fetched from the network
+function main_cache_dir() {
+    const cache_home = process.env.XDG_CACHE_HOME ||
+                       path.join(os.homedir(), ".cache");
+    return path.join(cache_home, "weekly");
+}
+
+// Remember the projects and the tags of events, most recent first, in the
+// completion cache directory, so that shells can complete them. Since this
+// is a convenience, errors are ignored.
+function main_cache_completion(events) {
+    const dir = main_cache_dir();
+    let seen = {projects : [], tags : []};
+    events.slice().sort(function(left, right) {
+        return weekly_compare_events(right, left);
+    }).forEach(function(evt) {
+        const parsed = weekly_parse_summary(evt.summary);
+        seen.projects.push(parsed.project);
+        seen.tags = seen.tags.concat(parsed.tags);
+    });
+    Object.keys(seen).forEach(function(name) {
+        const file = path.join(dir, name);
+        let previous = [];
+        try {
+            previous = fs.readFileSync(file, "utf8").split("\n");
+        } catch (ignored) {
+            // nothing
+        }
+        let values = [];
+        seen[name].concat(previous).forEach(function(value) {
+            if (value !== "" && values.indexOf(value) < 0) {
+                values.push(value);
+            }
+        });
+        try {
+            main_mkdir_parents(dir);
+            fs.writeFileSync(file, values.slice(0, 100).join("\n") + "\n",
+                             {mode : 0o600});
+        } catch (ignored) {
+            // nothing
+        }
+    });
+}
+
+// Check the setup of weekly, i.e., the private files, the access token, the
+// selected calendar, and the clock, printing the outcome of each check with
+// a hint telling how to fix failures, and exit with failure if any failed
+function main_doctor() {
+    let failures = 0;
+    const check = function(name, problem, hint) {
+        if (!problem) {
+            console.log("ok - " + name);
+            return;
+        }
+        failures += 1;
+        console.log("not ok - " + name + ": " + problem);
+        console.log("    " + hint.replace(/\n/g, "\n    "));
+    };
+    const finish = function() {
+        if (failures > 0) {
+            process.exit(weekly_error_kinds.config);
+        }
+    };
+    const read = function(file, valid) {
+        try {
+            return valid(JSON.parse(fs.readFileSync(file, "utf8")))
+                       ? undefined
+                       : "unexpected content";
+        } catch (error) {
+            return (error.code === 'ENOENT') ? "missing" : error.message;
+        }
+    };
+    let directory;
+    try {
+        directory = fs.statSync(private_dir).isDirectory()
+                        ? undefined
+                        : "not a directory";
+    } catch (error) {
+        directory = "missing";
+    }
+    check(private_dir + " directory exists", directory,
+          "Run weekly from the directory containing it (see README.md)");
+    check(app_path + " is valid", read(app_path, function(app) {
+        return app.client_id && app.client_secret;
+    }), main_missing_hints[app_path]);
+    const tokens = read(tokens_path, function(tokens) {
+        return tokens.access_token;
+    });
+    check(tokens_path + " is valid", tokens, main_missing_hints[tokens_path]);
+    const calendar = read(calendar_path, function(calendar) {
+        return typeof calendar === "string";
+    });
+    check(calendar_path + " is valid", calendar,
+          main_missing_hints[calendar_path]);
+    if (tokens || calendar) {
+        console.log("skip - token, calendar, and clock checks");
+        finish();
+        return;
+    }
+    calendar_events_page(tokens_path, calendar_path, {start : moment()},
+                         undefined, 1, function(error, response, headers) {
+        const auth = error && error.kind === "auth";
+        check("access token is valid", auth ? error.message : undefined,
+              "Try running 'node index.js --refresh'");
+        if (auth) {
+            console.log("skip - calendar and clock checks");
+            finish();
+            return;
+        }
+        check("calendar is reachable", error ? error.message : undefined,
+              "Select another calendar with 'node index.js --step3'");
+        if (error) {
+            console.log("skip - clock check");
+            finish();
+            return;
+        }
+        const date = Date.parse(headers.date);
+        const skew = Math.round((Date.now() - date) / 1000);
+        let problem;
+        if (isNaN(date)) {
+            problem = "the server did not tell its time";
+        } else if (Math.abs(skew) > 60) {
+            problem = "the clock is " + Math.abs(skew) + " seconds " +
+                      ((skew > 0) ? "ahead" : "behind");
+        }
+        check("clock is synchronized", problem,
+              "Synchronize the clock, e.g., using NTP");
+        finish();
+    });
+}
+
+// Write the man page and the completion scripts into dir
+function main_docs(dir) {
+    main_write_file(path.join(dir, "weekly.1"), main_man_page());
+    main_write_file(path.join(dir, "weekly.bash"), main_bash_completion());
+    main_write_file(path.join(dir, "weekly.fish"), main_fish_completion());
+    main_write_file(path.join(dir, "_weekly"), main_zsh_completion());
+    console.log("Written documentation into '" + dir + "'");
+}
+
+// Fetch the team configuration at address, containing the projects, fields,
+// and rates sections, and merge each section into the corresponding file,
+// exiting without changing any file if the configuration or any of its
+// sections is not an object, or if the merged projects are not valid
+function main_team_config(address) {
+    const sections = {
+        fields : fields_path,
+        projects : projects_path,
+        rates : rates_path,
+    };
+    const is_object = function(value) {
+        return value !== null && typeof value === "object" &&
+               !Array.isArray(value);
+    };
+    json_get_url(address, function(error, team) {
+        if (error) {
+            if (error.kind === "api") {
+                error.message = "cannot fetch '" + address + "': " +
+                                error.message;
+            }
+            main_fatal(error);
+        }
+        if (!is_object(team)) {
+            main_fatal(weekly_error("config",
+                                    "invalid team configuration at '" +
+                                        address + "'",
+                                    "It must be an object with the " +
+                                        Object.keys(sections).join(", ") +
+                                        " sections"));
+        }
+        let updates = [];
+        Object.keys(team).forEach(function(section) {
+            const file = sections[section];
+            if (!file) {
+                console.error("warning: ignoring unknown section: '" +
+                              section + "'");
+                return;
+            }
+            if (!is_object(team[section])) {
+                main_fatal(weekly_error("config",
+                                        "invalid section '" + section +
+                                            "' at '" + address + "'",
+                                        "Sections must be objects"));
+            }
+            let local = {};
+            try {
+                local = JSON.parse(fs.readFileSync(file, "utf8"));
+            } catch (error) {
+                if (error.code !== 'ENOENT') {
+                    main_fatal(error.syscall
+                                   ? error
+                                   : weekly_error("config",
+                                                  "invalid '" + file + "': " +
+                                                      error.message));
+                }
+            }
+            const merged = weekly_merge_config(local, team[section]);
+            if (file === projects_path) {
+                main_check_projects(merged, address);
+            }
+            updates.push({file : file, merged : merged});
+        });
+        updates.forEach(function(update) {
+            main_write_file(update.file,
+                            JSON.stringify(update.merged, undefined, 4) +
+                                "\n");
+            console.log("Updated '" + update.file + "'");
+        });
+    });
+}
+
+// Permissions beyond reading calendars, which are obtained separately with
+// --grant, so that the default credentials remain read-only, by name
+const main_grants = {
+    events : {
+        scopes : [ "https://www.googleapis.com/auth/calendar.events" ],
+        device_path : events_device_path,
+        tokens_path : events_tokens_path,
+        purpose : "add events to the calendar with --add and --edit-day",
+    },
+    sheets : {
+        scopes : [ "https://www.googleapis.com/auth/spreadsheets" ],
+        device_path : sheets_device_path,
+        tokens_path : sheets_tokens_path,
+        purpose : "append rows to spreadsheets with --sheet",
+    },
+};
+
+// Return the permission named name (see main_grants), exiting if unknown
+function main_grant(name) {
+    if (!main_grants[name]) {
+        main_fatal(weekly_error("usage", "unknown grant: '" + name + "'",
+                                "Available grants: " +
+                                    Object.keys(main_grants).join(", ")));
+    }
+    return main_grants[name];
+}
+
+// Initiate authentication process by requesting a device code to google,
+// for reading calendars or, with --grant, for the named permission
+function main_init() {
+    const grant = program.grant && main_grant(program.grant);
+    const file = grant ? grant.device_path : device_path;
+    const step2 = "node index.js --step2" +
+                  (grant ? " --grant " + program.grant : "");
+    oauth2_obtain_user_code(app_path, function(error, response) {
+        if (error) {
+            main_fatal(error);
+        }
+        json_write_file(file, response, function(error) {
+            if (error) {
+                main_fatal(error);
+            }
+            console.log("Written device-info at '" + file + "'");
+            console.log("Now go to <" + response.verification_url + "> and " +
+                        "authenticate using " + response.user_code);
+            console.log("Then, run '" + step2 + "'");
+        });
+    }, grant && grant.scopes);
+}
+
+// After user authorized the app with browser, call this function to get
+// a real authentication token to effectively access calendar api
+function main_step2() {
+    const grant = program.grant && main_grant(program.grant);
+    const file = grant ? grant.tokens_path : tokens_path;
+    oauth2_obtain_tokens(app_path, grant ? grant.device_path : device_path,
+                         function(error, response) {
+        if (error) {
+            main_fatal(error);
+        }
+        json_write_file(file, response, function(error) {
+            if (error) {
+                main_fatal(error);
+            }
+            console.log("Written tokens-info at '" + file + "'");
+            if (grant) {
+                console.log("You may now " + grant.purpose);
+                return;
+            }
+            console.log("Now, run 'node index.js --step3'");
+        });
+    });
+}
+
+// Write the id of the selected calendar and exit
+function main_select_calendar(id) {
+    json_write_file(calendar_path, id, function(error) {
+        if (error) {
+            main_fatal(error);
+        }
+        console.log("Written calendar-info at '" + calendar_path + "'");
+        console.log("You may now use this app");
+        process.exit(0);
+    });
+}
+
+// Return the description of the available calendars
+function main_describe_calendars(calendars) {
+    let result = "\nAvailable calendars:\n";
+    for (let index = 0; index < calendars.length; ++index) {
+        result += "  - id: " + calendars[index].id + "\n";
+        result += "    summary: '" + calendars[index].summary + "'\n";
+    }
+    return result;
+}
+
+// Allows use to select which calendar to use, either using --calendar-id or
+// interactively, which requires a terminal rather than hanging in scripts
+function main_step3() {
+    calendar_list(tokens_path, function(error, response) {
+        if (error) {
+            main_fatal(error);
+        }
+        const calendars = weekly_filter_calendars(response);
+        const known = function(id) {
+            return calendars.some(function(cal) { return cal.id === id; });
+        };
+        if (program.calendarId !== undefined) {
+            if (!known(program.calendarId)) {
+                main_fatal(weekly_error("usage", "calendar-id not found: " +
+                                                     program.calendarId,
+                                        main_describe_calendars(calendars)));
+            }
+            main_select_calendar(program.calendarId);
+            return;
+        }
+        if (!process.stdin.isTTY) {
+            main_fatal(weekly_error(
+                "usage", "selecting a calendar requires a terminal",
+                main_describe_calendars(calendars) + "\n" +
+                    "Use 'node index.js --step3 --calendar-id <id>'"));
+        }
+        const max_attempts = 3;
+        let attempts = 0;
+        let rl = readline.createInterface(process.stdin, process.stdout);
+        rl.setPrompt(main_describe_calendars(calendars) +
+                     "Which id do you want to use? ");
+        rl.prompt();
+        rl.on("line", function(line) {
+              line = line.trim();
+              if (known(line)) {
+                  rl = null;
+                  main_select_calendar(line);
+                  return;
+              }
+              console.log("\nError: calendar-id not found: " + line);
+              if (++attempts >= max_attempts) {
+                  main_fatal(weekly_error("usage",
+                                          "too many invalid calendar-ids"));
+              }
+              rl.prompt();
+          }).on("close", function() { process.exit(0); });
+    });
+}
+
+// Refresh authentication token after it expired, or the token of the
+// permission named by --grant
+function main_refresh() {
+    const file =
+        program.grant ? main_grant(program.grant).tokens_path : tokens_path;
+    oauth2_refresh(app_path, file, function (error, response) {
+        if (error) {
+            main_fatal(error);
+        }
+        json_read_file(file, function (error, tokens_info) {
+            if (error) {
+                main_fatal(error);
+            }
+            // Replace expired token with new token:
+            tokens_info.access_token = response.access_token;
+            json_write_file(file, tokens_info, function (error) {
+                if (error) {
+                    main_fatal(error);
+                }
+            });
+        });
+    });
+}
+
+// Split a comma separated command line value into a list
+function main_split_list(value) {
+    return value.split(",").map(function(item) {
+        return item.trim();
+    }).filter(function(item) {
+        return item.length > 0;
+    });
+}
+
+// Create directory and its missing parents
+function main_mkdir_parents(dir) {
+    if (fs.existsSync(dir)) {
+        return;
+    }
+    main_mkdir_parents(path.dirname(dir));
+    fs.mkdirSync(dir);
+}
+
+// Atomically replace file with text, by writing a temporary file next to it
+// and then renaming it, creating the parent directories as needed
+function main_write_file(file, text) {
+    const temp_path = file + ".tmp-" + process.pid;
+    try {
+        main_mkdir_parents(path.dirname(path.resolve(file)));
+        fs.writeFileSync(temp_path, text);
+        fs.renameSync(temp_path, file);
+    } catch (error) {
+        try {
+            fs.unlinkSync(temp_path);
+        } catch (ignored) {
+            // nothing
+        }
+        main_fatal(weekly_error("config", "cannot write '" + file + "': " +
+                                              error.message));
+    }
+}
+
+// Write the output of a command to the standard output or, with --output,
+// atomically replace the given file or upload it to the given url (see
+// main_destinations)
+function main_write_output(text) {
+    const targets = [ program.output, program.postWebhook, program.email ];
+    if (targets.filter(Boolean).length > 1) {
+        main_fatal(weekly_error("usage", "cannot use --output, " +
+                                             "--post-webhook, and --email " +
+                                             "together"));
+    }
+    if (program.email) {
+        main_email(text);
+        return;
+    }
+    if (program.postWebhook) {
+        main_post_webhook(program.postWebhook, text);
+        return;
+    }
+    if (!program.output) {
+        process.stdout.write(text);
+        return;
+    }
+    if (!main_url_scheme(program.output)) {
+        main_write_file(program.output, text);
+        return;
+    }
+    main_upload(program.output, text, function(error) {
+        if (error) {
+            main_fatal(error);
+        }
+    });
+}
+
+// Return the scheme of address, if it is a url such as s3://bucket/key,
+// or null, if it is the path of a file
+function main_url_scheme(address) {
+    const scheme = /^([a-z0-9]+):\/\//.exec(address);
+    return scheme ? scheme[1] : null;
+}
+
+// Return the destination of the scheme of the url address (see
+// main_destinations) or exit if there is none
+function main_destination(address) {
+    const destination = main_destinations[main_url_scheme(address)];
+    if (!destination) {
+        main_fatal(weekly_error("usage",
+                                "unsupported destination: '" + address + "'",
+                                "Available destinations: files, " +
+                                    Object.keys(main_destinations)
+                                        .map(function(name) {
+                                            return name + "://";
+                                        })
+                                        .join(", ")));
+    }
+    return destination;
+}
+
+// Upload text to the url address using the destination of its scheme (see
+// main_destination) and call callback with an error, if any
+function main_upload(address, text, callback) {
+    main_destination(address)(address, url.parse(address), text, callback);
+}
+
+// Time after which an upload is abandoned, in milliseconds
+const main_upload_timeout = 60 * 1000;
+
+// Send text with a PUT request to the http or https target, which contains
+// the protocol, hostname, port, and path of the request, and pass to
+// callback an error, whose hint is auth_hint if the request to upload to
+// address is not authorized, unless the server replies with a successful
+// status within main_upload_timeout
+function main_put(address, target, headers, text, auth_hint, callback) {
+    const client = (target.protocol === "http:") ? http : https;
+    const options = {
+        hostname : target.hostname,
+        port : target.port || ((client === http) ? 80 : 443),
+        method : "PUT",
+        path : target.path,
+        headers : Object.assign({
+            "Content-Length" : Buffer.byteLength(text),
+        }, headers),
+    };
+    const start = Date.now();
+    let request = client.request(options, function(response) {
+        json_log_request(options, start, response.statusCode);
+        response.resume();
+        if (response.statusCode === 401 || response.statusCode === 403) {
+            callback(weekly_error("auth", "you are not authorized to write " +
+                                              "'" + address + "'",
+                                  auth_hint));
+            return;
+        }
+        if (response.statusCode < 200 || response.statusCode >= 300) {
+            callback(weekly_error("api", "upload failed with status " +
+                                             response.statusCode));
+            return;
+        }
+        callback(null);
+    });
+    request.setTimeout(main_upload_timeout, function() {
+        request.destroy(new Error("upload to '" + address + "' timed out"));
+    });
+    request.on("error", function(error) {
+        json_log_request(options, start, error);
+        callback(weekly_error("api", error.message));
+    });
+    request.end(text);
+}
+
+// Send text with a PUT request to the WebDAV target using protocol and
+// the credentials in webdav_path, if it exists, which are only sent over
+// https, so that nobody on the path can read them
+function main_webdav_put(address, protocol, target, text, callback) {
+    let headers = {};
+    let config;
+    try {
+        config = JSON.parse(fs.readFileSync(webdav_path, "utf8"));
+    } catch (error) {
+        if (error.code !== 'ENOENT') {
+            callback(error.syscall ? error
+                                   : weekly_error("config",
+                                                  "invalid '" + webdav_path +
+                                                      "': " + error.message));
+            return;
+        }
+    }
+    if (config !== undefined) {
+        if (config === null || typeof config.username !== "string" ||
+            typeof config.password !== "string") {
+            callback(weekly_error("config", "invalid '" + webdav_path + "'",
+                                  "It must contain a username and a " +
+                                      "password"));
+            return;
+        }
+        if (protocol !== "https:") {
+            callback(weekly_error("usage",
+                                  "refusing to send the credentials in '" +
+                                      webdav_path + "' without TLS",
+                                  "Use a webdavs:// url"));
+            return;
+        }
+        headers["Authorization"] =
+            "Basic " + Buffer.from(config.username + ":" + config.password)
+                           .toString("base64");
+    }
+    main_put(address, Object.assign({}, target, {protocol : protocol}),
+             headers, text,
+             "Check the username and password in '" + webdav_path + "'",
+             callback);
+}
+
+// Payload posted with --post-webhook unless --webhook-template overrides it,
+// which works with both Slack and Mattermost
+const main_webhook_template = "{\"text\": \"{{text}}\"}";
+
+// Post text to the incoming webhook at address (e.g., of Slack or
+// Mattermost) as the JSON payload built from --webhook-template. Since the
+// address grants posting to the channel, it must use https, so that nobody
+// on the path can read it.
+function main_post_webhook(address, text) {
+    const target = url.parse(address);
+    if (target.protocol !== "https:") {
+        main_fatal(weekly_error("usage", "refusing to post to " +
+                                             "--post-webhook without https",
+                                "Use an https url"));
+    }
+    let payload;
+    try {
+        payload = weekly_make_payload(
+            JSON.parse(program.webhookTemplate || main_webhook_template),
+            {text : text});
+    } catch (error) {
+        main_fatal(weekly_error("usage", "invalid --webhook-template: " +
+                                             error.message));
+    }
+    json_send(https, {
+        hostname : target.hostname,
+        port : target.port || 443,
+        method : "POST",
+        path : target.path,
+        headers : {"Content-Type" : "application/json"},
+    }, function(error) {
+        if (error) {
+            main_fatal(error);
+        }
+    }, JSON.stringify(payload), function(status, headers, response_body,
+                                         callback) {
+        if (status === 401 || status === 403) {
+            callback(weekly_error("auth", "you are not authorized to post " +
+                                              "to --post-webhook",
+                                  "Check the --post-webhook url"));
+            return;
+        }
+        if (status < 200 || status >= 300) {
+            callback(weekly_error("api", "request failed with status " +
+                                             status));
+            return;
+        }
+        callback(null, response_body);
+    });
+}
+
+// Send message (see weekly_make_email) from the from address to each of the
+// to addresses through the SMTP server described by config, which contains
+// the host, the port (by default, 465 with secure and 587 otherwise),
+// whether to use TLS from the start (secure), in which case it does not
+// use STARTTLS, and, optionally, the username and password, which are only
+// sent over TLS, and pass to callback an error, if any
+function main_smtp_send(config, from, to, message, callback) {
+    const port = config.port || (config.secure ? 465 : 587);
+    // Only name the server for SNI when it is not an IP address
+    const servername = net.isIP(config.host) ? undefined : config.host;
+    const start = Date.now();
+    let socket;
+    let buffer = "";
+    let lines = [];
+    let pending = null;
+    let done = false;
+    const finish = function(error) {
+        if (done) {
+            return;
+        }
+        done = true;
+        json_log("smtp", {
+            host : config.host + ":" + port,
+            ms : Date.now() - start,
+            error : error ? error.message : undefined,
+        });
+        socket.destroy();
+        callback(error);
+    };
+    const receive = function(data) {
+        buffer += data;
+        let index;
+        while ((index = buffer.indexOf("\n")) >= 0) {
+            const line = buffer.slice(0, index).replace(/\r$/, "");
+            buffer = buffer.slice(index + 1);
+            lines.push(line.slice(4));
+            if (line.charAt(3) === "-") {
+                continue; // more lines of the same reply follow
+            }
+            const reply = {code : parseInt(line, 10), lines : lines};
+            lines = [];
+            const current = pending;
+            pending = null;
+            if (!current) {
+                finish(weekly_error("api", "unexpected SMTP reply: " + line));
+                return;
+            }
+            if (Math.floor(reply.code / 100) !== current.expected) {
+                finish(weekly_error(
+                    (reply.code === 535) ? "auth" : "api",
+                    "SMTP server replied: " + line,
+                    (reply.code === 535) ? "Check the username and " +
+                                               "password in '" + smtp_path +
+                                               "'"
+                                         : undefined));
+                return;
+            }
+            current.next(reply);
+        }
+    };
+    const connect = function(created) {
+        socket = created;
+        socket.setEncoding("utf8");
+        socket.setTimeout(json_timeout, function() {
+            finish(weekly_error("api",
+                                "SMTP server timed out after " +
+                                    json_timeout / 1000 + " seconds",
+                                "Use --timeout to wait longer"));
+        });
+        socket.on("data", receive);
+        socket.on("error", function(error) {
+            finish(weekly_error("api", "SMTP " + error.message));
+        });
+    };
+    // Send command, if any, and pass the reply to next when its status
+    // code starts with the expected digit, or fail otherwise
+    const exchange = function(command, expected, next) {
+        pending = {expected : expected, next : next};
+        if (command !== null) {
+            socket.write(command + "\r\n");
+        }
+    };
+    let secured = !!config.secure;
+    const hello = function() {
+        exchange("EHLO " + os.hostname(), 2, function(reply) {
+            const features = reply.lines.map(function(line) {
+                return line.toUpperCase();
+            });
+            if (!secured && features.indexOf("STARTTLS") >= 0) {
+                exchange("STARTTLS", 2, function() {
+                    socket.removeListener("data", receive);
+                    connect(tls.connect({
+                        socket : socket,
+                        host : config.host,
+                        servername : servername,
+                    }, function() {
+                        secured = true;
+                        hello();
+                    }));
+                });
+                return;
+            }
+            if (config.username === undefined) {
+                envelope();
+                return;
+            }
+            if (!secured) {
+                finish(weekly_error("config",
+                                    "refusing to send the SMTP password " +
+                                        "without TLS",
+                                    "Set secure to true in '" + smtp_path +
+                                        "' or use a server supporting " +
+                                        "STARTTLS"));
+                return;
+            }
+            const credentials = "\u0000" + config.username + "\u0000" +
+                                (config.password || "");
+            exchange("AUTH PLAIN " +
+                         Buffer.from(credentials).toString("base64"),
+                     2, envelope);
+        });
+    };
+    const envelope = function() {
+        exchange("MAIL FROM:<" + from + ">", 2, function() {
+            const recipient = function(index) {
+                if (index >= to.length) {
+                    exchange("DATA", 3, function() {
+                        // Lines starting with a dot need another dot
+                        exchange(message.replace(/^\./gm, "..") + ".", 2,
+                                 function() {
+                            exchange("QUIT", 2, function() { finish(null); });
+                        });
+                    });
+                    return;
+                }
+                exchange("RCPT TO:<" + to[index] + ">", 2, function() {
+                    recipient(index + 1);
+                });
+            };
+            recipient(0);
+        });
+    };
+    const options = {host : config.host, port : port};
+    connect(secured ? tls.connect(Object.assign({servername : servername},
+                                                options))
+                    : net.connect(options));
+    exchange(null, 2, hello);
+}
+
+// Email text to the recipients in smtp_path, as an HTML message when the
+// format is html and as plain text otherwise
+function main_email(text) {
+    let config;
+    try {
+        config = JSON.parse(fs.readFileSync(smtp_path, "utf8"));
+    } catch (error) {
+        main_fatal(error.syscall ? error
+                                 : weekly_error("config", "invalid '" +
+                                                              smtp_path + "'"));
+    }
+    const to = [].concat(config.to || []);
+    if (!config.host || !config.from || to.length <= 0) {
+        main_fatal(weekly_error("config", "'" + smtp_path + "' must " +
+                                              "contain host, from, and to",
+                                "See README.md for instructions"));
+    }
+    const message = weekly_make_email({
+        from : config.from,
+        to : to,
+        subject : config.subject || "Weekly report",
+        type : (program.format === "html") ? "text/html" : "text/plain",
+        text : text,
+        date : moment(),
+    });
+    main_smtp_send(config, config.from, to, message, function(error) {
+        if (error) {
+            main_fatal(error);
+        }
+    });
+}
+
+// Send text with a PUT request signed with credentials (see
+// weekly_s3_headers) to the object whose encoded path is target.pathname in
+// bucket, using the S3 compatible API at endpoint, which must use https,
+// so that nobody on the path can read the request, and the given region;
+// when virtual_host is true, the bucket is part of the host name rather
+// than of the path
+function main_s3_put(address, target, text, options, callback) {
+    const endpoint = url.parse(options.endpoint);
+    if (endpoint.protocol !== "https:") {
+        callback(weekly_error("usage",
+                              "refusing to send credentials to '" +
+                                  options.endpoint + "' without TLS",
+                              "Use an https endpoint"));
+        return;
+    }
+    const encode = function(segment) {
+        return encodeURIComponent(segment).replace(/[!'()*]/g, function(c) {
+            return "%" + c.charCodeAt(0).toString(16).toUpperCase();
+        });
+    };
+    const key = decodeURIComponent(target.pathname || "/")
+                    .slice(1)
+                    .split("/")
+                    .map(encode)
+                    .join("/");
+    const host = options.virtual_host ? target.hostname + "." + endpoint.host
+                                      : endpoint.host;
+    const request_path =
+        (options.virtual_host ? "" : "/" + target.hostname) + "/" + key;
+    const headers = weekly_s3_headers({
+        method : "PUT",
+        host : host,
+        path : request_path,
+        region : options.region,
+        body : text,
+    }, options.credentials, new Date());
+    main_put(address, {
+        protocol : endpoint.protocol,
+        hostname : options.virtual_host ? target.hostname + "." +
+                                              endpoint.hostname
+                                        : endpoint.hostname,
+        port : endpoint.port,
+        path : request_path,
+    }, headers, text, options.auth_hint, callback);
+}
+
+// Destinations of --output and --export by url scheme, besides files. Each
+// destination is a function receiving the url, the parsed url, the text to
+// write, and a callback receiving an error, if any.
+const main_destinations = {
+    gs : function(address, target, text, callback) {
+        if (!process.env.GS_ACCESS_KEY_ID ||
+            !process.env.GS_SECRET_ACCESS_KEY) {
+            callback(weekly_error("config", "missing Cloud Storage " +
+                                                "credentials",
+                                  "Set GS_ACCESS_KEY_ID and " +
+                                      "GS_SECRET_ACCESS_KEY to an HMAC key"));
+            return;
+        }
+        main_s3_put(address, target, text, {
+            endpoint : process.env.GS_ENDPOINT_URL ||
+                           "https://storage.googleapis.com",
+            region : "auto",
+            credentials : {
+                access_key : process.env.GS_ACCESS_KEY_ID,
+                secret_key : process.env.GS_SECRET_ACCESS_KEY,
+            },
+            auth_hint : "Check the HMAC key and its permissions",
+        }, callback);
+    },
+    s3 : function(address, target, text, callback) {
+        if (!process.env.AWS_ACCESS_KEY_ID ||
+            !process.env.AWS_SECRET_ACCESS_KEY) {
+            callback(weekly_error("config", "missing S3 credentials",
+                                  "Set AWS_ACCESS_KEY_ID and " +
+                                      "AWS_SECRET_ACCESS_KEY"));
+            return;
+        }
+        const region = process.env.AWS_REGION || "us-east-1";
+        main_s3_put(address, target, text, {
+            endpoint : process.env.AWS_ENDPOINT_URL ||
+                           "https://s3." + region + ".amazonaws.com",
+            virtual_host : !process.env.AWS_ENDPOINT_URL,
+            region : region,
+            credentials : {
+                access_key : process.env.AWS_ACCESS_KEY_ID,
+                secret_key : process.env.AWS_SECRET_ACCESS_KEY,
+                session_token : process.env.AWS_SESSION_TOKEN,
+            },
+            auth_hint : "Check the AWS credentials and their permissions",
+        }, callback);
+    },
+    webdav : function(address, target, text, callback) {
+        main_webdav_put(address, "http:", target, text, callback);
+    },
+    webdavs : function(address, target, text, callback) {
+        main_webdav_put(address, "https:", target, text, callback);
+    },
+};
+
+// Exit unless projects, read from file, maps each project to an object with
+// an optional known color, an optional string label, optional aliases, and
+// an optional positive budget
+function main_check_projects(projects, file) {
+    const fail = function(message) {
+        main_fatal(
+            weekly_error("config", "invalid '" + file + "': " + message));
+    };
+    if (projects === null || typeof projects !== "object" ||
+        Array.isArray(projects)) {
+        fail("expected an object mapping projects to their style");
+    }
+    Object.keys(projects).forEach(function(project) {
+        const config = projects[project];
+        if (config === null || typeof config !== "object" ||
+            Array.isArray(config)) {
+            fail("expected an object for project '" + project + "'");
+        }
+        if (config.color !== undefined && !weekly_colors[config.color]) {
+            main_fatal(weekly_error("config",
+                                    "unknown color for project '" + project +
+                                        "': '" + config.color + "'",
+                                    "Available colors: " +
+                                        Object.keys(weekly_colors).join(", ")));
+        }
+        if (config.label !== undefined && typeof config.label !== "string") {
+            fail("expected a string label for project '" + project + "'");
+        }
+        if (config.aliases !== undefined &&
+            !(Array.isArray(config.aliases) &&
+              config.aliases.every(function(alias) {
+                  return typeof alias === "string";
+              }))) {
+            main_fatal(weekly_error("config",
+                                    "invalid aliases for project '" + project +
+                                        "'",
+                                    "Aliases are a list of project names"));
+        }
+        if (config.budget !== undefined &&
+            !(typeof config.budget === "number" && config.budget > 0)) {
+            main_fatal(weekly_error("config",
+                                    "invalid budget for project '" + project +
+                                        "': '" + config.budget + "'",
+                                    "Budgets are hours per month, e.g. 60"));
+        }
+    });
+}
+
+// Options whose default can be stored in config_path, with the type of
+// their value
+const main_config_schema = {
+    "activity-regex" : "string",
+    "aggregate" : "string",
+    "billable-hours" : "boolean",
+    "billable-only" : "boolean",
+    "by" : "string",
+    "cache" : "boolean",
+    "coalesce" : "duration",
+    "color" : "string",
+    "columns" : "string",
+    "concurrency" : "integer",
+    "csv-header" : "boolean",
+    "days" : "integer",
+    "debug" : "boolean",
+    "dedup" : "boolean",
+    "field-prefix" : "string",
+    "filter" : "string",
+    "footnotes" : "boolean",
+    "format" : "string",
+    "include-declined" : "boolean",
+    "lowercase" : "boolean",
+    "max-duration" : "duration",
+    "max-events" : "integer",
+    "min-duration" : "duration",
+    "non-billable-only" : "boolean",
+    "percent" : "boolean",
+    "period" : "string",
+    "person-prefix" : "string",
+    "pretty" : "boolean",
+    "project" : "string",
+    "project-regex" : "string",
+    "rollup" : "boolean",
+    "round" : "duration",
+    "round-policy" : "string",
+    "since" : "string",
+    "source" : "string",
+    "split-days" : "boolean",
+    "tag" : "string",
+    "tag-prefix" : "string",
+    "tag-regex" : "string",
+    "template" : "string",
+    "timeout" : "number",
+    "total-by" : "string",
+    "until" : "string",
+    "verbose" : "boolean",
+    "warn-events" : "number",
+    "webhook-template" : "string",
+    "week-start" : "string",
+};
+
+// Options selecting the window of time, such that giving any of them on the
+// command line overrides the defaults of all of them
+const main_window_options = [ "days", "period", "since", "until" ];
+
+// Return the defaults of options stored in config_path, or an empty object
+// if the file does not exist
+function main_config() {
+    let config;
+    try {
+        config = JSON.parse(fs.readFileSync(config_path, "utf8"));
+    } catch (error) {
+        if (error.code === 'ENOENT') {
+            return {};
+        }
+        main_fatal(error.syscall ? error
+                                 : weekly_error("config",
+                                                "invalid '" + config_path +
+                                                    "': " + error.message));
+    }
+    if (config === null || typeof config !== "object" ||
+        Array.isArray(config)) {
+        main_fatal(weekly_error("config", "invalid '" + config_path + "'",
+                                "It must be a json object mapping options " +
+                                    "to their defaults"));
+    }
+    return config;
+}
+
+// Tell whether the option named name is given in args
+function main_has_option(args, name) {
+    return args.some(function(arg) {
+        return arg === "--" + name || arg.startsWith("--" + name + "=");
+    });
+}
+
+// Tell whether the default of the option named name is overridden by the
+// options given in args
+function main_overridden(args, name) {
+    if (main_window_options.indexOf(name) >= 0) {
+        return main_window_options.some(function(option) {
+            return main_has_option(args, option);
+        });
+    }
+    return main_has_option(args, name);
+}
+
+// Return the name of the environment variable overriding the default of
+// the option named name, e.g. WEEKLY_ROUND_POLICY for round-policy
+function main_env_name(name) {
+    return "WEEKLY_" + name.toUpperCase().replace(/-/g, "_");
+}
+
+// Return the value and the source of the default of each option, where the
+// environment variables (see main_env_name) override config_path
+function main_defaults() {
+    const config = main_config();
+    let defaults = {};
+    Object.keys(main_config_schema).forEach(function(name) {
+        const variable = main_env_name(name);
+        if (process.env[variable] !== undefined) {
+            defaults[name] = {
+                value : main_config_value(name, process.env[variable],
+                                          variable),
+                source : variable,
+            };
+        } else if (config[name] !== undefined) {
+            defaults[name] = {value : config[name], source : config_path};
+        }
+    });
+    return defaults;
+}
+
+// Return argv with the defaults of the options it does not give (see
+// main_defaults) inserted before its own options
+function main_apply_config(argv) {
+    const defaults = main_defaults();
+    const given = argv.slice(2);
+    let result = [];
+    Object.keys(defaults).forEach(function(name) {
+        const value = defaults[name].value;
+        if (main_overridden(given, name)) {
+            return;
+        }
+        if (value === true) {
+            result.push("--" + name);
+        } else if (value !== false) {
+            result.push("--" + name, String(value));
+        }
+    });
+    return argv.slice(0, 2).concat(result, given);
+}
+
+// Exit unless the default of the option named name can be configured
+function main_config_key(name) {
+    if (!main_config_schema[name]) {
+        main_fatal(weekly_error("usage", "unknown key: '" + name + "'",
+                                "Available keys: " +
+                                    Object.keys(main_config_schema)
+                                        .join(", ")));
+    }
+}
+
+// Convert value to the type of the default of the option named name, set
+// by the given source (by default, the command line), exiting if the
+// option cannot be configured or the value is not valid
+function main_config_value(name, value, source) {
+    main_config_key(name);
+    const type = main_config_schema[name];
+    const option = program.options.find(function(option) {
+        return option.long === "--" + name;
+    });
+    const words = (main_completion_argument(option) || {}).words;
+    const invalid = function(expected) {
+        main_fatal(weekly_error("usage", "invalid value for '" +
+                                             (source || name) + "': '" +
+                                             value + "'",
+                                "Expected " + expected));
+    };
+    if (type === "boolean") {
+        if (value !== "true" && value !== "false") {
+            invalid("true or false");
+        }
+        return value === "true";
+    }
+    if (type === "integer") {
+        if (!/^\d+$/.test(value) || !(parseInt(value, 10) > 0)) {
+            invalid("a positive integer");
+        }
+        return parseInt(value, 10);
+    }
+    if (type === "number") {
+        if (!/^\d+(\.\d+)?$/.test(value)) {
+            invalid("a number");
+        }
+        return parseFloat(value);
+    }
+    if (type === "duration" && !(weekly_parse_duration(value) > 0)) {
+        invalid("a duration such as 15m");
+    }
+    if (words && !words.some(function(word) {
+            return word === value ||
+                   (word.endsWith(":") && value.startsWith(word));
+        })) {
+        invalid("one of " + words.join(", "));
+    }
+    return value;
+}
+
+// Get, set, or unset the default of an option stored in config_path, or
+// list the options set on the command line, by environment variables, or
+// by config_path, in order of precedence
+function main_config_command(action) {
+    const args = program.args;
+    let config = main_config();
+    const write = function() {
+        main_write_file(config_path, JSON.stringify(config, undefined, 4) +
+                                         "\n");
+    };
+    if (action === "get" && args.length === 1) {
+        main_config_key(args[0]);
+        if (config[args[0]] === undefined) {
+            process.exit(weekly_error_kinds.config);
+        }
+        console.log(String(config[args[0]]));
+    } else if (action === "set" && args.length === 2) {
+        config[args[0]] = main_config_value(args[0], args[1]);
+        write();
+    } else if (action === "unset" && args.length === 1) {
+        main_config_key(args[0]);
+        delete config[args[0]];
+        write();
+    } else if (action === "list" && args.length === 0) {
+        const given = process.argv.slice(2);
+        const defaults = main_defaults();
+        Object.keys(main_config_schema).forEach(function(name) {
+            const flag = main_has_option(given, name);
+            const key = name.replace(/-([a-z])/g, function(match, letter) {
+                return letter.toUpperCase();
+            });
+            if (!flag && (!defaults[name] || main_overridden(given, name))) {
+                return;
+            }
+            const value = flag ? program[key] : defaults[name].value;
+            console.log(name + "=" +
+                        (Array.isArray(value) ? value.join(",") : value) +
+                        " (" +
+                        (flag ? "command line" : defaults[name].source) + ")");
+        });
+    } else {
+        main_fatal(weekly_error("usage", "invalid config command",
+                                "Use '--config get <key>', '--config set " +
+                                    "<key> <value>', '--config unset <key>', " +
+                                    "or '--config list'"));
+    }
+}
+
+// Return the configured color, label, budget, and aliases of each project,
+// read from private/projects.json, or an empty object if the file does not
+// exist
+function main_projects() {
+    let projects;
+    try {
+        projects = JSON.parse(fs.readFileSync(projects_path, "utf8"));
+    } catch (error) {
+        if (error.code === 'ENOENT') {
+            return {};
+        }
+        main_fatal(error.syscall
+                       ? error
+                       : weekly_error("config", "invalid '" + projects_path +
+                                                    "': " + error.message));
+    }
+    main_check_projects(projects, projects_path);
+    return projects;
+}
+
+// Return the map from the aliases of projects, listed in the aliases of each
+// project in private/projects.json, to the name of the project
+function main_aliases() {
+    const projects = main_projects();
+    let aliases = {};
+    Object.keys(projects).forEach(function(project) {
+        (projects[project].aliases || []).forEach(function(alias) {
+            aliases[alias] = project;
+        });
+    });
+    return aliases;
+}
+
+// Return the budget in hours of each project within window, according to
+// the monthly budgets in private/projects.json (see weekly_budget_hours)
+function main_budgets(window) {
+    const projects = main_projects();
+    let monthly = {};
+    Object.keys(projects).forEach(function(project) {
+        if (projects[project].budget !== undefined) {
+            monthly[project] = projects[project].budget;
+        }
+    });
+    return weekly_budget_hours(monthly, window);
+}
+
+// Print the consumed and remaining budget of each project, warning about
+// the projects that are over budget
+function main_budget(events, window) {
+    const table = weekly_make_budget_table(events, main_budgets(window));
+    table.rows.forEach(function(row) {
+        if (Number(row[3]) < 0) {
+            console.error("warning: project '" + row[0] + "' is over budget: " +
+                          row[2] + " of " + row[1] + " hours");
+        }
+    });
+    main_print_table(table);
+}
+
+// Tell whether to use colors according to --color and, when it is auto (the
+// default), to whether the output is a terminal and NO_COLOR is not set
+function main_use_color() {
+    const mode = program.color || "auto";
+    if ([ "auto", "always", "never" ].indexOf(mode) < 0) {
+        main_fatal(weekly_error("usage", "unknown color mode: '" + mode + "'",
+                                "Available color modes: auto, always, never"));
+    }
+    if (mode === "auto") {
+        return Boolean(process.stdout.isTTY) && !process.env.NO_COLOR &&
+               !main_deterministic;
+    }
+    return mode === "always";
+}
+
+// Print table using the format and the columns selected on the command line,
+// where columns defaults to all the columns of the table
+function main_print_table(table, columns) {
+    columns = program.columns || columns;
+    if (columns) {
+        try {
+            table = weekly_select_columns(table, columns);
+        } catch (error) {
+            main_fatal(weekly_error("usage", error.message,
+                                    "Available columns: " +
+                                        table.header.join(", ")));
+        }
+    }
+    const name = program.format || "box";
+    const format = weekly_formats[name];
+    if (!format) {
+        main_fatal(weekly_error("usage", "unknown format: '" + name + "'",
+                                "Available formats: " +
+                                    Object.keys(weekly_formats)
+                                        .concat(Object.keys(
+                                            weekly_event_formats))
+                                        .join(", ")));
+    }
+    let output;
+    try {
+        output = format(table, {
+            color : main_use_color(),
+            header : program.csvHeader,
+            pretty : program.pretty,
+            projects : main_projects(),
+            width : main_deterministic ? 80 : process.stdout.columns,
+        });
+    } catch (error) {
+        main_fatal(weekly_error("usage", error.message));
+    }
+    main_write_output(output);
+}
+
+// Parse the --since and --until dates into a window including both days
+function main_range_window() {
+    if (program.since === undefined) {
+        main_fatal(weekly_error("usage", "--until requires --since"));
+    }
+    const parse = function(option, value) {
+        const regexp = /^\d{4}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])$/;
+        if (!regexp.test(value) || !moment(value, "YYYY-MM-DD").isValid()) {
+            main_fatal(weekly_error("usage",
+                                    "invalid " + option + ": '" + value + "'",
+                                    "The date must be a day such as " +
+                                        "2025-01-31"));
+        }
+        return moment(value, "YYYY-MM-DD");
+    };
+    let window = {start : parse("--since", program.since)};
+    if (program.until !== undefined) {
+        window.end = parse("--until", program.until).add(1, "day");
+        if (!window.end.isAfter(window.start)) {
+            main_fatal(weekly_error("usage", "--until is before --since"));
+        }
+    }
+    return window;
+}
+
+// Exit unless value, given with the option named name, is a month
+function main_check_month(name, value) {
+    if (!/^\d{4}-(0[1-9]|1[0-2])$/.test(value)) {
+        main_fatal(weekly_error("usage",
+                                "invalid " + name + ": '" + value + "'",
+                                "The " + name + " must be a month such as " +
+                                    "2025-01"));
+    }
+}
+
+// Compute the window of time to query, by default the current week, or the
+// current month with --budget
+function main_window() {
+    if (program.standup) {
+        return main_standup_window();
+    }
+    const range = program.since !== undefined || program.until !== undefined;
+    if (program.days !== undefined && program.period ||
+        (program.days !== undefined || program.period) && range) {
+        main_fatal(weekly_error("usage", "cannot use --days, --period, and " +
+                                             "--since together"));
+    }
+    if (range) {
+        return main_range_window();
+    }
+    if (program.days !== undefined) {
+        if (!(program.days > 0)) {
+            main_fatal(weekly_error("usage", "invalid number of days"));
+        }
+        return {
+            start : moment().startOf("day").subtract(program.days - 1, "days"),
+        };
+    }
+    if (program.period) {
+        main_check_month("period", program.period);
+        const start = moment(program.period, "YYYY-MM");
+        return {
+            start : start,
+            end : start.clone().add(1, "month"),
+        };
+    }
+    if (program.budget) {
+        return {
+            start : moment().startOf("month"),
+            end : moment().startOf("month").add(1, "month"),
+        };
+    }
+    return {
+        start : weekly_start_of_week(moment(), main_week_start()),
+    };
+}
+
+// Return the window of --standup, which contains the --days days (by
+// default, one) before today
+function main_standup_window() {
+    if (program.period || program.since !== undefined ||
+        program.until !== undefined) {
+        main_fatal(weekly_error("usage", "--standup only accepts --days"));
+    }
+    const days = (program.days !== undefined) ? program.days : 1;
+    if (!(days > 0)) {
+        main_fatal(weekly_error("usage", "invalid number of days"));
+    }
+    const today = moment().startOf("day");
+    return {
+        start : today.clone().subtract(days, "days"),
+        end : today,
+    };
+}
+
+// Return the day starting weeks, according to --week-start, where 0 is
+// Sunday and 1 is Monday (the default)
+function main_week_start() {
+    const days = {sun : 0, mon : 1};
+    const name = program.weekStart || "mon";
+    if (days[name] === undefined) {
+        main_fatal(weekly_error("usage", "unknown week start: '" + name + "'",
+                                "Available week starts: mon, sun"));
+    }
+    return days[name];
+}
+
+// Build the view available to templates, where invoice is optional
+function main_template_view(events, window, invoice) {
+    const stats = weekly_aggregate_events(events);
+    const fixed = function(value) { return value.toFixed(2); };
+    let view = {
+        start : window.start.format("YYYY-MM-DD"),
+        end : (window.end || moment()).format("YYYY-MM-DD"),
+        now : moment().format("YYYY-MM-DD HH:mm"),
+        events : events.map(function(evt) {
+            const start = moment(evt.start);
+            const end = moment(evt.end);
+            return Object.assign({}, evt, weekly_parse_summary(evt.summary), {
+                date : start.format("YYYY-MM-DD"),
+                start : start.format("HH:mm"),
+                end : end.format("HH:mm"),
+                hours : fixed(end.diff(start, "hours", true)),
+            });
+        }),
+        totals : Object.keys(stats.details).sort().map(function(key) {
+            return {
+                summary : key,
+                hours : fixed(stats.details[key]),
+                percent : fixed(stats.percentage[key]),
+            };
+        }),
+        total : fixed(stats.total),
+    };
+    if (invoice) {
+        view.invoice = Object.assign({}, invoice, {
+            clients : invoice.clients.map(function(client) {
+                return {
+                    client : client.client,
+                    items : client.items.map(function(item) {
+                        return {
+                            project : item.project,
+                            hours : fixed(item.hours),
+                            rate : fixed(item.rate),
+                            amount : fixed(item.amount),
+                        };
+                    }),
+                    subtotal : fixed(client.subtotal),
+                };
+            }),
+            net : fixed(invoice.net),
+            vat : fixed(invoice.vat),
+            total : fixed(invoice.total),
+        });
+    }
+    return view;
+}
+
+// Print the view rendered using the template selected on the command line
+function main_print_template(view) {
+    fs.readFile(program.template, "utf8", function(error, data) {
+        if (error) {
+            main_fatal(error);
+        }
+        let template;
+        try {
+            template = weekly_parse_template(data);
+        } catch (error) {
+            main_fatal(weekly_error("config",
+                                    "invalid template: " + error.message));
+        }
+        main_write_output(weekly_render_template(template, view));
+    });
+}
+
+// Print invoice for events using the rates in rates_path
+function main_invoice(events, window) {
+    json_read_file(rates_path, function(error, rates) {
+        if (error) {
+            main_fatal(error);
+        }
+        const invoice = weekly_make_invoice(events, rates);
+        if (invoice.unbilled.length > 0) {
+            console.error("warning: projects without rate: " +
+                          invoice.unbilled.join(", "));
+        }
+        if (program.template) {
+            main_print_template(main_template_view(events, window, invoice));
+            return;
+        }
+        if (program.format === "json") {
+            main_write_output(JSON.stringify(invoice, undefined, 4) + "\n");
+            return;
+        }
+        main_print_table(weekly_make_invoice_table(invoice));
+    });
+}
+
+// Check the custom fields of events and exit if they do not match the
+// schema in fields_path, or just report problems when linting
+function main_check_fields(events, callback) {
+    json_read_file(fields_path, function(error, schema) {
+        if (error) {
+            main_fatal(error);
+        }
+        const problems = weekly_check_fields(events, schema);
+        if (problems.length > 0 && !program.lint) {
+            main_fatal(weekly_error("config", problems.join("\n")));
+        }
+        problems.forEach(function(problem) {
+            console.error(problem);
+        });
+        if (problems.length > 0) {
+            process.exit(weekly_error_kinds.config);
+        }
+        if (program.lint) {
+            console.log("All custom fields match the schema");
+            return;
+        }
+        callback();
+    });
+}
+
+// Parse a --field key=value option and add it to the previous ones
+function main_parse_field(value, fields) {
+    const index = value.indexOf("=");
+    if (index <= 0) {
+        main_fatal(weekly_error("usage", "invalid field: '" + value + "'",
+                                "Fields must be written as key=value"));
+    }
+    fields = Object.assign({}, fields);
+    fields[value.substr(0, index)] = value.substr(index + 1);
+    return fields;
+}
+
+// Set the timeout of requests according to --timeout, in seconds
+function main_set_timeout() {
+    if (program.timeout === undefined) {
+        return;
+    }
+    if (!(program.timeout >= 0)) {
+        main_fatal(weekly_error("usage", "invalid timeout"));
+    }
+    json_set_timeout(program.timeout * 1000);
+}
+
+// Change the prefixes of summaries according to --tag-prefix,
+// --person-prefix, and --field-prefix, which must be one or two punctuation
+// characters, none of them starting another
+function main_set_sigils() {
+    const sigils = Object.assign({}, weekly_sigils);
+    [
+        [ "--tag-prefix", program.tagPrefix, "tag" ],
+        [ "--person-prefix", program.personPrefix, "person" ],
+        [ "--field-prefix", program.fieldPrefix, "field" ],
+    ].forEach(function(option) {
+        if (option[1] === undefined) {
+            return;
+        }
+        if (!/^[!-\/:-@\[-`{-~]{1,2}$/.test(option[1])) {
+            main_fatal(weekly_error("usage", "invalid " + option[0] + ": '" +
+                                                 option[1] + "'",
+                                    "Prefixes are one or two punctuation " +
+                                        "characters, e.g. +"));
+        }
+        sigils[option[2]] = option[1];
+    });
+    const values = [ sigils.tag, sigils.person, sigils.field ];
+    if (values.some(function(value, index) {
+            return values.some(function(other, index2) {
+                return index !== index2 && other.startsWith(value);
+            });
+        })) {
+        main_fatal(weekly_error("usage", "summary prefixes must be distinct"));
+    }
+    weekly_set_sigils(sigils);
+}
+
+// Parse a comma separated list of values and add them to the previous ones
+function main_parse_list(value, values) {
+    return (values || []).concat(value.split(",").filter(function(item) {
+        return item !== "";
+    }));
+}
+
+// Filter and transform events according to the command line options,
+// counting the events dropped for each reason into excluded. Stages run in
+// this order: --dedup, ~ignore, declined, aliases and --lowercase, --rollup,
+// the filters (--field, --project, --tag, the regexps, the billable ones,
+// --search, --filter, and the durations), --split-days, --coalesce, and
+// --round, such that rounding applies to the coalesced events
+function main_pipeline(events, excluded) {
+    const filter = function(reason, keep) {
+        return function(evt) {
+            if (keep(evt)) {
+                return evt;
+            }
+            excluded[reason] = (excluded[reason] || 0) + 1;
+            return undefined;
+        };
+    };
+    let seen = {};
+    let stages = [];
+    if (program.dedup) {
+        stages.push(filter("duplicate", function(evt) {
+            const key = weekly_event_key(evt);
+            const first = !seen[key];
+            seen[key] = true;
+            return first;
+        }));
+    }
+    stages.push(filter("marked ~ignore",
+                       function(evt) { return !weekly_is_ignored(evt); }));
+    if (!program.includeDeclined) {
+        stages.push(filter("declined or cancelled", function(evt) {
+            return !weekly_is_declined(evt);
+        }));
+    }
+    const aliases = main_aliases();
+    if (Object.keys(aliases).length > 0 || program.lowercase) {
+        stages.push(function(evt) {
+            return weekly_alias_event(evt, aliases, program.lowercase);
+        });
+    }
+    if (program.rollup) {
+        stages.push(weekly_rollup_event);
+    }
+    if (program.field) {
+        stages.push(filter("not matching --field", function(evt) {
+            return weekly_match_fields(evt, program.field);
+        }));
+    }
+    if (program.project) {
+        stages.push(filter("not matching --project", function(evt) {
+            return weekly_match_any(evt, "project", program.project);
+        }));
+    }
+    if (program.tag) {
+        const tags = program.tag.map(function(tag) {
+            return (tag.startsWith(weekly_sigils.tag) ? tag
+                                                      : weekly_sigils.tag + tag)
+                .toLowerCase();
+        });
+        stages.push(filter("not matching --tag", function(evt) {
+            return weekly_match_any(evt, "tag", tags);
+        }));
+    }
+    [
+        [ "--project-regex", program.projectRegex, "project" ],
+        [ "--tag-regex", program.tagRegex, "tag" ],
+        [ "--activity-regex", program.activityRegex, "summary" ],
+    ].forEach(function(option) {
+        if (option[1] === undefined) {
+            return;
+        }
+        let regexp;
+        try {
+            regexp = new RegExp(option[1]);
+        } catch (error) {
+            main_fatal(weekly_error("usage", "invalid " + option[0] + ": " +
+                                                 error.message));
+        }
+        stages.push(filter("not matching " + option[0], function(evt) {
+            return weekly_match_regexp(evt, option[2], regexp);
+        }));
+    });
+    if (program.billableOnly && program.nonBillableOnly) {
+        main_fatal(weekly_error("usage", "cannot use --billable-only and " +
+                                             "--non-billable-only together"));
+    }
+    if (program.billableOnly || program.nonBillableOnly) {
+        const projects = main_projects();
+        const billable = Boolean(program.billableOnly);
+        const keep = function(evt) {
+            return weekly_is_billable(evt, projects) === billable;
+        };
+        stages.push(filter(billable ? "not billable" : "billable", keep));
+    }
+    if (program.search !== undefined) {
+        stages.push(filter("not matching --search", function(evt) {
+            return weekly_search_event(evt, program.search);
+        }));
+    }
+    if (program.filter !== undefined) {
+        let tree;
+        try {
+            tree = weekly_parse_filter(program.filter);
+        } catch (error) {
+            main_fatal(weekly_error("usage",
+                                    "invalid filter: " + error.message,
+                                    "See README.md for the filter syntax"));
+        }
+        stages.push(filter("not matching --filter", function(evt) {
+            return weekly_eval_filter(tree, evt);
+        }));
+    }
+    [
+        [ "--min-duration", program.minDuration, "shorter than" ],
+        [ "--max-duration", program.maxDuration, "longer than" ],
+    ].forEach(function(option) {
+        if (option[1] === undefined) {
+            return;
+        }
+        if (!(option[1] >= 0)) {
+            main_fatal(weekly_error("usage", "invalid " + option[0] + ": " +
+                                                 "expected a duration"));
+        }
+        const longest = (option[0] === "--max-duration");
+        stages.push(filter(option[2] + " " + option[0], function(evt) {
+            const minutes = weekly_event_minutes(evt);
+            return longest ? minutes <= option[1] : minutes >= option[1];
+        }));
+    });
+    if (program.splitDays) {
+        stages.push(weekly_split_days);
+    }
+    if (program.coalesce !== undefined) {
+        if (!(program.coalesce >= 0)) {
+            main_fatal(weekly_error("usage", "invalid coalesce gap"));
+        }
+        events = weekly_coalesce_events(weekly_run_stages(events, stages),
+                                        program.coalesce);
+        stages = [];
+    }
+    if (program.round !== undefined) {
+        const policy = program.roundPolicy || "nearest";
+        if (!(program.round > 0)) {
+            main_fatal(weekly_error("usage", "invalid rounding increment"));
+        }
+        if (["up", "down", "nearest"].indexOf(policy) < 0) {
+            main_fatal(weekly_error("usage", "unknown rounding policy: '" +
+                                                 policy + "'",
+                                    "Available policies: up, down, nearest"));
+        }
+        stages.push(function(evt) {
+            return weekly_round_event(evt, program.round, policy);
+        });
+    }
+    events = weekly_run_stages(events, stages);
+    if (program.verbose && excluded.duplicate) {
+        console.error("verbose: removed " + excluded.duplicate +
+                      " duplicate events");
+    }
+    return events;
+}
+
+// Return the maximum number of events to fetch, set with --max-events
+function main_max_events() {
+    const max_events = (program.maxEvents !== undefined) ? program.maxEvents
+                                                         : 4096;
+    if (!(max_events > 0)) {
+        main_fatal(weekly_error("usage", "invalid maximum number of events"));
+    }
+    return max_events;
+}
+
+// Return the number of requests fetching events at the same time, set
+// with --concurrency
+function main_concurrency() {
+    const concurrency =
+        (program.concurrency !== undefined) ? program.concurrency : 4;
+    if (!(concurrency >= 1)) {
+        main_fatal(weekly_error("usage", "invalid concurrency"));
+    }
+    return concurrency;
+}
+
+// Warn when fetching events stopped at max_events, such that the report is
+// incomplete, or when the number of events is close to max_events, i.e.
+// above the --warn-events percentage of it
+function main_warn_max_events(response, max_events, window) {
+    const count = response.items.length;
+    const threshold = (program.warnEvents !== undefined) ? program.warnEvents
+                                                         : 90;
+    const range = window.start.format("YYYY-MM-DD") + " and " +
+                  (window.end || moment()).format("YYYY-MM-DD");
+    if (response.truncated) {
+        console.error("warning: stopped after fetching " + count +
+                      " events between " + range + ", so the report is " +
+                      "incomplete; use --max-events to fetch more");
+        return;
+    }
+    if (count >= max_events * threshold / 100) {
+        console.error("warning: fetched " + count + " events between " +
+                      range + ", close to the maximum of " + max_events +
+                      " (see --max-events)");
+    }
+}
+
+// Archive the events of the google calendar starting within the window into
+// file, which contains the raw events and, once complete, the events parsed
+// as in --list. The archive is written after each page of events, so that an
+// interrupted export is resumed by running the same command again, unless
+// file is a url (see main_destinations), where the archive is only uploaded
+// once complete.
+function main_export(file) {
+    const window = main_window();
+    const range = {
+        start : window.start.toISOString(),
+        end : window.end ? window.end.toISOString() : null,
+    };
+    let archive = {version : 1, window : range, complete : false, raw : []};
+    const remote = main_url_scheme(file) !== null;
+    if (remote) {
+        main_destination(file);
+    }
+    let previous;
+    try {
+        previous =
+            remote ? undefined : JSON.parse(fs.readFileSync(file, "utf8"));
+    } catch (error) {
+        if (error.code !== "ENOENT") {
+            main_fatal(error.syscall ? error
+                                     : weekly_error("config",
+                                                    "invalid archive: '" +
+                                                        file + "'"));
+        }
+    }
+    if (previous !== undefined) {
+        if (previous === null || typeof previous !== "object" ||
+            !Array.isArray(previous.raw)) {
+            main_fatal(weekly_error("config",
+                                    "invalid archive: '" + file + "'"));
+        }
+        if (previous.version !== archive.version || !previous.window ||
+            previous.window.start !== range.start ||
+            previous.window.end !== range.end) {
+            main_fatal(weekly_error("usage", "'" + file + "' archives " +
+                                                 "another window of time",
+                                    "Remove it or choose another file"));
+        }
+        if (previous.complete) {
+            console.log("Export to '" + file + "' is already complete");
+            return;
+        }
+        archive = previous;
+        console.log("Resuming export to '" + file + "' after " +
+                    archive.raw.length + " events");
+    }
+    const next = function(page_token) {
+        calendar_events_page(tokens_path, calendar_path, window, page_token,
+                             2500, function(error, response) {
+            if (error) {
+                main_fatal(error);
+            }
+            archive.raw = archive.raw.concat(response.items);
+            if (response.nextPageToken) {
+                archive.next_page_token = response.nextPageToken;
+                if (!remote) {
+                    main_write_file(file,
+                                    JSON.stringify(archive, null, 4) + "\n");
+                }
+                next(response.nextPageToken);
+                return;
+            }
+            delete archive.next_page_token;
+            archive.complete = true;
+            archive.events = weekly_filter_events({items : archive.raw})
+                                 .map(function(evt) {
+                                     return Object.assign(
+                                         {}, evt,
+                                         weekly_parse_summary(evt.summary));
+                                 });
+            const done = function() {
+                console.log("Exported " + archive.raw.length +
+                            " events to '" + file + "'");
+            };
+            const text = JSON.stringify(archive, null, 4) + "\n";
+            if (!remote) {
+                main_write_file(file, text);
+                done();
+                return;
+            }
+            main_upload(file, text, function(error) {
+                if (error) {
+                    main_fatal(error);
+                }
+                done();
+            });
+        });
+    };
+    next(archive.next_page_token);
+}
+
+// Sources of events by name. Each source is a function receiving the
+// location given after the colon in --source, if any, the query window, and
+// a callback receiving either an error or the events starting within the
+// window, in the format returned by weekly_filter_events.
+const main_sources = {
+    google : function(location, window, callback) {
+        const max_events = main_max_events();
+        calendar_events(tokens_path, calendar_path, window,
+                        function(error, response) {
+            if (error && error.reason === "not_found") {
+                callback(weekly_error("config", "calendar not found",
+                                      "Select another calendar with " +
+                                          "'node index.js --step3'"));
+                return;
+            }
+            if (error) {
+                callback(error);
+                return;
+            }
+            main_warn_max_events(response, max_events, window);
+            callback(null, weekly_filter_events(response));
+        }, max_events, main_concurrency());
+    },
+    caldav : function(location, window, callback) {
+        calendar_caldav_events(location || caldav_path, window,
+                               function(error, response) {
+            if (error) {
+                callback(error);
+                return;
+            }
+            let events;
+            try {
+                events = weekly_parse_caldav(response);
+            } catch (error) {
+                callback(weekly_error("api", "invalid caldav calendar: " +
+                                                 error.message));
+                return;
+            }
+            callback(null, weekly_filter_window(events, window));
+        });
+    },
+    ics : function(location, window, callback) {
+        if (!location) {
+            callback(weekly_error("usage", "missing location of source",
+                                  "Use, e.g., '--source ics:cal.ics'"));
+            return;
+        }
+        fs.readFile(location, "utf8", function(error, data) {
+            if (error) {
+                callback(error);
+                return;
+            }
+            let events;
+            try {
+                events = weekly_parse_ics(data);
+            } catch (error) {
+                callback(weekly_error("config", "invalid '" + location +
+                                                    "': " + error.message));
+                return;
+            }
+            callback(null, weekly_filter_window(events, window));
+        });
+    },
+    stdin : function(location, window, callback) {
+        if (process.stdin.isTTY) {
+            callback(weekly_error("usage", "the stdin source needs piped input",
+                                  "Use, e.g., 'node index.js --source stdin " +
+                                      "< events.jsonl'"));
+            return;
+        }
+        let data = "";
+        process.stdin.setEncoding("utf8");
+        process.stdin.on("data", function(chunk) { data += chunk; });
+        process.stdin.on("end", function() {
+            let items;
+            try {
+                items = weekly_parse_raw_events(data);
+            } catch (error) {
+                callback(weekly_error("config", "invalid event on stdin: " +
+                                                    error.message));
+                return;
+            }
+            callback(null, weekly_filter_window(
+                weekly_filter_events({items : items}), window));
+        });
+    },
+    local : function(location, window, callback) {
+        const file = location || main_local_path();
+        fs.readFile(file, "utf8", function(error, data) {
+            if (error) {
+                callback(error);
+                return;
+            }
+            let events;
+            try {
+                events = weekly_parse_journal(data);
+            } catch (error) {
+                callback(weekly_error("config", "invalid '" + file + "': " +
+                                                    error.message));
+                return;
+            }
+            callback(null, weekly_filter_window(events, window));
+        });
+    },
+};
+
+// Maximum number of windows of events kept in the events cache
+const main_events_cache_size = 64;
+
+// Return the key identifying the calendar of the network source named name
+// at location in the events cache, i.e. the id of the google calendar or
+// the url of the caldav one, or null when the calendar is not configured
+function main_events_cache_key(name, location) {
+    try {
+        if (name === "google") {
+            return "google:" +
+                   JSON.parse(fs.readFileSync(calendar_path, "utf8"));
+        }
+        const config =
+            JSON.parse(fs.readFileSync(location || caldav_path, "utf8"));
+        return "caldav:" + config.url;
+    } catch (ignored) {
+        return null;
+    }
+}
+
+// Return the entries of the events cache, each containing the key of the
+// calendar (see main_events_cache_key), the start and end (null for windows
+// without end) of a window, the time when its events were fetched, and the
+// events, or an empty list when the cache is missing or invalid
+function main_read_events_cache() {
+    try {
+        const cache = JSON.parse(fs.readFileSync(
+            path.join(main_cache_dir(), "events.json"), "utf8"));
+        return Array.isArray(cache.entries) ? cache.entries : [];
+    } catch (ignored) {
+        return [];
+    }
+}
+
+// Remember the events of the calendar identified by key fetched within
+// window, replacing the entries of the same calendar whose window is within
+// window, so that --offline can answer from them. The cache is only readable
+// by the user, since events are private. Since this is a convenience,
+// errors are ignored.
+function main_cache_events(key, window, events) {
+    const entry = {
+        key : key,
+        start : window.start.toISOString(),
+        end : window.end ? window.end.toISOString() : null,
+        fetched : moment().toISOString(),
+        events : events,
+    };
+    const within = function(other) {
+        return other.key === key &&
+               !moment(other.start).isBefore(entry.start) &&
+               (entry.end === null ||
+                other.end !== null && !moment(other.end).isAfter(entry.end));
+    };
+    const entries = main_read_events_cache().filter(function(other) {
+        return !within(other);
+    });
+    try {
+        main_mkdir_parents(main_cache_dir());
+        fs.writeFileSync(path.join(main_cache_dir(), "events.json"),
+                         JSON.stringify({
+                             entries : [ entry ].concat(entries).slice(
+                                 0, main_events_cache_size),
+                         }) + "\n",
+                         {mode : 0o600});
+    } catch (ignored) {
+        // nothing
+    }
+}
+
+// Pass to callback the cached events of the calendar identified by key
+// within window, taken from the most recent entry covering it, where only
+// entries without end cover windows without end, or fail if none covers it
+function main_cached_events(key, window, callback) {
+    const entry = main_read_events_cache().find(function(entry) {
+        if (entry.key !== key || moment(entry.start).isAfter(window.start)) {
+            return false;
+        }
+        if (!window.end) {
+            return entry.end === null;
+        }
+        return !moment(entry.end || entry.fetched).isBefore(window.end);
+    });
+    if (!entry) {
+        const range = window.start.format("YYYY-MM-DD") + " and " +
+                      (window.end || moment()).format("YYYY-MM-DD");
+        callback(weekly_error("config",
+                              "events between " + range + " are not cached",
+                              "Run once with --cache and without --offline " +
+                                  "to cache them"));
+        return;
+    }
+    callback(null, weekly_filter_window(entry.events, window));
+}
+
+// Wrap the fetch function of the network source named name such that, with
+// --cache, it caches the fetched events or, with --offline, answers from
+// the cache without accessing the network
+function main_cached_source(name, fetch) {
+    return function(location, window, callback) {
+        const key = main_events_cache_key(name, location);
+        if (program.offline) {
+            main_cached_events(key, window, callback);
+            return;
+        }
+        fetch(location, window, function(error, events) {
+            if (!error && program.cache && key !== null) {
+                main_cache_events(key, window, events);
+            }
+            callback(error, events);
+        });
+    };
+}
+
+// Return the source selected with --source name[:location], which defaults
+// to the Google calendar selected with --step3
+function main_source() {
+    const spec = program.source || "google";
+    const index = spec.indexOf(":");
+    const name = (index < 0) ? spec : spec.slice(0, index);
+    if (!main_sources[name]) {
+        main_fatal(weekly_error("usage", "unknown source: '" + name + "'",
+                                "Available sources: " +
+                                    Object.keys(main_sources).join(", ")));
+    }
+    const network = (name === "google" || name === "caldav");
+    return {
+        fetch : network ? main_cached_source(name, main_sources[name])
+                        : main_sources[name],
+        location : (index < 0) ? undefined : spec.slice(index + 1),
+    };
+}
+
+// Query the source of events and print statistics
+function main_weekly() {
+    const window = main_window();
+    const source = main_source();
+    source.fetch(source.location, window, function(error, response) {
+        if (error) {
+            main_fatal(error);
+        }
+        let excluded = {};
+        const events = main_pipeline(response, excluded);
+        main_cache_completion(events);
+        const report = function() {
+            if (program.diff) {
+                main_diff(source, window, events);
+                return;
+            }
+            main_report(events, window);
+            if (program.footnotes) {
+                process.stderr.write(weekly_format_footnotes(excluded));
+            }
+        };
+        if (program.lint || program.strict) {
+            main_check_fields(events, report);
+            return;
+        }
+        report();
+    });
+}
+
+// Clear the screen and print statistics every given number of minutes,
+// recomputing the window each time, such that, e.g., --days 1 keeps
+// following today, until interrupted
+function main_watch(minutes) {
+    if (!(minutes > 0)) {
+        main_fatal(weekly_error("usage", "invalid --watch: expected a " +
+                                             "duration (e.g. 5m)"));
+    }
+    const refresh = function() {
+        process.stdout.write("\x1b[2J\x1b[H" + "Every " + minutes +
+                             "m, updated at " + moment().format("HH:mm:ss") +
+                             "\n\n");
+        main_weekly();
+    };
+    refresh();
+    setInterval(refresh, minutes * 60 * 1000);
+}
+
+// Append the hours spent on each summary in each day of the window to the
+// spreadsheet selected with --sheet id[:tab] (by default, its first tab),
+// writing the header first when the tab is empty, and skipping the days
+// already in the tab, so that exporting the same window twice does not
+// duplicate rows
+function main_sheet(spec) {
+    const index = spec.indexOf(":");
+    const id = (index < 0) ? spec : spec.slice(0, index);
+    const tab = (index < 0) ? "" : spec.slice(index + 1);
+    const range = tab ? "'" + tab.replace(/'/g, "''") + "'!A:C" : "A:C";
+    const fail = function(error) {
+        if (error.kind === "auth") {
+            error.hint = "Try running 'node index.js --refresh --grant sheets'";
+        } else if (error.status === 403) {
+            error.hint = main_missing_hints[sheets_tokens_path];
+        } else if (error.reason === "not_found") {
+            error.hint = "Check the spreadsheet id given to --sheet";
+        }
+        main_fatal(error);
+    };
+    const window = main_window();
+    const source = main_source();
+    source.fetch(source.location, window, function(error, events) {
+        if (error) {
+            main_fatal(error);
+        }
+        const table = weekly_make_period_table(main_pipeline(events, {}),
+                                               "daily", main_week_start(),
+                                               false);
+        sheets_get_values(sheets_tokens_path, id, range,
+                          function(error, response) {
+            if (error) {
+                fail(error);
+            }
+            const existing = response.values || [];
+            const days = existing.map(function(row) { return row[0]; });
+            const rows = table.rows.filter(function(row) {
+                return days.indexOf(row[0]) < 0;
+            });
+            if (rows.length < table.rows.length) {
+                console.log("Skipped " + (table.rows.length - rows.length) +
+                            " rows of days already in the spreadsheet");
+            }
+            if (rows.length <= 0) {
+                return;
+            }
+            sheets_append_values(
+                sheets_tokens_path, id, range,
+                (existing.length > 0) ? rows : [ table.header ].concat(rows),
+                function(error) {
+                    if (error) {
+                        fail(error);
+                    }
+                    console.log("Appended " + rows.length + " rows to the " +
+                                "spreadsheet");
+                });
+        });
+    });
+}
+
+// Add to Jira the worklogs of the events in the window (see
+// weekly_make_worklogs), skipping those whose marker is in the comment of
+// a worklog of their issue, or only preview them with --dry-run
+function main_push_jira() {
+    const window = main_window();
+    const source = main_source();
+    source.fetch(source.location, window, function(error, events) {
+        if (error) {
+            main_fatal(error);
+        }
+        const worklogs = weekly_make_worklogs(main_pipeline(events, {}));
+        let issues = [];
+        worklogs.forEach(function(worklog) {
+            if (issues.indexOf(worklog.issue) < 0) {
+                issues.push(worklog.issue);
+            }
+        });
+        let pending = [];
+        const push = function(index) {
+            if (index >= pending.length) {
+                console.log("Pushed " + pending.length + " worklogs to Jira" +
+                            " (" + (worklogs.length - pending.length) +
+                            " already pushed)");
+                return;
+            }
+            jira_add_worklog(jira_path, pending[index], function(error) {
+                if (error) {
+                    main_fatal(error);
+                }
+                push(index + 1);
+            });
+        };
+        const preview = function() {
+            const table = {
+                header : [ "issue", "started", "hours", "comment" ],
+                rows : pending.map(function(worklog) {
+                    return [
+                        worklog.issue, worklog.started,
+                        (worklog.seconds / 3600).toFixed(2), worklog.comment
+                    ];
+                }),
+            };
+            process.stdout.write(weekly_format_box(table, {}));
+            if (program.dryRun) {
+                console.log("Dry run: would push " + pending.length +
+                            " worklogs to Jira (" +
+                            (worklogs.length - pending.length) +
+                            " already pushed)");
+                return;
+            }
+            push(0);
+        };
+        const check = function(index) {
+            if (index >= issues.length) {
+                preview();
+                return;
+            }
+            jira_worklogs(jira_path, issues[index], function(error, response) {
+                if (error) {
+                    main_fatal(error);
+                }
+                const comments = (response.worklogs || []).map(function(item) {
+                    return (typeof item.comment === "string") ? item.comment
+                                                              : "";
+                }).join("\n");
+                worklogs.forEach(function(worklog) {
+                    if (worklog.issue === issues[index] &&
+                        comments.indexOf(worklog.marker) < 0) {
+                        pending.push(worklog);
+                    }
+                });
+                check(index + 1);
+            });
+        };
+        check(0);
+    });
+}
+
+// Add to Toggl Track the time entries of the events in the window (see
+// weekly_make_time_entries) using the workspace and the projects in
+// toggl_path, skipping those matching an entry with the same start,
+// duration, and description, or only preview them with --dry-run
+function main_push_toggl() {
+    let config;
+    try {
+        config = JSON.parse(fs.readFileSync(toggl_path, "utf8"));
+    } catch (error) {
+        main_fatal(error.syscall ? error
+                                 : weekly_error("config", "invalid '" +
+                                                              toggl_path +
+                                                              "'"));
+    }
+    if (!config.token || !config.workspace_id) {
+        main_fatal(weekly_error("config", "'" + toggl_path + "' must " +
+                                              "contain token and " +
+                                              "workspace_id",
+                                "See README.md for instructions"));
+    }
+    const window = main_window();
+    const source = main_source();
+    const key = function(entry) {
+        return JSON.stringify([
+            moment(entry.start).toISOString(), entry.duration,
+            entry.description || ""
+        ]);
+    };
+    source.fetch(source.location, window, function(error, events) {
+        if (error) {
+            main_fatal(error);
+        }
+        const entries = weekly_make_time_entries(main_pipeline(events, {}),
+                                                 config.projects || {});
+        toggl_time_entries(toggl_path, window, function(error, response) {
+            if (error) {
+                main_fatal(error);
+            }
+            const existing = (response || []).map(key);
+            const pending = entries.filter(function(entry) {
+                return existing.indexOf(key(entry)) < 0;
+            });
+            const table = {
+                header : [ "start", "hours", "description", "project", "tags" ],
+                rows : pending.map(function(entry) {
+                    return [
+                        moment(entry.start).format("YYYY-MM-DD HH:mm"),
+                        (entry.duration / 3600).toFixed(2), entry.description,
+                        (entry.project_id !== undefined)
+                            ? String(entry.project_id)
+                            : "",
+                        entry.tags.join(" ")
+                    ];
+                }),
+            };
+            process.stdout.write(weekly_format_box(table, {}));
+            const skipped = " (" + (entries.length - pending.length) +
+                            " already pushed)";
+            if (program.dryRun) {
+                console.log("Dry run: would push " + pending.length +
+                            " time entries to Toggl" + skipped);
+                return;
+            }
+            const push = function(index) {
+                if (index >= pending.length) {
+                    console.log("Pushed " + pending.length +
+                                " time entries to Toggl" + skipped);
+                    return;
+                }
+                toggl_add_time_entry(toggl_path, config.workspace_id,
+                                     pending[index], function(error) {
+                    if (error) {
+                        main_fatal(error);
+                    }
+                    push(index + 1);
+                });
+            };
+            push(0);
+        });
+    });
+}
+
+// Print the values of dimension (see weekly_make_seen_table) seen in the
+// events of the window, by default the last 90 days, with their totals,
+// remembering the projects and tags for shell completion
+function main_list_seen(dimension) {
+    const given = program.days !== undefined || program.period ||
+                  program.since !== undefined || program.until !== undefined;
+    const window = given ? main_window() : {
+        start : moment().startOf("day").subtract(89, "days"),
+    };
+    const source = main_source();
+    source.fetch(source.location, window, function(error, events) {
+        if (error) {
+            main_fatal(error);
+        }
+        events = main_pipeline(events, {});
+        main_cache_completion(events);
+        main_print_table(weekly_make_seen_table(events, dimension));
+    });
+}
+
+// Return the command and the arguments opening address in the browser, which
+// is $BROWSER, when set, or the opener of the platform
+function main_opener(address) {
+    if (process.env.BROWSER) {
+        return [ process.env.BROWSER, [ address ] ];
+    }
+    if (process.platform === "darwin") {
+        return [ "open", [ address ] ];
+    }
+    if (process.platform === "win32") {
+        return [ "cmd", [ "/c", "start", "", address.replace(/&/g, "^&") ] ];
+    }
+    return [ "xdg-open", [ address ] ];
+}
+
+// Open address in the browser and call callback when the opener exits
+function main_open_link(address, callback) {
+    const opener = main_opener(address);
+    const hint = "Set BROWSER to the command opening URLs in your browser";
+    const child =
+        child_process.spawn(opener[0], opener[1], {stdio : "ignore"});
+    child.on("error", function(error) {
+        callback(weekly_error("config",
+                              "cannot run '" + opener[0] + "': " +
+                                  error.message,
+                              hint));
+    });
+    child.on("exit", function(code) {
+        if (code !== 0) {
+            callback(weekly_error("config",
+                                  "'" + opener[0] + "' exited with status " +
+                                      code,
+                                  hint));
+            return;
+        }
+        callback();
+    });
+}
+
+// Maximum number of events opened at once with --open
+const main_open_limit = 10;
+
+// Open in the browser the event with the given id within the window or, when
+// id is true, the events matching --search (see --list --columns id)
+function main_open(id) {
+    if (id === true && program.search === undefined) {
+        main_fatal(weekly_error("usage", "--open requires an event id",
+                                "Pass the id or use --search to select " +
+                                    "the events to open"));
+    }
+    const source = main_source();
+    source.fetch(source.location, main_window(), function(error, events) {
+        if (error) {
+            main_fatal(error);
+        }
+        const selected = (id === true)
+                             ? main_pipeline(events, {})
+                             : events.filter(function(evt) {
+                                   return evt.id === id;
+                               });
+        if (selected.length <= 0) {
+            main_fatal(weekly_error(
+                "usage", "no event to open within the window",
+                "Use --period, --since, or --days to select the window " +
+                    "containing the event"));
+        }
+        if (selected.length > main_open_limit) {
+            main_fatal(weekly_error("usage",
+                                    "too many events to open: " +
+                                        selected.length,
+                                    "Refine --search to select at most " +
+                                        main_open_limit + " events"));
+        }
+        const open = function(index) {
+            if (index >= selected.length) {
+                return;
+            }
+            if (!selected[index].link) {
+                main_fatal(weekly_error("usage",
+                                        "event has no link to open: " +
+                                            selected[index].summary,
+                                        "Only Google Calendar events link " +
+                                            "to a page"));
+            }
+            main_open_link(selected[index].link, function(error) {
+                if (error) {
+                    main_fatal(error);
+                }
+                open(index + 1);
+            });
+        };
+        open(0);
+    });
+}
+
+// Query parameters accepted by --serve, with their type, which select
+// events as the options with the same name do
+const main_serve_params = {
+    "activity-regex" : "string",
+    "billable-only" : "boolean",
+    "days" : "integer",
+    "filter" : "string",
+    "include-declined" : "boolean",
+    "max-duration" : "duration",
+    "min-duration" : "duration",
+    "non-billable-only" : "boolean",
+    "percent" : "boolean",
+    "period" : "string",
+    "project" : "list",
+    "project-regex" : "string",
+    "search" : "string",
+    "since" : "string",
+    "tag" : "list",
+    "tag-regex" : "string",
+    "until" : "string",
+};
+
+// Whether a request to the --serve server is being handled
+let main_serving = false;
+
+// Convert the query parameters of a request to the --serve server into the
+// values of the options with the same name, keyed as in program, failing
+// with a usage error for unknown parameters and invalid values. Parameters
+// selecting the window replace all the window options given to --serve.
+function main_serve_options(query) {
+    const converters = {
+        boolean : function(text) { return text !== "false"; },
+        duration : weekly_parse_duration,
+        integer : function(text) { return parseInt(text, 10); },
+        list : main_parse_list,
+        string : function(text) { return text; },
+    };
+    const key = function(name) {
+        return name.replace(/-(\w)/g, function(all, letter) {
+            return letter.toUpperCase();
+        });
+    };
+    let options = {};
+    Object.keys(query).forEach(function(name) {
+        const type = main_serve_params[name];
+        if (!type) {
+            throw weekly_error("usage", "unknown parameter: '" + name + "'",
+                               "Available parameters: " +
+                                   Object.keys(main_serve_params).join(", "));
+        }
+        let result;
+        [].concat(query[name]).forEach(function(text) {
+            result = converters[type](text, result);
+        });
+        if (typeof result === "number" && isNaN(result)) {
+            throw weekly_error("usage", "invalid " + name + ": '" +
+                                            query[name] + "'");
+        }
+        options[key(name)] = result;
+    });
+    if (main_window_options.some(function(name) { return name in query; })) {
+        main_window_options.forEach(function(name) {
+            if (!(name in query)) {
+                options[key(name)] = undefined;
+            }
+        });
+    }
+    return options;
+}
+
+// Call func with the program options temporarily replaced by options, such
+// that fatal errors are thrown (see main_fatal), returning its result
+function main_with_options(options, func) {
+    let saved = {};
+    Object.keys(options).forEach(function(key) {
+        saved[key] = program[key];
+        program[key] = options[key];
+    });
+    main_serving = true;
+    try {
+        return func();
+    } finally {
+        main_serving = false;
+        Object.keys(saved).forEach(function(key) {
+            program[key] = saved[key];
+        });
+    }
+}
+
+// Pages of the --serve server, each building the content type and body of
+// the reply from the selected events, their window, and the options given
+// as query parameters
+const main_serve_pages = {
+    "/" : function(events, window, options) {
+        return [
+            "text/html; charset=utf-8",
+            weekly_format_html_report(weekly_aggregate_events(events), events,
+                                      window, {
+                                          columns : program.columns,
+                                          percent : options.percent,
+                                          projects : main_projects(),
+                                      }),
+        ];
+    },
+    "/api/events" : function(events) {
+        return [
+            "application/json",
+            weekly_format_json_array(weekly_make_events_table(events), {}),
+        ];
+    },
+    "/api/summary" : function(events, window, options) {
+        const stats = weekly_aggregate_events(events);
+        return [
+            "application/json",
+            weekly_format_json_array(
+                weekly_make_table(stats, {percent : options.percent}), {}),
+        ];
+    },
+};
+
+// Reply to a request to the --serve server with the page for the events of
+// source selected by the query parameters, or with an error, formatted as
+// with --json-errors. Requests whose Host header is not among hosts are
+// refused, such that pages of other sites cannot read the reports through
+// DNS rebinding.
+function main_serve_request(source, hosts, request, response) {
+    const parsed = url.parse(request.url, true);
+    const reply = function(status, type, body) {
+        response.writeHead(status, {"Content-Type" : type});
+        response.end(body);
+    };
+    const fail = function(error, status) {
+        if (!error.kind) {
+            // Let main_fatal convert file system errors
+            try {
+                main_with_options({}, function() { main_fatal(error); });
+            } catch (thrown) {
+                error = thrown;
+            }
+        }
+        if (!error.kind) {
+            error = weekly_error("internal", error.message);
+        }
+        reply(status || ((error.kind === "usage") ? 400 : 500),
+              "application/json",
+              JSON.stringify({
+                  code : weekly_error_kinds[error.kind],
+                  message : error.message,
+                  hint : error.hint || null,
+              }) + "\n");
+    };
+    if (hosts.indexOf(request.headers.host) < 0) {
+        fail(weekly_error("usage",
+                          "unexpected host: '" + request.headers.host + "'",
+                          "Use the address given to --bind"),
+             403);
+        return;
+    }
+    const page = main_serve_pages[parsed.pathname];
+    if (request.method !== "GET" || !page) {
+        fail(weekly_error("usage", "not found: '" + parsed.pathname + "'",
+                          "Available pages: " +
+                              Object.keys(main_serve_pages).join(", ")),
+             404);
+        return;
+    }
+    let options;
+    let window;
+    try {
+        options = main_serve_options(parsed.query);
+        window = main_with_options(options, main_window);
+    } catch (error) {
+        fail(error);
+        return;
+    }
+    source.fetch(source.location, window, function(error, events) {
+        if (error) {
+            fail(error);
+            return;
+        }
+        let result;
+        try {
+            result = main_with_options(options, function() {
+                return page(main_pipeline(events, {}), window, options);
+            });
+        } catch (error) {
+            fail(error);
+            return;
+        }
+        reply(200, result[0], result[1]);
+    });
+}
+
+// Return the values of the Host header naming address and port, adding
+// localhost when address is a loopback address
+function main_serve_hosts(address, port) {
+    const hosts = [ address ];
+    if (address === "127.0.0.1" || address === "::1") {
+        hosts.push("localhost");
+    }
+    return hosts.map(function(host) {
+        return ((host.indexOf(":") >= 0) ? "[" + host + "]" : host) + ":" +
+               port;
+    });
+}
+
+// Serve at port on the address given with --bind, by default localhost, a
+// dashboard with the HTML report (at /) and the events (at /api/events) and
+// totals (at /api/summary) as JSON, where query parameters select events as
+// the options with the same name
+function main_serve(port) {
+    if (!(port >= 0 && port < 65536)) {
+        main_fatal(weekly_error("usage", "invalid port"));
     }
-    Object.keys(res.details).forEach(function (key) {
-        res.percentage[key] = (res.details[key] / res.total) * 100.0;
+    const address = program.bind || "127.0.0.1";
+    const source = main_source();
+    let hosts = [];
+    const server = http.createServer(function(request, response) {
+        main_serve_request(source, hosts, request, response);
+    });
+    server.on("error", function(error) {
+        main_fatal(weekly_error("usage", "cannot serve: " + error.message));
+    });
+    server.listen(port, address, function() {
+        hosts = main_serve_hosts(address, server.address().port);
+        console.error("serving on http://" + hosts[0] + "/");
     });
-    return res;
 }
 
-/*
-                 _
- _ __ ___   __ _(_)_ __
-| '_ ` _ \ / _` | | '_ \
-| | | | | | (_| | | | | |
-|_| |_| |_|\__,_|_|_| |_|
-*/
+// Browse the events of a week in the terminal, where keys move to the
+// previous (p or left) and next (n or right) weeks or back to this week
+// (t), filter events by cycling through the projects of the week (f),
+// switch between events and hours by project (a), and quit (q)
+function main_tui() {
+    if (!process.stdin.isTTY || !process.stdout.isTTY) {
+        main_fatal(weekly_error("usage", "--tui requires a terminal"));
+    }
+    const source = main_source();
+    const this_week = weekly_start_of_week(moment(), main_week_start());
+    let start = this_week.clone();
+    let aggregate = false;
+    let project = null;
+    let projects = [];
+    let generation = 0;
+    const render = function() {
+        const window = {
+            start : start.clone(),
+            end : start.clone().add(7, "days"),
+        };
+        const current = ++generation;
+        source.fetch(source.location, window, function(error, events) {
+            if (current !== generation) {
+                return; // the user moved to another week meanwhile
+            }
+            if (error) {
+                main_fatal(error);
+            }
+            events = main_pipeline(events, {});
+            projects = [];
+            events.forEach(function(evt) {
+                const name = weekly_parse_summary(evt.summary).project;
+                if (projects.indexOf(name) < 0) {
+                    projects.push(name);
+                }
+            });
+            projects.sort();
+            const shown = events.filter(function(evt) {
+                return project === null ||
+                       weekly_parse_summary(evt.summary).project === project;
+            });
+            const title = "Week of " + window.start.format("YYYY-MM-DD") +
+                          ((project !== null) ? ", project " + project : "");
+            process.stdout.write(
+                "\x1b[2J\x1b[H" + title + "\n\n" +
+                weekly_format_week(shown, window.start,
+                                   process.stdout.columns || 80, aggregate) +
+                "\np/n: previous/next week, t: this week, f: filter project, " +
+                "a: totals, q: quit\n");
+        });
+    };
+    readline.emitKeypressEvents(process.stdin);
+    process.stdin.setRawMode(true);
+    // Give the terminal back on every exit, including main_fatal ones
+    process.on("exit", function() { process.stdin.setRawMode(false); });
+    process.stdin.on("keypress", function(text, key) {
+        const name = (key && key.name) || text;
+        if (name === "q" || (key && key.ctrl && name === "c")) {
+            process.stdin.setRawMode(false);
+            process.stdin.pause();
+            return;
+        }
+        if (name === "p" || name === "left") {
+            start.subtract(7, "days");
+        } else if (name === "n" || name === "right") {
+            start.add(7, "days");
+        } else if (name === "t") {
+            start = this_week.clone();
+        } else if (name === "a") {
+            aggregate = !aggregate;
+        } else if (name === "f") {
+            const index = projects.indexOf(project);
+            project =
+                (index + 1 < projects.length) ? projects[index + 1] : null;
+        } else {
+            return;
+        }
+        render();
+    });
+    render();
+}
 
-const app_path = "private/app.json";
-const calendar_path = "private/calendar.json";
-const device_path = "private/device.json";
-const doc_url = "https://github.com/bassosimone/weekly#create-privateappjson-using-google-developers-console"
-const tokens_path = "private/tokens.json";
+// Return the dimension selected with --by, by default the project
+function main_dimension() {
+    const dimension = program.by || "project";
+    if (weekly_dimensions.indexOf(dimension) < 0 &&
+        !dimension.startsWith("field:")) {
+        main_fatal(weekly_error("usage",
+                                "unknown dimension: '" + dimension + "'",
+                                "Available dimensions: " +
+                                    weekly_dimensions.join(", ") +
+                                    ", field:<key>"));
+    }
+    return dimension;
+}
 
-// Initiate authentication process by requesting a device code to google
-function main_init() {
-    oauth2_obtain_user_code(app_path, function(error, response) {
+// Return the window preceding window, which is the previous month when
+// querying a month, the previous week when querying the current week, and
+// the same number of days before window otherwise
+function main_previous_window(window) {
+    let count = 1;
+    let unit = "week";
+    if (program.period) {
+        unit = "month";
+    } else if (program.days !== undefined || program.since !== undefined) {
+        const end = window.end || moment().startOf("day").add(1, "day");
+        count = end.diff(window.start, "days");
+        unit = "days";
+    }
+    return {
+        start : window.start.clone().subtract(count, unit),
+        end : window.start.clone(),
+    };
+}
+
+// Compare the hours of events, fetched within window, with the ones of the
+// previous window (see main_previous_window), by the dimension of --by
+function main_diff(source, window, events) {
+    const previous = main_previous_window(window);
+    source.fetch(source.location, previous, function(error, response) {
         if (error) {
-            if (error.code === 'ENOENT' && error.syscall === 'open') {
-                if (error.path === app_path) {
-                    console.error("fatal: missing file: '" + error.path + "'");
-                    console.log("You should create your own app");
-                    console.log("See <" + doc_url + "> for instructions");
-                    process.exit(1);
-                }
-            }
-            throw error;
+            main_fatal(error);
         }
-        json_write_file(device_path, response, function(error) {
-            if (error) {
-                throw error;
+        main_print_table(weekly_make_diff_table(main_pipeline(response, {}),
+                                                events, main_dimension()));
+    });
+}
+
+// Print the report selected on the command line
+function main_report(events, window) {
+    if (program.standup) {
+        main_write_output(weekly_format_standup(events));
+        return;
+    }
+    if (weekly_event_formats[program.format]) {
+        main_write_output(weekly_event_formats[program.format](events));
+        return;
+    }
+    if (program.top !== undefined) {
+        main_print_table(weekly_make_top_table(events, main_dimension(),
+                                               program.top, window));
+        return;
+    }
+    if (program.invoice) {
+        main_invoice(events, window);
+        return;
+    }
+    if (program.aggregate !== undefined || program.totalBy !== undefined) {
+        const total = program.totalBy !== undefined;
+        const period = total ? program.totalBy : program.aggregate;
+        if (!weekly_periods[period]) {
+            main_fatal(weekly_error("usage", "unknown period: '" + period + "'",
+                                    "Available periods: " +
+                                        Object.keys(weekly_periods)
+                                            .join(", ")));
+        }
+        main_print_table(weekly_make_period_table(events, period,
+                                                  main_week_start(), total));
+        return;
+    }
+    if (program.collab) {
+        main_print_table(weekly_make_collab_table(events));
+        return;
+    }
+    if (program.stats) {
+        main_print_table(weekly_make_stats_table(events, window));
+        return;
+    }
+    if (program.budget) {
+        main_budget(events, window);
+        return;
+    }
+    if (program.expenses) {
+        main_print_table(weekly_make_expenses_table(events, program.expenses));
+        return;
+    }
+    if (program.list || program.search !== undefined) {
+        main_print_table(weekly_make_events_table(events),
+                         weekly_events_columns);
+        return;
+    }
+    if (program.template) {
+        main_print_template(main_template_view(events, window));
+        return;
+    }
+    const stats = weekly_aggregate_events(events);
+    if (!program.format) {
+        main_write_output(util.inspect(stats) + "\n");
+        return;
+    }
+    if (program.format === "html") {
+        main_write_output(weekly_format_html_report(stats, events, window, {
+            columns : program.columns,
+            percent : program.percent,
+            projects : main_projects(),
+        }));
+        return;
+    }
+    main_print_table(weekly_make_table(stats, {
+        budgets : main_budgets(window),
+        percent : program.percent,
+        projects : program.billableHours ? main_projects() : undefined,
+    }));
+}
+
+// Call callback with the time zone where times such as 2025-01-15 09:00 are
+// interpreted when creating events, i.e. the one given with --time-zone or,
+// when writing to the google calendar (see main_write_target), the
+// calendar's one, after making it the time zone of weekly, so that events
+// land at the intended times when travelling
+function main_with_time_zone(target, callback) {
+    const use = function(zone) {
+        try {
+            new Intl.DateTimeFormat("en-US", {timeZone : zone});
+        } catch (error) {
+            main_fatal(weekly_error("usage",
+                                    "unknown time zone: '" + zone + "'",
+                                    "Use an IANA time zone such as " +
+                                        "Europe/Rome"));
+        }
+        process.env.TZ = zone;
+        callback(zone);
+    };
+    if (program.timeZone) {
+        use(program.timeZone);
+        return;
+    }
+    if (program.offline || target.file) {
+        callback();
+        return;
+    }
+    calendar_get(tokens_path, calendar_path, function(error, response) {
+        if (error) {
+            main_fatal(error);
+        }
+        if (response.timeZone) {
+            use(response.timeZone);
+            return;
+        }
+        callback();
+    });
+}
+
+// Return the path of the file where the local source stores events
+function main_local_path() {
+    const data_home = process.env.XDG_DATA_HOME ||
+                      path.join(os.homedir(), ".local", "share");
+    return path.join(data_home, "weekly", "events.jsonl");
+}
+
+// Return where option writes events: the google calendar, by default or
+// with --source google, or the file of the local source (or the file
+// selected with --source local:<path>), exiting for any other source
+function main_write_target(option) {
+    const spec = program.source || "google";
+    const index = spec.indexOf(":");
+    const name = (index < 0) ? spec : spec.slice(0, index);
+    if (name === "google") {
+        return {name : name};
+    }
+    if (name !== "local") {
+        main_fatal(weekly_error("usage", option + " only writes to the " +
+                                             "google and local sources",
+                                "Use '--source local:<path>' to write to a " +
+                                    "file"));
+    }
+    return {
+        name : name,
+        file : (index < 0) ? main_local_path() : spec.slice(index + 1),
+    };
+}
+
+// Append events to file, in the format read by the local source
+function main_append_events(file, events) {
+    try {
+        main_mkdir_parents(path.dirname(path.resolve(file)));
+        fs.appendFileSync(file, events.map(function(evt) {
+            return JSON.stringify(evt) + "\n";
+        }).join(""));
+    } catch (error) {
+        main_fatal(weekly_error("config", "cannot write '" + file + "': " +
+                                              error.message));
+    }
+}
+
+// Return the locked months, e.g. because they were already invoiced, which
+// are listed in locks_path, if it exists
+function main_locks() {
+    let locks;
+    try {
+        locks = JSON.parse(fs.readFileSync(locks_path, "utf8"));
+    } catch (error) {
+        if (error.code === 'ENOENT') {
+            return [];
+        }
+        if (error.syscall) {
+            main_fatal(error);
+        }
+        locks = undefined;
+    }
+    const valid = Array.isArray(locks) && locks.every(function(month) {
+        return /^\d{4}-(0[1-9]|1[0-2])$/.test(month);
+    });
+    if (!valid) {
+        main_fatal(weekly_error("config", "invalid '" + locks_path + "'",
+                                "It must be a json list of months such as " +
+                                    "\"2025-01\""));
+    }
+    return locks;
+}
+
+// Add month to the locked months, so that commands writing events refuse
+// to change it, unless --force is used
+function main_lock(month) {
+    main_check_month("month", month);
+    let locks = main_locks();
+    if (locks.indexOf(month) < 0) {
+        locks.push(month);
+        locks.sort();
+    }
+    main_write_file(locks_path, JSON.stringify(locks, undefined, 4) + "\n");
+    console.log("Locked " + month + "; events within it can only be " +
+                "written with --force");
+}
+
+// Return the problems of the events starting within a locked month, which
+// are none with --force
+function main_lock_problems(events) {
+    if (program.force) {
+        return [];
+    }
+    const locks = main_locks();
+    return events.filter(function(evt) {
+        return locks.indexOf(moment(evt.start).format("YYYY-MM")) >= 0;
+    }).map(function(evt) {
+        return "event '" + evt.summary + "' starts in the locked month " +
+               moment(evt.start).format("YYYY-MM");
+    });
+}
+
+// Exit if any of the events starts within a locked month, unless --force
+function main_check_locks(events) {
+    const problems = main_lock_problems(events);
+    if (problems.length > 0) {
+        main_fatal(weekly_error("usage", problems[0],
+                                "Use --force to write it anyway"));
+    }
+}
+
+// Add an event with the given summary to the google calendar or, with
+// --source local[:<path>], to the file of the local source, lasting
+// --duration and starting at --start or, by default, ending now, after
+// letting the user review it with --interactive
+function main_add(summary) {
+    if (!(program.duration > 0)) {
+        main_fatal(weekly_error("usage", "missing or invalid --duration"));
+    }
+    const target = main_write_target("--add");
+    if (program.start &&
+        !moment(program.start, "YYYY-MM-DD HH:mm", true).isValid()) {
+        main_fatal(weekly_error("usage",
+                                "invalid start: '" + program.start + "'",
+                                "The start must be a time such as " +
+                                    "2025-01-15 09:00"));
+    }
+    main_with_time_zone(target, function(zone) {
+        const start = program.start
+                          ? moment(program.start, "YYYY-MM-DD HH:mm", true)
+                          : moment().subtract(program.duration, "minutes");
+        const evt = {
+            summary : summary,
+            start : start.format(),
+            end : start.clone().add(program.duration, "minutes").format(),
+        };
+        const add = function(evt) {
+            main_check_locks([ evt ]);
+            if (target.file) {
+                main_append_events(target.file, [ evt ]);
+                console.log("Added event to '" + target.file + "'");
+                return;
             }
-            console.log("Written device-info at '" + device_path + "'");
-            console.log("Now go to <" + response.verification_url + "> and " +
-                        "authenticate using " + response.user_code);
-            console.log("Then, run 'node index.js --step2'");
+            if (program.offline) {
+                main_journal_append(evt);
+                return;
+            }
+            main_check_conflicts([ evt ], function(events) {
+                main_insert_event(events[0], zone);
+            });
+        };
+        if (program.interactive) {
+            main_confirm_event(evt, add);
+            return;
+        }
+        add(evt);
+    });
+}
+
+// Return the path of the file storing the timer started with --start-timer,
+// which is next to the file of the local source
+function main_timer_path() {
+    return path.join(path.dirname(main_local_path()), "timer.json");
+}
+
+// Return the running timer, with its summary and start, or null if there is
+// no running timer
+function main_timer() {
+    const file = main_timer_path();
+    try {
+        return JSON.parse(fs.readFileSync(file, "utf8"));
+    } catch (error) {
+        if (error.code === 'ENOENT') {
+            return null;
+        }
+        main_fatal(weekly_error("config", "cannot read '" + file + "': " +
+                                              error.message));
+    }
+}
+
+// Start a timer for an event with the given summary, which --stop-timer adds
+// to the calendar, so that time can be tracked like with a punch clock
+function main_start_timer(summary) {
+    main_write_target("--start-timer");
+    const timer = main_timer();
+    if (timer) {
+        main_fatal(weekly_error("usage",
+                                "timer already running: '" + timer.summary +
+                                    "' since " +
+                                    moment(timer.start).format("HH:mm"),
+                                "Use --stop-timer to stop it first"));
+    }
+    const file = main_timer_path();
+    try {
+        main_mkdir_parents(path.dirname(file));
+        fs.writeFileSync(file, JSON.stringify({
+            summary : summary,
+            start : moment().startOf("minute").format(),
+        }) + "\n");
+    } catch (error) {
+        main_fatal(weekly_error("config", "cannot write '" + file + "': " +
+                                              error.message));
+    }
+    console.log("Started timer for '" + summary + "'");
+}
+
+// Stop the running timer, adding an event lasting from its start until now
+// to the google calendar or, with --source local[:<path>], to the file of
+// the local source or, with --offline, to the journal
+function main_stop_timer() {
+    const target = main_write_target("--stop-timer");
+    const timer = main_timer();
+    if (!timer) {
+        main_fatal(weekly_error("usage", "no timer running",
+                                "Use --start-timer to start one"));
+    }
+    const evt = {
+        summary : timer.summary,
+        start : timer.start,
+        end : moment().startOf("minute").format(),
+    };
+    if (!moment(evt.end).isAfter(evt.start)) {
+        evt.end = moment(evt.start).add(1, "minutes").format();
+    }
+    main_check_locks([ evt ]);
+    const done = function(name) {
+        try {
+            fs.unlinkSync(main_timer_path());
+        } catch (error) {
+            main_fatal(weekly_error("config",
+                                    "cannot remove '" + main_timer_path() +
+                                        "': " + error.message));
+        }
+        console.log("Added " + weekly_event_minutes(evt) + " minutes of '" +
+                    evt.summary + "' to " + name);
+    };
+    if (target.file || program.offline) {
+        main_append_events(target.file || main_journal_path(), [ evt ]);
+        done(target.file ? "'" + target.file + "'" : "the journal");
+        return;
+    }
+    main_with_time_zone(target, function(zone) {
+        main_push_events([ evt ], zone, function() {
+            done("the google calendar");
         });
     });
 }
 
-// After user authorized the app with browser, call this function to get
-// a real authentication token to effectively access calendar api
-function main_step2() {
-    oauth2_obtain_tokens(app_path, device_path, function(error, response) {
+// Print what is being tracked now and the hours tracked today (see
+// weekly_format_status), where --offline avoids network access, e.g. when
+// updating a shell prompt
+function main_status() {
+    const timer = main_timer();
+    const today = moment().startOf("day");
+    const window = {start : today, end : today.clone().add(1, "days")};
+    const source = main_source();
+    source.fetch(source.location, window, function(error, events) {
         if (error) {
-            if (error.code === 'ENOENT' && error.syscall === 'open') {
-                console.error("fatal: missing file: '" + error.path + "'");
-                console.log("did you run 'node index.js --init'?");
-                process.exit(1);
-            }
-            throw error;
+            main_fatal(error);
         }
-        json_write_file(tokens_path, response, function(error) {
-            if (error) {
-                throw error;
+        process.stdout.write(
+            weekly_format_status(main_pipeline(events, {}), timer, moment()));
+    });
+}
+
+// Functions reading the files given to --import, by name of --from
+const main_importers = {
+    csv : weekly_import_csv,
+    timewarrior : weekly_import_timewarrior,
+};
+
+// Import the events of the file read according to --from (see
+// main_importers), whose times are interpreted as in main_add, into the
+// google calendar or, with --source local[:<path>], into the file of the
+// local source or, with --offline, into the journal, after printing a
+// preview of them; with --dry-run, only print the preview. No event is
+// imported if any entry is not valid.
+function main_import(import_path) {
+    const target = main_write_target("--import");
+    const importer = main_importers[program.from || "csv"];
+    if (!importer) {
+        main_fatal(weekly_error("usage", "unknown --from: '" + program.from +
+                                             "'",
+                                "Available formats: " +
+                                    Object.keys(main_importers).join(", ")));
+    }
+    let text;
+    try {
+        text = fs.readFileSync(import_path, "utf8");
+    } catch (error) {
+        main_fatal(error);
+    }
+    main_with_time_zone(target, function(zone) {
+        const result = importer(text);
+        if (result.problems.length > 0) {
+            main_fatal(weekly_error("usage", result.problems.join("\n"),
+                                    "Fix '" + import_path +
+                                        "' and try again"));
+        }
+        main_print_table(weekly_make_events_table(result.events),
+                         weekly_events_columns);
+        main_check_locks(result.events);
+        const name = target.file ? "'" + target.file + "'"
+                                 : program.offline ? "the journal"
+                                                   : "the google calendar";
+        if (program.dryRun) {
+            console.log("Dry run: would import " + result.events.length +
+                        " events into " + name);
+            return;
+        }
+        if (target.file || program.offline) {
+            main_append_events(target.file || main_journal_path(),
+                               result.events);
+            console.log("Imported " + result.events.length + " events into " +
+                        name);
+            return;
+        }
+        main_push_events(result.events, zone, function(written) {
+            console.log("Imported " + written + " events into " + name +
+                        " (" + (result.events.length - written) +
+                        " already there)");
+        });
+    });
+}
+
+// Policies for events overlapping those already in the calendar, by name of
+// --on-conflict
+const main_conflict_policies = [ "warn", "shift", "fail" ];
+
+// Check whether events overlap those in the google calendar or each other
+// and warn, move them after the overlapping events, or exit, according to
+// --on-conflict (by default, warn), then call callback with the events to
+// write
+function main_check_conflicts(events, callback) {
+    const policy = program.onConflict || "warn";
+    if (main_conflict_policies.indexOf(policy) < 0) {
+        main_fatal(weekly_error("usage", "unknown conflict policy: '" +
+                                             policy + "'",
+                                "Available policies: " +
+                                    main_conflict_policies.join(", ")));
+    }
+    let window = {start : moment(events[0].start), end : moment(events[0].end)};
+    events.forEach(function(evt) {
+        if (moment(evt.start).isBefore(window.start)) {
+            window.start = moment(evt.start);
+        }
+        if (moment(evt.end).isAfter(window.end)) {
+            window.end = moment(evt.end);
+        }
+    });
+    window.start.subtract(1, "days");
+    window.end.add(1, "days");
+    calendar_events(tokens_path, calendar_path, window,
+                    function(error, response) {
+        if (error) {
+            main_fatal(error);
+        }
+        const existing = weekly_filter_events(response).filter(function(evt) {
+            return evt.start !== undefined;
+        });
+        const result = weekly_resolve_conflicts(events, existing, policy);
+        result.conflicts.forEach(function(conflict) {
+            const format = function(evt) {
+                return "'" + evt.summary + "' (" +
+                       moment(evt.start).format("YYYY-MM-DD HH:mm") + "-" +
+                       moment(evt.end).format("HH:mm") + ")";
+            };
+            const message = format(conflict.event) + " overlaps " +
+                            format(conflict.other);
+            if (policy === "fail") {
+                main_fatal(weekly_error("usage", message,
+                                        "Use --on-conflict shift to move it " +
+                                            "after the overlapping events"));
+            }
+            if (policy === "warn") {
+                console.error("warning: " + message);
             }
-            console.log("Written tokens-info at '" + tokens_path + "'");
-            console.log("Now, run 'node index.js --step3'");
         });
+        callback(result.events);
     });
 }
 
-// Allows use to select which calendar to use
-function main_step3() {
-    calendar_list(tokens_path, function(error, response) {
+// Exit because of error, which occurred when changing the google calendar,
+// telling how to obtain the permission to do so
+function main_write_failed(error) {
+    if (error.kind === "auth") {
+        error.hint = "Try running 'node index.js --refresh --grant events'";
+    } else if (error.status === 403) {
+        error.hint = main_missing_hints[events_tokens_path];
+    }
+    main_fatal(error);
+}
+
+// Insert evt into the google calendar, in the given IANA time zone, if any,
+// using the tokens of the events grant
+function main_insert_event(evt, zone) {
+    let resource = weekly_calendar_resource(evt, zone);
+    resource.id = weekly_event_id(evt);
+    calendar_insert_event(events_tokens_path, calendar_path, resource,
+                          function(error) {
+        if (error && error.status === 409) {
+            console.log("The event is already in the google calendar");
+            return;
+        }
         if (error) {
-            throw error;
+            main_write_failed(error);
         }
-        const calendars = weekly_filter_calendars(response);
-        let rl = readline.createInterface(process.stdin, process.stdout);
-        rl.setPrompt(function() {
-            let result = "\nAvailable calendars:\n";
-            for (let index = 0; index < calendars.length; ++index) {
-                result += "  - id: " + calendars[index].id + "\n";
-                result += "    summary: '" + calendars[index].summary + "'\n";
-            }
-            result += "Which id do you want to use? ";
-            return result;
-        }());
+        console.log("Added event to the google calendar");
+    });
+}
+
+// Print evt and let the user edit its fields (see weekly_edit_event) until
+// they confirm it, calling callback with the confirmed event, so that
+// mistakes are caught before adding it
+function main_confirm_event(evt, callback) {
+    let confirmed = false;
+    const rl = readline.createInterface(process.stdin, process.stdout);
+    const show = function() {
+        const format = function(date) {
+            return moment(date).format("YYYY-MM-DD HH:mm");
+        };
+        const minutes = Math.round(weekly_event_minutes(evt));
+        console.log("\nsummary  " + evt.summary + "\nstart    " +
+                    format(evt.start) + "\nend      " + format(evt.end) +
+                    " (" + Math.floor(minutes / 60) + ":" +
+                    String(minutes % 60).padStart(2, "0") + ")");
+        rl.setPrompt("Add this event? [y/n/field=value] ");
         rl.prompt();
-        rl.on("line", function(line) {
-              line = line.trim();
-              for (let index = 0; index < calendars.length; ++index) {
-                  let cal = calendars[index];
-                  if (line === cal.id) {
-                      rl = null;
-                      json_write_file(calendar_path, cal.id, function(error) {
-                          if (error) {
-                              throw error;
-                          }
-                          console.log("Written calendar-info at '" +
-                                      calendar_path + "'");
-                          console.log("You may now use this app");
-                          process.exit(0);
-                      });
-                      return;
-                  }
-              }
-              console.log("\nError: calendar-id not found: " + line);
-              rl.prompt();
-          }).on("close", function() { process.exit(0); });
+    };
+    rl.on("line", function(line) {
+          line = line.trim();
+          if (line === "y" || line === "yes") {
+              confirmed = true;
+              rl.close();
+              callback(evt);
+              return;
+          }
+          if (line === "n" || line === "no") {
+              rl.close();
+              return;
+          }
+          try {
+              evt = weekly_edit_event(evt, line);
+          } catch (error) {
+              console.log("\nError: " + error.message);
+          }
+          show();
+      }).on("close", function() {
+          if (!confirmed) {
+              console.log("\nEvent not added");
+          }
+      });
+    show();
+}
+
+// Milliseconds to wait between two changes to the calendar, to stay within
+// the rate limit of the Calendar API
+const main_write_interval = 100;
+
+// Return the path of the journal of the events added with --offline, which
+// are added to the google calendar with --flush
+function main_journal_path() {
+    const data_home = process.env.XDG_DATA_HOME ||
+                      path.join(os.homedir(), ".local", "share");
+    return path.join(data_home, "weekly", "journal.jsonl");
+}
+
+// Append evt to the journal of the events to add to the google calendar
+// when back online (see main_flush)
+function main_journal_append(evt) {
+    main_append_events(main_journal_path(), [ evt ]);
+    console.log("Added event to the journal (use --flush when back online)");
+}
+
+// Add to the google calendar the events written to the journal with
+// --offline, checking whether they overlap others (see
+// main_check_conflicts), then empty the journal; the events already in the
+// calendar, e.g. because a previous flush was interrupted, are skipped
+function main_flush() {
+    if (program.offline) {
+        main_fatal(weekly_error("usage", "--flush needs network access",
+                                "Run it without --offline"));
+    }
+    const file = main_journal_path();
+    let events = [];
+    try {
+        events = weekly_parse_journal(fs.readFileSync(file, "utf8"));
+    } catch (error) {
+        if (error.code !== 'ENOENT') {
+            main_fatal(error.syscall
+                           ? error
+                           : weekly_error("config", "invalid '" + file +
+                                                        "': " + error.message));
+        }
+    }
+    if (events.length <= 0) {
+        console.log("Nothing to flush");
+        return;
+    }
+    main_check_locks(events);
+    main_with_time_zone({name : "google"}, function(zone) {
+        main_push_events(events, zone, function(written) {
+            fs.unlinkSync(file);
+            console.log("Flushed " + written + " events to the google " +
+                        "calendar (" + (events.length - written) +
+                        " already there)");
+        });
     });
 }
 
-// Refresh authentication token after it expired
-function main_refresh() {
-    oauth2_refresh(app_path, tokens_path, function (error, response) {
+// Add events to the google calendar, in the given IANA time zone, if any,
+// checking whether they overlap others (see main_check_conflicts), one at a
+// time (see main_run_changes), and call callback with the number of events
+// added, which does not count those already in the calendar
+function main_push_events(events, zone, callback) {
+    main_check_conflicts(events, function(events) {
+        let written = 0;
+        main_run_changes(events.map(function(evt) {
+            return function(callback) {
+                let resource = weekly_calendar_resource(evt, zone);
+                resource.id = weekly_event_id(evt);
+                calendar_insert_event(events_tokens_path, calendar_path,
+                                      resource, function(error) {
+                    if (error && error.status === 409) {
+                        callback();
+                        return;
+                    }
+                    written += (error ? 0 : 1);
+                    callback(error);
+                });
+            };
+        }), function() { callback(written); });
+    });
+}
+
+// Add to the google calendar the events of the local source (or of the file
+// selected with --source local:<path>) in the window, skipping those already
+// added, or only preview them with --dry-run
+function main_push_google() {
+    if (program.offline) {
+        main_fatal(weekly_error("usage", "--push-google needs network access",
+                                "Run it without --offline"));
+    }
+    const target = main_write_target("--push-google");
+    if (!target.file) {
+        main_fatal(weekly_error("usage", "--push-google reads the local source",
+                                "Use '--source local' or " +
+                                    "'--source local:<path>'"));
+    }
+    main_sources.local(target.file, main_window(), function(error, events) {
         if (error) {
-            throw error;
+            main_fatal(error);
         }
-        json_read_file(tokens_path, function (error, tokens_info) {
-            if (error) {
-                throw error;
-            }
-            // Replace expired token with new token:
-            tokens_info.access_token = response.access_token;
-            json_write_file(tokens_path, tokens_info, function (error) {
-                if (error) {
-                    throw error;
-                }
+        main_print_table(weekly_make_events_table(events),
+                         weekly_events_columns);
+        main_check_locks(events);
+        if (program.dryRun) {
+            console.log("Dry run: would push " + events.length +
+                        " events to the google calendar");
+            return;
+        }
+        if (events.length <= 0) {
+            console.log("Nothing to push");
+            return;
+        }
+        main_with_time_zone({name : "google"}, function(zone) {
+            main_push_events(events, zone, function(written) {
+                console.log("Pushed " + written + " events to the google " +
+                            "calendar (" + (events.length - written) +
+                            " already there)");
             });
         });
     });
 }
 
-// Query the calendar and print statistics
-function main_weekly() {
-    calendar_events(tokens_path, calendar_path, function(error, response) {
-        if (error) {
-            if (error.code === 'ENOENT' && error.syscall === 'open') {
-                console.error("fatal: missing file: '" + error.path + "'");
-                console.log("did you run 'node index.js --init'?");
-                process.exit(1);
+// Apply the changes to the google calendar one at a time (see
+// main_write_interval), where each change is a function calling back with
+// the error that occurred, if any, exiting on errors, then call callback
+function main_run_changes(changes, callback) {
+    const run = function(index) {
+        if (index >= changes.length) {
+            callback();
+            return;
+        }
+        changes[index](function(error) {
+            if (error) {
+                main_write_failed(error);
             }
-            if (error.message === 'json-request-unauthorized') {
-                console.error("fatal: you are not authorized");
-                console.log("Try running 'node index.js --refresh'");
-                process.exit(1);
+            setTimeout(function() { run(index + 1); }, main_write_interval);
+        });
+    };
+    run(0);
+}
+
+// Open the events of day (YYYY-MM-DD) in the google calendar in $VISUAL or
+// $EDITOR (see weekly_format_day) and apply the changes made, adding,
+// updating, and deleting events; with --dry-run, only print the changes
+function main_edit_day(day) {
+    if (program.offline) {
+        main_fatal(weekly_error("usage", "--edit-day needs network access",
+                                "Run it without --offline"));
+    }
+    if (!moment(day, "YYYY-MM-DD", true).isValid()) {
+        main_fatal(weekly_error("usage", "invalid day: '" + day + "'",
+                                "The day must be a date such as 2025-01-15"));
+    }
+    if (!program.force && main_locks().indexOf(day.slice(0, 7)) >= 0) {
+        main_fatal(weekly_error("usage",
+                                day + " is in the locked month " +
+                                    day.slice(0, 7),
+                                "Use --force to edit it anyway"));
+    }
+    main_with_time_zone({name : "google"}, function(zone) {
+        const start = moment(day, "YYYY-MM-DD", true);
+        const window = {start : start, end : start.clone().add(1, "days")};
+        calendar_events(tokens_path, calendar_path, window,
+                        function(error, response) {
+            if (error) {
+                main_fatal(error);
             }
-            throw error;
-        }
-        console.log(weekly_aggregate_events(weekly_filter_events(response)));
+            main_edit_events(day, zone, weekly_filter_events(response));
+        });
+    });
+}
+
+// Let the user edit the events of day in an editor and apply the changes to
+// the google calendar, in the given IANA time zone, if any (see
+// main_edit_day), leaving all-day events alone
+function main_edit_events(day, zone, events) {
+    const file =
+        path.join(os.tmpdir(), "weekly-" + day + "-" + process.pid + ".txt");
+    const editor = process.env.VISUAL || process.env.EDITOR || "vi";
+    fs.writeFileSync(file, weekly_format_day(events, day));
+    const child =
+        child_process.spawnSync(editor, [ file ], {stdio : "inherit"});
+    if (child.error || child.status !== 0) {
+        main_fatal(weekly_error("config",
+                                "cannot run '" + editor + "'" +
+                                    (child.error ? ": " + child.error.message
+                                                 : ""),
+                                "Set EDITOR to the command of your text " +
+                                    "editor"));
+    }
+    const parsed = weekly_parse_day(fs.readFileSync(file, "utf8"), day);
+    const diff = weekly_diff_day(events.filter(function(evt) {
+        return evt.start !== undefined;
+    }), parsed.events);
+    const problems = parsed.problems.concat(
+        diff.problems, main_lock_problems(diff.create.concat(diff.update)));
+    if (problems.length > 0) {
+        main_fatal(weekly_error("usage", problems.join("\n"),
+                                "Nothing changed; your edits are in '" +
+                                    file + "'"));
+    }
+    fs.unlinkSync(file);
+    const summary = diff.create.length + " added, " + diff.update.length +
+                    " updated, " + diff.remove.length + " deleted";
+    if (program.dryRun) {
+        console.log("Dry run: would change events in the google calendar (" +
+                    summary + ")");
+        return;
+    }
+    main_run_changes(diff.create.map(function(evt) {
+        return function(callback) {
+            calendar_insert_event(events_tokens_path, calendar_path,
+                                  weekly_calendar_resource(evt, zone),
+                                  callback);
+        };
+    }).concat(diff.update.map(function(evt) {
+        return function(callback) {
+            calendar_update_event(events_tokens_path, calendar_path, evt.id,
+                                  weekly_calendar_resource(evt, zone),
+                                  callback);
+        };
+    }), diff.remove.map(function(evt) {
+        return function(callback) {
+            calendar_delete_event(events_tokens_path, calendar_path, evt.id,
+                                  callback);
+        };
+    })), function() {
+        console.log("Changed events in the google calendar (" + summary +
+                    ")");
     });
 }
+// Remove the hidden --deterministic flag from the command line, if present,
+// and, in such case, fix the clock at SOURCE_DATE_EPOCH (or at the epoch)
+// and ignore the terminal size, so that output can be compared across runs
+function main_take_deterministic() {
+    const index = process.argv.indexOf("--deterministic");
+    if (index < 0) {
+        return false;
+    }
+    process.argv.splice(index, 1);
+    const clock = parseInt(process.env.SOURCE_DATE_EPOCH || "0", 10) * 1000;
+    moment.now = function() { return clock; };
+    return true;
+}
+
+let main_deterministic = false;
+
+// Parse the command line and run the selected command
+function main() {
+    main_deterministic = main_take_deterministic();
+    program.version(main_package.version)
+        .option("--activity-regex <regexp>",
+                "Only keep events whose summary matches regexp")
+        .option("--add <summary>", "Add an event with the given summary")
+        .option("--aggregate <period>",
+                "Report hours by daily, weekly, or monthly period")
+        .option("--billable-hours",
+                "Add a billable hours column to statistics")
+        .option("--billable-only", "Only keep billable events")
+        .option("--bind <address>",
+                "Serve with --serve on address instead of localhost")
+        .option("--bugreport", "Print diagnostics to attach to bug reports")
+        .option("--budget",
+                "Report the monthly budgets of private/projects.json")
+        .option("--by <dimension>",
+                "Group --top and --diff by project (default), tag, person, " +
+                    "summary, or field:<key>")
+        .option("--cache",
+                "Save the events fetched from google or caldav, so that " +
+                    "--offline can report them")
+        .option("--calendar-id <id>", "Select calendar id with --step3")
+        .option("--coalesce <gap>",
+                "Merge events with the same summary at most gap apart " +
+                    "(e.g. 5m)",
+                weekly_parse_duration)
+        .option("--collab", "Report hours spent with each @person by project")
+        .option("--color <when>",
+                "Color box output: auto (the default), always, or never")
+        .option("--columns <names>",
+                "Print the comma separated columns in the given order",
+                main_split_list)
+        .option("--completion <shell>",
+                "Print the completion script of bash, fish, or zsh")
+        .option("--concurrency <n>",
+                "Fetch at most n chunks of long windows at a time " +
+                    "(default: 4)",
+                parseInt)
+        .option("--config <command>",
+                "Get, set, unset, or list option defaults (see README)")
+        .option("--csv-header", "Print the header row in csv output")
+        .option("--days <n>", "Query the last n days, including today",
+                parseInt)
+        .option("--debug",
+                "Log http requests and pagination on the standard error")
+        .option("--dedup",
+                "Count only once the events appearing more than once")
+        .option("--diff", "Compare hours with the previous period")
+        .option("--docs <dir>",
+                "Write man page and completion scripts into dir")
+        .option("--doctor", "Check the setup and tell how to fix problems")
+        .option("--dry-run",
+                "Only print the changes --edit-day, --import, --push-google, " +
+                    "--push-jira, or --push-toggl would make")
+        .option("--duration <duration>",
+                "Duration of the event to --add (e.g. 1h30)",
+                weekly_parse_duration)
+        .option("--edit-day <day>",
+                "Edit the events of the given day (e.g. 2025-01-15) in $EDITOR")
+        .option("--email",
+                "Email the output to the recipients in private/smtp.json")
+        .option("--expenses <tags>",
+                "Report events tagged with any of the comma separated tags",
+                main_split_list)
+        .option("--export <path>",
+                "Archive google events into a resumable json file, or " +
+                    "upload them to a url (use with --since)")
+        .option("--field <key=value>",
+                "Only keep events with the given !key=value field (repeatable)",
+                main_parse_field)
+        .option("--field-prefix <prefix>",
+                "Prefix of custom fields in summaries (default: !)")
+        .option("--filter <expression>",
+                "Only keep events matching expression, e.g. 'duration > 1h'")
+        .option("--flush",
+                "Add the events added with --offline to the google calendar")
+        .option("--footnotes",
+                "Tell how many events were excluded from the report and why")
+        .option("--force",
+                "Write events into locked months (see --lock) anyway")
+        .option("--format <name>",
+                "Print statistics as box, chart, csv, html, json, " +
+                    "json-array, markdown, prom, or yaml, or events as " +
+                    "heatmap, org, standup, timeclock, timeline, or " +
+                    "timewarrior")
+        .option("--from <format>",
+                "Read the file given to --import as csv (the default) or " +
+                    "timewarrior json")
+        .option("--grant <name>",
+                "Use --init, --step2, and --refresh to obtain the named " +
+                    "permission (events or sheets)")
+        .option("--import <path>",
+                "Import events from a file into the calendar (see README)")
+        .option("--include-declined",
+                "Report events that were cancelled or that you declined")
+        .option("--init", "Triggers the initialization procedure")
+        .option("--interactive", "Review and edit the event to --add")
+        .option("--invoice", "Print invoice using rates in private/rates.json")
+        .option("--json-errors", "Print fatal errors as json on stderr")
+        .option("--lint", "Check custom fields using private/fields.json")
+        .option("--list", "List events rather than printing statistics")
+        .option("--lock <month>",
+                "Refuse to write events into month (e.g. 2025-01)")
+        .option("--lowercase",
+                "Lowercase project names before applying aliases")
+        .option("--max-events <n>",
+                "Fetch at most n events from google (default: 4096)", parseInt)
+        .option("--max-duration <duration>",
+                "Only keep events lasting at most duration (e.g. 8h)",
+                weekly_parse_duration)
+        .option("--min-duration <duration>",
+                "Only keep events lasting at least duration (e.g. 10m)",
+                weekly_parse_duration)
+        .option("--non-billable-only", "Only keep non-billable events")
+        .option("--offline",
+                "Write the events to --add to a journal, to --flush later, " +
+                    "and report the events saved with --cache")
+        .option("--on-conflict <policy>",
+                "When adding events overlapping others, warn, shift them " +
+                    "after the others, or fail (default: warn)")
+        .option("--open [id]",
+                "Open in the browser the event with the given id or the " +
+                    "events matching --search")
+        .option("--output <path>",
+                "Atomically write the output to path, or upload it to a " +
+                    "gs://, s3://, or webdav(s):// url")
+        .option("--percent", "Add a percentage-of-total column to statistics")
+        .option("--period <month>", "Query the given month (e.g. 2025-01)")
+        .option("--person-prefix <prefix>",
+                "Prefix of persons in summaries (default: @)")
+        .option("--persons",
+                "List the persons of the last 90 days with their totals")
+        .option("--post-webhook <url>",
+                "Post the output to the Slack or Mattermost incoming " +
+                    "webhook at url")
+        .option("--pretty", "Indent json and json-array output")
+        .option("--project <names>",
+                "Only keep events of any of the given projects (repeatable)",
+                main_parse_list)
+        .option("--project-regex <regexp>",
+                "Only keep events whose project matches regexp")
+        .option("--projects",
+                "List the projects of the last 90 days with their totals")
+        .option("--push-google",
+                "Add the events of the local source to the google calendar")
+        .option("--push-jira",
+                "Add worklogs to the Jira issues tagged in summaries " +
+                    "(see README)")
+        .option("--push-toggl",
+                "Add time entries to Toggl Track using the projects in " +
+                    "private/toggl.json")
+        .option("--refresh", "Refresh authentication when not authorized")
+        .option("--rollup",
+                "Report client/project sub-projects as their client")
+        .option("--round <duration>",
+                "Round each event duration to a multiple of duration " +
+                    "(e.g. 15m)",
+                weekly_parse_duration)
+        .option("--round-policy <policy>",
+                "Round durations up, down, or to the nearest (default) " +
+                    "multiple")
+        .option("--search <query>",
+                "List the events whose summary or description contains " +
+                    "all the words of query")
+        .option("--serve <port>",
+                "Serve a dashboard and a json API on localhost at port",
+                parseInt)
+        .option("--sheet <id>",
+                "Append the daily hours to the Google spreadsheet id[:tab]")
+        .option("--since <date>",
+                "Query from the given day (e.g. 2020-01-01) onwards")
+        .option("--source <name>",
+                "Read events from google (the default), caldav[:<path>], " +
+                    "ics:<path>, local[:<path>], or stdin")
+        .option("--split-days",
+                "Split events spanning midnight into one event for each day")
+        .option("--standup",
+                "Summarize yesterday, or the --days days before today, " +
+                    "for standup meetings")
+        .option("--start <time>",
+                "Start of the event to --add (e.g. '2025-01-15 09:00')")
+        .option("--start-timer <summary>",
+                "Start timing an event with the given summary (see " +
+                    "--stop-timer)")
+        .option("--stats", "Print summary statistics for retrospectives")
+        .option("--status",
+                "Print the running timer or event and the hours tracked " +
+                    "today")
+        .option("--step2", "Second of initialization procedure")
+        .option("--step3", "Third step of initialization procedure")
+        .option("--stop-timer",
+                "Stop the timer, adding the timed event to the local source")
+        .option("--strict", "Refuse to report if custom fields are not valid")
+        .option("--tag <tags>",
+                "Only keep events with any of the given #tags (repeatable)",
+                main_parse_list)
+        .option("--tag-prefix <prefix>",
+                "Prefix of tags in summaries (default: #)")
+        .option("--tag-regex <regexp>",
+                "Only keep events with a #tag matching regexp")
+        .option("--tags",
+                "List the tags of the last 90 days with their totals")
+        .option("--team-config <url>",
+                "Merge the team configuration at url into private files")
+        .option("--template <path>",
+                "Render statistics or --invoice using the given template")
+        .option("--time-zone <zone>",
+                "IANA time zone of the times of the events to --add, " +
+                    "--edit-day, and --import (default: the calendar's one)")
+        .option("--timeout <seconds>",
+                "Fail requests inactive for this long, or 0 to wait forever " +
+                    "(default: 30)",
+                parseFloat)
+        .option("--top <n>", "Rank what consumed most of your time", parseInt)
+        .option("--total-by <period>",
+                "Report hours across all summaries by daily, weekly, or " +
+                    "monthly period")
+        .option("--tui", "Browse the events of each week in the terminal")
+        .option("--until <date>",
+                "Query until the given day, included (use with --since)")
+        .option("--verbose", "Tell how many duplicate events were removed")
+        .option("--version-info", "Print version information for bug reports")
+        .option("--warn-events <percent>",
+                "Warn when fetching this percentage of --max-events " +
+                    "(default: 90)",
+                parseFloat)
+        .option("--watch <interval>",
+                "Refresh the output every interval (e.g. 5m) until " +
+                    "interrupted",
+                weekly_parse_duration)
+        .option("--webhook-template <json>",
+                "Post this JSON payload with --post-webhook, where " +
+                    "{{text}} is the output (see README)")
+        .option("--week-start <day>",
+                "Start weeks on mon (the default) or sun")
+        .parse(main_apply_config(process.argv));
+
+    main_set_sigils();
+    main_set_timeout();
+
+    if (program.debug) {
+        json_set_logger(function(record) {
+            console.error("debug: " + JSON.stringify(record));
+        });
+    }
+
+    if (program.versionInfo) {
+        main_version_info();
+    } else if (program.bugreport) {
+        main_bugreport();
+    } else if (program.doctor) {
+        main_doctor();
+    } else if (program.config) {
+        main_config_command(program.config);
+    } else if (program.completion) {
+        main_completion(program.completion);
+    } else if (program.docs) {
+        main_docs(program.docs);
+    } else if (program.lock) {
+        main_lock(program.lock);
+    } else if (program.teamConfig) {
+        main_team_config(program.teamConfig);
+    } else if (program.init) {
+        main_init();
+    } else if (program.step2) {
+        main_step2();
+    } else if (program.step3) {
+        main_step3();
+    } else if (program.refresh) {
+        main_refresh();
+    } else if (program.flush) {
+        main_flush();
+    } else if (program.pushGoogle) {
+        main_push_google();
+    } else if (program.export) {
+        main_export(program.export);
+    } else if (program.sheet) {
+        main_sheet(program.sheet);
+    } else if (program.pushJira) {
+        main_push_jira();
+    } else if (program.pushToggl) {
+        main_push_toggl();
+    } else if (program.projects) {
+        main_list_seen("project");
+    } else if (program.tags) {
+        main_list_seen("tag");
+    } else if (program.persons) {
+        main_list_seen("person");
+    } else if (program.open !== undefined) {
+        main_open(program.open);
+    } else if (program.add !== undefined) {
+        main_add(program.add);
+    } else if (program.startTimer !== undefined) {
+        main_start_timer(program.startTimer);
+    } else if (program.stopTimer) {
+        main_stop_timer();
+    } else if (program.status) {
+        main_status();
+    } else if (program.import) {
+        main_import(program.import);
+    } else if (program.editDay !== undefined) {
+        main_edit_day(program.editDay);
+    } else if (program.serve !== undefined) {
+        main_serve(program.serve);
+    } else if (program.tui) {
+        main_tui();
+    } else if (program.watch !== undefined) {
+        main_watch(program.watch);
+    } else {
+        main_weekly();
+    }
+}
 
-program.version("1.0.0")
-    .option("--init", "Triggers the initialization procedure")
-    .option("--refresh", "Refresh authentication when not authorized")
-    .option("--step2", "Second of initialization procedure")
-    .option("--step3", "Third step of initialization procedure")
-    .parse(process.argv);
+// The functions that do not depend on the command line are exported, so
+// that other programs can query calendars and produce reports
+module.exports = {
+    json_set_logger : json_set_logger,
+    json_set_timeout : json_set_timeout,
+    oauth2_obtain_user_code : oauth2_obtain_user_code,
+    oauth2_obtain_tokens : oauth2_obtain_tokens,
+    oauth2_refresh : oauth2_refresh,
+    calendar_list : calendar_list,
+    calendar_events : calendar_events,
+    calendar_get : calendar_get,
+    calendar_insert_event : calendar_insert_event,
+    calendar_update_event : calendar_update_event,
+    calendar_delete_event : calendar_delete_event,
+    weekly_error : weekly_error,
+    weekly_error_kinds : weekly_error_kinds,
+    weekly_join_errors : weekly_join_errors,
+    weekly_filter_calendars : weekly_filter_calendars,
+    weekly_filter_events : weekly_filter_events,
+    weekly_event_key : weekly_event_key,
+    weekly_event_minutes : weekly_event_minutes,
+    weekly_import_csv : weekly_import_csv,
+    weekly_import_timewarrior : weekly_import_timewarrior,
+    weekly_event_id : weekly_event_id,
+    weekly_parse_journal : weekly_parse_journal,
+    weekly_parse_raw_events : weekly_parse_raw_events,
+    weekly_calendar_resource : weekly_calendar_resource,
+    weekly_event_minutes : weekly_event_minutes,
+    weekly_edit_event : weekly_edit_event,
+    weekly_resolve_conflicts : weekly_resolve_conflicts,
+    weekly_format_day : weekly_format_day,
+    weekly_parse_day : weekly_parse_day,
+    weekly_diff_day : weekly_diff_day,
+    weekly_compare_events : weekly_compare_events,
+    weekly_split_window : weekly_split_window,
+    weekly_parse_duration : weekly_parse_duration,
+    weekly_parse_summary : weekly_parse_summary,
+    weekly_set_sigils : weekly_set_sigils,
+    weekly_check_fields : weekly_check_fields,
+    weekly_is_ignored : weekly_is_ignored,
+    weekly_is_declined : weekly_is_declined,
+    weekly_is_billable : weekly_is_billable,
+    weekly_alias_event : weekly_alias_event,
+    weekly_rollup_event : weekly_rollup_event,
+    weekly_match_fields : weekly_match_fields,
+    weekly_match_any : weekly_match_any,
+    weekly_match_regexp : weekly_match_regexp,
+    weekly_parse_filter : weekly_parse_filter,
+    weekly_eval_filter : weekly_eval_filter,
+    weekly_search_event : weekly_search_event,
+    weekly_round_event : weekly_round_event,
+    weekly_run_stages : weekly_run_stages,
+    weekly_split_days : weekly_split_days,
+    weekly_coalesce_events : weekly_coalesce_events,
+    weekly_format_footnotes : weekly_format_footnotes,
+    weekly_format_standup : weekly_format_standup,
+    weekly_format_status : weekly_format_status,
+    weekly_format_week : weekly_format_week,
+    weekly_s3_headers : weekly_s3_headers,
+    weekly_aggregate_events : weekly_aggregate_events,
+    weekly_make_table : weekly_make_table,
+    weekly_make_events_table : weekly_make_events_table,
+    weekly_select_columns : weekly_select_columns,
+    weekly_make_collab_table : weekly_make_collab_table,
+    weekly_make_projects_table : weekly_make_projects_table,
+    weekly_make_seen_table : weekly_make_seen_table,
+    weekly_make_invoice : weekly_make_invoice,
+    weekly_make_invoice_table : weekly_make_invoice_table,
+    weekly_make_top_table : weekly_make_top_table,
+    weekly_make_stats_table : weekly_make_stats_table,
+    weekly_make_diff_table : weekly_make_diff_table,
+    weekly_budget_hours : weekly_budget_hours,
+    weekly_make_budget_table : weekly_make_budget_table,
+    weekly_make_period_table : weekly_make_period_table,
+    weekly_start_of_week : weekly_start_of_week,
+    weekly_make_expenses_table : weekly_make_expenses_table,
+    weekly_parse_template : weekly_parse_template,
+    weekly_make_payload : weekly_make_payload,
+    weekly_make_email : weekly_make_email,
+    weekly_make_worklogs : weekly_make_worklogs,
+    weekly_make_time_entries : weekly_make_time_entries,
+    weekly_render_template : weekly_render_template,
+    weekly_formats : weekly_formats,
+    weekly_event_formats : weekly_event_formats,
+};
 
-if (program.init) {
-    main_init();
-} else if (program.step2) {
-    main_step2();
-} else if (program.step3) {
-    main_step3();
-} else if (program.refresh) {
-    main_refresh();
-} else {
-    main_weekly();
+if (require.main === module) {
+    main();
 }
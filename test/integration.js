@@ -0,0 +1,3939 @@
+// This software is free software. See AUTHORS and LICENSE for more
+// information on the copying conditions.
+
+// Integration tests running index.js against the fake calendar server.
+
+"use strict";
+
+const assert = require("assert");
+const child_process = require("child_process");
+const crypto = require("crypto");
+const fakecalendar = require("./fakecalendar");
+const fs = require("fs");
+const http = require("http");
+const os = require("os");
+const path = require("path");
+const querystring = require("querystring");
+
+const index_path = path.join(__dirname, "..", "index.js");
+const release_build_path =
+    path.join(__dirname, "..", "tools", "release-build.js");
+
+// Return an ISO timestamp for today at the given hour and minute
+function integration_today(hour, minute) {
+    let date = new Date();
+    date.setHours(hour, minute, 0, 0);
+    return date.toISOString();
+}
+
+// Return today's date in the local time zone as YYYY-MM-DD
+function integration_date() {
+    const date = new Date();
+    const pad = function(value) { return String(value).padStart(2, "0"); };
+    return date.getFullYear() + "-" + pad(date.getMonth() + 1) + "-" +
+           pad(date.getDate());
+}
+
+// Return the IANA time zone of the tests
+function integration_zone() {
+    return Intl.DateTimeFormat().resolvedOptions().timeZone;
+}
+
+// Return a fake event starting and ending today at the given times
+function integration_event(id, summary, start, end) {
+    return {
+        id : id,
+        summary : summary,
+        start : {dateTime : integration_today(start[0], start[1])},
+        end : {dateTime : integration_today(end[0], end[1])},
+    };
+}
+
+// Return the line of a json lines file, such as the one of the local source,
+// containing an event with summary, starting at start (an ISO timestamp) and
+// lasting minutes, to which the fields of extra, if any, are added
+function integration_local_event(summary, start, minutes, extra) {
+    const end = new Date(Date.parse(start) + minutes * 60 * 1000);
+    return JSON.stringify(Object.assign({
+               summary : summary,
+               start : start,
+               end : end.toISOString(),
+           }, extra)) +
+           "\n";
+}
+
+const state = {
+    access_token : "fake-access-token",
+    events_token : "fake-events-token",
+    time_zone : "Europe/Rome",
+    page_size : 2,
+    hung_calendar : "hung@example.com",
+    limited_calendar : "limited@example.com",
+    exhausted_calendar : "exhausted@example.com",
+    caldav : {
+        username : "user",
+        password : "app-password",
+        ics : [
+            "BEGIN:VCALENDAR", "BEGIN:VEVENT", "DTSTART:20250115T090000Z",
+            "DTEND:20250115T100000Z", "SUMMARY:R&D", "END:VEVENT",
+            "END:VCALENDAR", ""
+        ].join("\r\n"),
+    },
+    webdav : {username : "user", password : "dav-password"},
+    s3 : {access_key : "AKIDEXAMPLE"},
+    smtp : {username : "user", password : "smtp-password"},
+    sheets : {
+        "sheet-1" : [],
+        "sheet-2" : [
+            [ "period", "summary", "hours" ],
+            [ "2000-01-03", "nexa", "1.00" ],
+        ],
+    },
+    sheets_token : "fake-sheets-token",
+    jira : {email : "alice@example.com", token : "jira-token"},
+    toggl : {token : "toggl-token", workspace_id : 42},
+    team_config : {
+        projects : {nexa : {color : "blue"}},
+        rates : {currency : "EUR", projects : {nexa : {client : "Team"}}},
+    },
+    calendars : [
+        {id : "work@example.com", summary : "Work"},
+        {id : "home@example.com", summary : "Home"},
+    ],
+    events : {
+        "work@example.com" : [
+            integration_event("e1", "nexa #code", [ 9, 0 ], [ 11, 30 ]),
+            Object.assign(
+                integration_event("e2", "mlab @alice", [ 12, 0 ], [ 13, 0 ]),
+                {
+                  attendees : [
+                      {email : "alice@example.com"},
+                      {email : "room-1@example.com"}
+                  ],
+                  colorId : "5",
+                  creator : {email : "bob@example.com"},
+                }),
+            Object.assign(
+                integration_event("e3", "nexa", [ 14, 0 ], [ 15, 0 ]),
+                {htmlLink : "https://calendar.google.com/event?eid=e3"}),
+            integration_event("e4", "dentist ~ignore", [ 16, 0 ], [ 17, 0 ]),
+        ],
+        "trips@example.com" : [
+            integration_event("t1", "mlab #code", [ 9, 0 ], [ 10, 0 ]),
+            Object.assign(integration_event("t2", "nexa #travel @alice",
+                                            [ 13, 0 ], [ 14, 30 ]),
+                          {location : "Turin"}),
+        ],
+        "fields@example.com" : [
+            integration_event("f1", "nexa !po=4501 !cc=ops", [ 9, 0 ],
+                              [ 10, 0 ]),
+            integration_event("f2", "nexa !po=4501 !cc=dev", [ 10, 0 ],
+                              [ 12, 0 ]),
+            integration_event("f3", "mlab !po=4502", [ 13, 0 ], [ 13, 30 ]),
+            integration_event("f4", "mlab", [ 14, 0 ], [ 15, 0 ]),
+        ],
+        "lint@example.com" : [
+            integration_event("l1", "nexa !po=4501 !cc=ops", [ 9, 0 ],
+                              [ 10, 0 ]),
+            integration_event("l2", "nexa !po=abc !cc=hr", [ 10, 0 ],
+                              [ 12, 0 ]),
+            integration_event("l3", "mlab !pm=x <b>", [ 13, 0 ], [ 13, 30 ]),
+        ],
+        "day@example.com" : [
+            integration_event("d1", "nexa #code", [ 9, 0 ], [ 11, 30 ]),
+            integration_event("d2", "mlab", [ 14, 0 ], [ 15, 0 ]),
+            {
+              id : "d3",
+              summary : "holiday",
+              start : {date : integration_date()},
+              end : {date : integration_date()},
+            },
+        ],
+        "empty@example.com" : [
+            integration_event("z1", "nexa", [ 9, 0 ], [ 9, 0 ]),
+        ],
+        "limited@example.com" : [
+            integration_event("l1", "nexa", [ 9, 0 ], [ 10, 0 ]),
+        ],
+    },
+};
+
+// Create a directory containing the private files of a configured user and
+// the certificate of the fake server, in ca.pem
+function integration_setup() {
+    const dir = fs.mkdtempSync(path.join(os.tmpdir(), "weekly-"));
+    const write = function(name, data) {
+        fs.writeFileSync(path.join(dir, "private", name),
+                         JSON.stringify(data));
+    };
+    fs.mkdirSync(path.join(dir, "private"));
+    write("app.json", {client_id : "id", client_secret : "secret"});
+    write("tokens.json", {
+        access_token : state.access_token,
+        refresh_token : "fake-refresh-token",
+    });
+    write("calendar.json", "work@example.com");
+    fs.writeFileSync(path.join(dir, "ca.pem"), fakecalendar.tls_cert);
+    return dir;
+}
+
+// Write into dir the tokens granting weekly to add events to calendars
+function integration_setup_events(dir) {
+    fs.writeFileSync(path.join(dir, "private", "tokens-events.json"),
+                     JSON.stringify({access_token : state.events_token}));
+}
+
+// Write into dir the tokens granting weekly to edit spreadsheets
+function integration_setup_sheets(dir) {
+    fs.writeFileSync(path.join(dir, "private", "tokens-sheets.json"),
+                     JSON.stringify({access_token : state.sheets_token}));
+}
+
+// Write into dir the configuration of the fake SMTP server, authenticating
+// with the given password
+function integration_setup_smtp(dir, password) {
+    fs.writeFileSync(path.join(dir, "private", "smtp.json"),
+                     JSON.stringify({
+                         host : "127.0.0.1",
+                         port : state.smtp.port,
+                         username : state.smtp.username,
+                         password : password,
+                         from : "me@example.com",
+                         to : [ "pm@example.com", "hr@example.com" ],
+                     }));
+}
+
+// Select the calendar containing two events and an all-day event, write
+// into dir the tokens granting weekly to change them, and write the
+// editor.sh script applying the given sed commands to the edited file
+function integration_setup_day(dir, commands) {
+    integration_setup_events(dir);
+    fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                     JSON.stringify("day@example.com"));
+    fs.writeFileSync(path.join(dir, "editor.sh"),
+                     "#!/bin/sh\nsed -i" + commands.map(function(command) {
+                         return " -e '" + command + "'";
+                     }).join("") + " \"$1\"\n",
+                     {mode : 0o755});
+}
+
+// Select the calendar whose events only last zero minutes
+function integration_setup_empty(dir) {
+    fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                     JSON.stringify("empty@example.com"));
+}
+
+// Select the calendar containing an event tagged #travel in Turin
+function integration_setup_trips(dir) {
+    fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                     JSON.stringify("trips@example.com"));
+}
+
+// Select the calendar containing events with the po and cc custom fields
+// and one event without fields
+function integration_setup_fields(dir) {
+    fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                     JSON.stringify("fields@example.com"));
+}
+
+// Select the calendar containing events with valid custom fields, invalid
+// ones, an unknown one, and HTML markup, and write into dir the schema of
+// the po and cc custom fields
+function integration_setup_lint(dir) {
+    fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                     JSON.stringify("lint@example.com"));
+    fs.writeFileSync(path.join(dir, "private", "fields.json"),
+                     JSON.stringify({
+                         po : {type : "integer"},
+                         cc : {values : [ "ops", "dev" ]},
+                     }));
+}
+
+// Write into dir the rates of nexa and mlab, which has no rate and is
+// therefore not billed
+function integration_setup_rates(dir) {
+    fs.writeFileSync(path.join(dir, "private", "rates.json"),
+                     JSON.stringify({
+                         currency : "EUR",
+                         vat : 22,
+                         projects : {
+                             nexa : {rate : 50, client : "Acme"},
+                             mlab : {client : "Acme"},
+                         },
+                     }));
+}
+
+// Write into dir the events cache containing, for the calendar identified
+// by key, the events of January and February 2025
+function integration_setup_cache(dir, key) {
+    fs.mkdirSync(path.join(dir, "cache", "weekly"), {recursive : true});
+    fs.writeFileSync(
+        path.join(dir, "cache", "weekly", "events.json"),
+        JSON.stringify({
+            entries : [ {
+                key : key,
+                start : "2025-01-01T00:00:00.000Z",
+                end : "2025-03-01T00:00:00.000Z",
+                fetched : "2025-03-01T10:00:00.000Z",
+                events : [
+                    JSON.parse(integration_local_event(
+                        "nexa", "2025-01-10T09:00:00Z", 60)),
+                    JSON.parse(integration_local_event(
+                        "mlab", "2025-02-10T09:00:00Z", 60)),
+                ],
+            } ],
+        }));
+}
+
+// Write into dir the configuration of the caldav calendar of the fake
+// server at address, using the given password
+function integration_setup_caldav(dir, address, password) {
+    fs.writeFileSync(path.join(dir, "private", "caldav.json"),
+                     JSON.stringify({
+                         url : address + "/caldav/",
+                         username : state.caldav.username,
+                         password : password,
+                     }));
+}
+
+// Write the events tagged with a Jira issue, among other events, and the
+// Jira credentials, whose url points to the fake server at urls, into dir
+function integration_setup_jira(dir, urls) {
+    fs.writeFileSync(path.join(dir, "private", "jira.json"),
+                     JSON.stringify(Object.assign(
+                         {url : urls.secure + "/jira/"}, state.jira)));
+    fs.writeFileSync(
+        path.join(dir, "events.jsonl"),
+        integration_local_event("nexa #proj-7", "2025-01-10T09:00:00Z", 90) +
+            integration_local_event("nexa #proj-7 #code",
+                                    "2025-01-10T14:00:00Z", 30) +
+            integration_local_event("mlab #code", "2025-01-10T16:00:00Z",
+                                    60));
+}
+
+// Run index.js with args inside dir, adding env to its environment and
+// writing input to its standard input, and pass the result to callback,
+// where "$server" and "$insecure" in args and env are replaced by the urls
+// of the fake server over https and http, "$host" by the host and port of
+// the former, and where weekly trusts its certificate. When fetch is set,
+// index.js is expected to serve on the url printed on the standard error,
+// which is fetched adding the fetch path, storing the reply into the
+// response field of the result, before killing index.js; fetch is either
+// the path or an object with the path and the request headers, where
+// "$port" is replaced by the port index.js serves on.
+function integration_run(urls, dir, args, env, input, fetch, callback) {
+    const replace = function(value) {
+        return value.replace("$server", urls.secure)
+            .replace("$insecure", urls.plain)
+            .replace("$host", urls.secure.replace("https://", ""));
+    };
+    args = args.map(replace);
+    env = Object.assign({}, env);
+    Object.keys(env).forEach(function(name) {
+        env[name] = replace(env[name]);
+    });
+    const child = child_process.spawn(
+        process.execPath, [ index_path ].concat(args), {
+            cwd : dir,
+            env : Object.assign({}, process.env,
+                                {XDG_CACHE_HOME : path.join(dir, "cache")},
+                                env, {
+                                    NODE_EXTRA_CA_CERTS :
+                                        path.join(dir, "ca.pem"),
+                                    WEEKLY_API_URL : urls.plain,
+                                }),
+        });
+    let result = {stdout : "", stderr : ""};
+    child.stdout.on("data", function(data) { result.stdout += data; });
+    child.stderr.on("data", function(data) {
+        result.stderr += data;
+        const match = /^serving on (http:\/\/\S+)\/$/m.exec(result.stderr);
+        if (!fetch || !match || result.response) {
+            return;
+        }
+        result.response = {body : ""};
+        const request = (typeof fetch === "string") ? {path : fetch} : fetch;
+        let headers = Object.assign({}, request.headers);
+        Object.keys(headers).forEach(function(name) {
+            headers[name] =
+                headers[name].replace("$port", match[1].split(":").pop());
+        });
+        http.get(match[1] + request.path, {headers : headers},
+                 function(response) {
+            result.response.status = response.statusCode;
+            result.response.type = response.headers["content-type"];
+            response.on("data", function(data) {
+                result.response.body += data;
+            });
+            response.on("end", function() { child.kill(); });
+                 });
+    });
+    child.on("close", function(code) {
+        result.code = code;
+        callback(result);
+    });
+    child.stdin.end(input);
+}
+
+const tests = [
+    {
+        name : "statistics as csv",
+        args : [ "--format", "csv" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,1.00\n" +
+                                              "nexa,1.00\n" +
+                                              "nexa #code,2.50\n");
+            const read = function(name) {
+                return fs.readFileSync(
+                    path.join(dir, "cache", "weekly", name), "utf8");
+            };
+            assert.strictEqual(read("projects"), "nexa\nmlab\n");
+            assert.strictEqual(read("tags"), "#code\n");
+        },
+    },
+    {
+        name : "percent adds the share of the total to csv",
+        args : [ "--format", "csv", "--percent" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,1.00,22.22\n" +
+                                              "nexa,1.00,22.22\n" +
+                                              "nexa #code,2.50,55.56\n");
+        },
+    },
+    {
+        name : "percent adds the share of the total to markdown",
+        args : [ "--format", "markdown", "--percent" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "| summary | hours | percent |\n" +
+                                   "| --- | ---: | ---: |\n" +
+                                   "| mlab @alice | 1.00 | 22.22 |\n" +
+                                   "| nexa | 1.00 | 22.22 |\n" +
+                                   "| nexa #code | 2.50 | 55.56 |\n");
+        },
+    },
+    {
+        name : "percent adds the share of the total to box",
+        args : [ "--format", "box", "--percent" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "+-------------+-------+---------+\n" +
+                                   "| summary     | hours | percent |\n" +
+                                   "+-------------+-------+---------+\n" +
+                                   "| mlab @alice |  1.00 |   22.22 |\n" +
+                                   "| nexa        |  1.00 |   22.22 |\n" +
+                                   "| nexa #code  |  2.50 |   55.56 |\n" +
+                                   "+-------------+-------+---------+\n");
+        },
+    },
+    {
+        name : "percent is zero when no time was tracked",
+        setup : integration_setup_empty,
+        args : [ "--format", "csv", "--percent" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa,0.00,0.00\n");
+        },
+    },
+    {
+        name : "unknown formats are refused",
+        args : [ "--format", "xml" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/unknown format: 'xml'/.test(result.stderr),
+                      result.stderr);
+            assert.ok(
+                /^Available formats: box, chart, csv, /.test(result.stdout),
+                result.stdout);
+        },
+    },
+    {
+        name : "expenses list the events with the given tags",
+        setup : integration_setup_trips,
+        args : [ "--expenses", "#travel,#onsite", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               integration_date() + ",13:00,14:30,1.50," +
+                                   "#travel,nexa #travel @alice,Turin\n");
+        },
+    },
+    {
+        name : "expenses are printed as a box by default",
+        setup : integration_setup_trips,
+        args : [ "--expenses", "#code" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const lines = result.stdout.split("\n");
+            assert.strictEqual(lines[1], "| date       | start | end   | " +
+                                             "hours | tag   | summary    " +
+                                             "| location |");
+            assert.strictEqual(lines[3], "| " + integration_date() +
+                                             " | 09:00 | 10:00 |  1.00 " +
+                                             "| #code | mlab #code |" +
+                                             "          |");
+        },
+    },
+    {
+        name : "collab prints hours with each person by project",
+        setup : integration_setup_trips,
+        args : [ "--collab", "--format", "markdown" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "| person | nexa | total |\n" +
+                                                  "| --- | ---: | ---: |\n" +
+                                                  "| @alice | 1.50 | 1.50 |\n");
+        },
+    },
+    {
+        name : "collab is empty without persons",
+        setup : integration_setup_empty,
+        args : [ "--collab", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+        },
+    },
+    {
+        name : "collab uses rounded events",
+        setup : integration_setup_trips,
+        args : [
+            "--collab", "--round", "1h", "--round-policy", "up", "--format",
+            "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "@alice,2.00,2.00\n");
+        },
+    },
+    {
+        name : "round down drops events shorter than the increment",
+        args : [ "--round", "2h", "--round-policy", "down", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,0.00\n" +
+                                                  "nexa,0.00\n" +
+                                                  "nexa #code,2.00\n");
+        },
+    },
+    {
+        name : "round defaults to the nearest multiple",
+        args : [ "--round", "45m", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,0.75\n" +
+                                                  "nexa,0.75\n" +
+                                                  "nexa #code,2.25\n");
+        },
+    },
+    {
+        name : "unknown rounding policies are refused",
+        args : [ "--round", "15m", "--round-policy", "sideways" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/unknown rounding policy: 'sideways'/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/up, down, nearest/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "invalid rounding increments are refused",
+        args : [ "--round", "soon" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/invalid rounding increment/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "invoice does not bill projects without rate",
+        setup : integration_setup_rates,
+        args : [ "--invoice", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "Acme,nexa,3.50,50.00,175.00\n" +
+                                   "Acme,subtotal,,,175.00\n" +
+                                   ",net,,,175.00\n" +
+                                   ",vat 22%,,,38.50\n" +
+                                   ",total EUR,,,213.50\n");
+            assert.strictEqual(result.stderr,
+                               "warning: projects without rate: mlab\n");
+        },
+    },
+    {
+        name : "invoice as json",
+        setup : integration_setup_rates,
+        args : [ "--invoice", "--format", "json" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const invoice = JSON.parse(result.stdout);
+            assert.strictEqual(invoice.total, 213.5);
+            assert.deepStrictEqual(invoice.unbilled, [ "mlab" ]);
+        },
+    },
+    {
+        name : "invoice requires rates",
+        args : [ "--invoice" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/missing file: 'private\/rates.json'/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "invalid periods are refused",
+        args : [ "--period", "2025-13" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/invalid period: '2025-13'/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "top ranks projects by hours",
+        args : [ "--top", "5", "--days", "1", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "1,nexa,3.50,77.78,\u2588\n" +
+                                                  "2,mlab,1.00,22.22,\u2588\n");
+        },
+    },
+    {
+        name : "top ranks tags with --by",
+        args : [
+            "--top", "5", "--by", "tag", "--days", "1", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "1,#code,2.50,55.56,\u2588\n");
+        },
+    },
+    {
+        name : "top table has zero percentages without tracked time",
+        setup : integration_setup_empty,
+        args : [ "--top", "5", "--days", "1", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "1,nexa,0.00,0.00,\u2581\n");
+        },
+    },
+    {
+        name : "unknown top dimensions are refused",
+        args : [ "--top", "5", "--by", "weekday" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/unknown dimension: 'weekday'/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "events must have all the given fields",
+        setup : integration_setup_fields,
+        args : [ "--field", "po=4501", "--field", "cc=ops", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa !po=4501 !cc=ops,1.00\n");
+        },
+    },
+    {
+        name : "events are ranked by the value of a field",
+        setup : integration_setup_fields,
+        args : [
+            "--top", "5", "--by", "field:po", "--days", "1", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "1,4501,3.00,66.67,\u2588\n" +
+                                                  "2,4502,0.50,11.11,\u2588\n");
+        },
+    },
+    {
+        name : "fields without value are refused",
+        args : [ "--field", "po", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/invalid field: 'po'/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/key=value/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "template renders totals",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "report.txt"),
+                             "{{#totals}}{{summary}}={{hours}}\n{{/totals}}" +
+                                 "Total: {{total}}\n");
+        },
+        args : [ "--template", "report.txt" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice=1.00\n" +
+                                                  "nexa=1.00\n" +
+                                                  "nexa #code=2.50\n" +
+                                                  "Total: 4.50\n");
+        },
+    },
+    {
+        name : "template renders invoices",
+        setup : function(dir) {
+            integration_setup_rates(dir);
+            fs.writeFileSync(path.join(dir, "invoice.txt"),
+                             "{{#invoice.clients}}{{client}}: {{subtotal}}" +
+                                 "{{/invoice.clients}}\n{{#invoice.unbilled}}" +
+                                 "{{.}}{{/invoice.unbilled}}\n");
+        },
+        args : [ "--invoice", "--template", "invoice.txt" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "Acme: 175.00\nmlab\n");
+        },
+    },
+    {
+        name : "templates with unclosed sections are refused",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "report.txt"), "{{#totals}}\n");
+        },
+        args : [ "--template", "report.txt" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/invalid template: missing \{\{\/totals\}\}/.test(
+                          result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "html report is a standalone sortable page",
+        setup : integration_setup_lint,
+        args : [ "--format", "html", "--percent" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(result.stdout.startsWith("<!DOCTYPE html>\n"));
+            assert.ok(result.stdout.endsWith("</html>\n"));
+            assert.ok(/<style>/.test(result.stdout), result.stdout);
+            assert.ok(/<p>Total: 3.50 hours in 3 events.<\/p>/.test(
+                          result.stdout),
+                      result.stdout);
+            assert.ok(/<th class="num">percent<\/th>/.test(result.stdout),
+                      result.stdout);
+            assert.ok(/>mlab !pm=x &lt;b&gt;<\/td><td class="num">0.50<\/td>/
+                          .test(result.stdout),
+                      result.stdout);
+            assert.ok(!/<b>/.test(result.stdout), result.stdout);
+            assert.ok(/table\.sortable th/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "expenses as html",
+        setup : integration_setup_trips,
+        args : [ "--expenses", "#travel", "--format", "html" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(result.stdout.startsWith("<!DOCTYPE html>\n"));
+            assert.ok(new RegExp("<td>#travel</td><td style=\"border-left: " +
+                                 "4px solid #[0-9a-f]{6}\">nexa #travel " +
+                                 "@alice</td>")
+                          .test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "lint lists the events with invalid fields",
+        setup : integration_setup_lint,
+        args : [ "--lint" ],
+        check : function(result) {
+            const today = integration_date();
+            assert.strictEqual(result.code, 4, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            assert.strictEqual(
+                result.stderr,
+                today + " 10:00 'nexa !po=abc !cc=hr': field 'po' is " +
+                    "not integer: 'abc'\n" + today +
+                    " 10:00 'nexa !po=abc !cc=hr': field 'cc' " +
+                    "must be one of ops, dev: 'hr'\n" + today +
+                    " 13:00 'mlab !pm=x <b>': unknown field 'pm'\n");
+        },
+    },
+    {
+        name : "lint accepts valid fields",
+        setup : integration_setup_lint,
+        args : [ "--lint", "--field", "cc=ops" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "All custom fields match the schema\n");
+        },
+    },
+    {
+        name : "strict refuses to report invalid fields",
+        setup : integration_setup_lint,
+        args : [ "--strict", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            assert.ok(/^fatal: .*unknown field 'pm'$/m.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "strict reports valid fields",
+        setup : integration_setup_lint,
+        args : [ "--strict", "--field", "po=4501", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa !po=4501 !cc=ops,1.00\n");
+        },
+    },
+    {
+        name : "statistics as yaml",
+        args : [ "--format", "yaml", "--percent" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "- summary: \"mlab @alice\"\n" +
+                                   "  hours: 1.00\n  percent: 22.22\n" +
+                                   "- summary: \"nexa\"\n" +
+                                   "  hours: 1.00\n  percent: 22.22\n" +
+                                   "- summary: \"nexa #code\"\n" +
+                                   "  hours: 2.50\n  percent: 55.56\n");
+        },
+    },
+    {
+        name : "empty yaml tables are empty lists",
+        setup : integration_setup_empty,
+        args : [ "--collab", "--format", "yaml" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "[]\n");
+        },
+    },
+    {
+        name : "statistics as json",
+        args : [ "--format", "json", "--percent" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const lines = result.stdout.trim().split("\n").map(JSON.parse);
+            assert.deepStrictEqual(lines[2], {
+                summary : "nexa #code",
+                hours : 2.5,
+                percent : 55.56,
+            });
+            assert.strictEqual(lines.length, 3);
+        },
+    },
+    {
+        name : "pretty json array",
+        setup : integration_setup_trips,
+        args : [ "--collab", "--format", "json-array", "--pretty" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "[\n    {\n        \"person\": \"@alice\",\n" +
+                                   "        \"nexa\": 1.5,\n" +
+                                   "        \"total\": 1.5\n    }\n]\n");
+        },
+    },
+    {
+        name : "events are added to the google calendar in its time zone",
+        setup : integration_setup_events,
+        env : {TZ : "UTC"},
+        args : [
+            "--add", "mlab #review", "--duration", "45m", "--start",
+            "2025-01-15 09:00"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/google calendar/.test(result.stdout), result.stdout);
+            const item = state.inserted[state.inserted.length - 1];
+            assert.strictEqual(item.calendar, "work@example.com");
+            assert.strictEqual(item.resource.summary, "mlab #review");
+            assert.strictEqual(Date.parse(item.resource.start.dateTime),
+                               Date.parse("2025-01-15T08:00:00Z"));
+            assert.strictEqual(Date.parse(item.resource.end.dateTime),
+                               Date.parse("2025-01-15T08:45:00Z"));
+            assert.strictEqual(item.resource.start.timeZone, "Europe/Rome");
+        },
+    },
+    {
+        name : "interactive add edits the event before adding it",
+        setup : integration_setup_events,
+        env : {TZ : "UTC"},
+        args : [
+            "--add", "mlab", "--duration", "1h", "--start", "2025-01-15 09:00",
+            "--interactive", "--time-zone", "UTC"
+        ],
+        input : "summary=nexa #code\nstart=tomorrow\n" +
+                    "start=2025-01-15 10:00\nduration=30m\ny\n",
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Error: invalid start: 'tomorrow'/.test(result.stdout),
+                      result.stdout);
+            assert.ok(/end +2025-01-15 10:30 \(0:30\)/.test(result.stdout),
+                      result.stdout);
+            const item = state.inserted[state.inserted.length - 1];
+            assert.strictEqual(item.resource.summary, "nexa #code");
+            assert.strictEqual(Date.parse(item.resource.start.dateTime),
+                               Date.parse("2025-01-15T10:00:00Z"));
+            assert.strictEqual(Date.parse(item.resource.end.dateTime),
+                               Date.parse("2025-01-15T10:30:00Z"));
+        },
+    },
+    {
+        name : "interactive add can be declined",
+        setup : function(dir) {
+            integration_setup_events(dir);
+            state.inserted = [];
+        },
+        args : [ "--add", "mlab", "--duration", "1h", "--interactive" ],
+        input : "n\n",
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Event not added/.test(result.stdout), result.stdout);
+            assert.strictEqual(state.inserted.length, 0);
+        },
+    },
+    {
+        name : "adding events requires the events grant",
+        args : [ "--add", "mlab", "--duration", "1h" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/tokens-events\.json/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/--init --grant events/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "init requests granted scopes separately",
+        args : [ "--init", "--grant", "events" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(fs.existsSync(
+                path.join(dir, "private", "device-events.json")));
+            assert.ok(/--step2 --grant events/.test(result.stdout));
+            assert.strictEqual(requests[requests.length - 1].body.scope,
+                               "https://www.googleapis.com/auth/" +
+                                   "calendar.events");
+        },
+    },
+    {
+        name : "list prints the default columns with header",
+        setup : integration_setup_trips,
+        args : [ "--list", "--format", "csv", "--csv-header" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "date,start,end,hours,summary\n" +
+                                   integration_date() +
+                                   ",09:00,10:00,1.00,mlab #code\n" +
+                                   integration_date() +
+                                   ",13:00,14:30,1.50,nexa #travel @alice\n");
+        },
+    },
+    {
+        name : "list prints the selected columns in order",
+        setup : integration_setup_trips,
+        args : [
+            "--list", "--columns", "project,hours,location,tags,persons",
+            "--format", "csv", "--csv-header"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "project,hours,location,tags,persons\n" +
+                                   "mlab,1.00,,#code,\n" +
+                                   "nexa,1.50,Turin,#travel,@alice\n");
+        },
+    },
+    {
+        name : "statistics print the selected columns",
+        setup : integration_setup_trips,
+        args : [ "--columns", "hours,summary", "--format", "markdown" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "| hours | summary |\n| ---: | --- |\n" +
+                                   "| 1.00 | mlab #code |\n" +
+                                   "| 1.50 | nexa #travel @alice |\n");
+        },
+    },
+    {
+        name : "unknown columns are refused",
+        args : [ "--list", "--columns", "start,bogus", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.strictEqual(result.stderr,
+                               "fatal: unknown column 'bogus'\n");
+            assert.ok(/^Available columns: date, start, end, hours,/.test(
+                          result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "edit-day applies the changes to the google calendar",
+        setup : function(dir) {
+            integration_setup_day(dir, [
+                "s/ nexa #code$/ nexa #review/", "/^d2 /d",
+                "$a 17:30-18:00 nexa #new"
+            ]);
+        },
+        env : {EDITOR : "./editor.sh"},
+        args : [
+            "--edit-day", integration_date(), "--time-zone", integration_zone()
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/1 added, 1 updated, 1 deleted/.test(result.stdout),
+                      result.stdout);
+            const patched = state.patched[state.patched.length - 1];
+            assert.strictEqual(patched.id, "d1");
+            assert.strictEqual(patched.resource.summary, "nexa #review");
+            assert.deepStrictEqual(state.deleted, [ "d2" ]);
+            const inserted = state.inserted[state.inserted.length - 1];
+            assert.strictEqual(inserted.resource.summary, "nexa #new");
+            assert.strictEqual(Date.parse(inserted.resource.start.dateTime),
+                               Date.parse(integration_today(17, 30)));
+        },
+    },
+    {
+        name : "edit-day leaves all-day events alone",
+        setup : function(dir) {
+            integration_setup_day(dir, [
+                "s/^# all day, cannot be edited: holiday$/d3 09:00-10:00 x/"
+            ]);
+        },
+        env : {EDITOR : "./editor.sh", TMPDIR : "."},
+        args : [
+            "--edit-day", integration_date(), "--time-zone", integration_zone()
+        ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/unknown id 'd3'/.test(result.stderr), result.stderr);
+            assert.ok(/your edits are in/.test(result.stdout), result.stdout);
+            assert.strictEqual(requests[requests.length - 1].method, "GET");
+        },
+    },
+    {
+        name : "edit-day only prints the changes with dry-run",
+        setup : function(dir) {
+            integration_setup_day(dir, [ "/^d1 /d" ]);
+        },
+        env : {EDITOR : "./editor.sh"},
+        args : [
+            "--edit-day", integration_date(), "--time-zone",
+            integration_zone(), "--dry-run"
+        ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/would change .* \(0 added, 0 updated, 1 deleted\)/
+                          .test(result.stdout),
+                      result.stdout);
+            assert.strictEqual(requests[requests.length - 1].method, "GET");
+        },
+    },
+    {
+        name : "edit-day changes nothing when a line is not valid",
+        setup : function(dir) {
+            integration_setup_day(dir, [ "$a after lunch nexa" ]);
+        },
+        env : {EDITOR : "./editor.sh", TMPDIR : "."},
+        args : [
+            "--edit-day", integration_date(), "--time-zone", integration_zone()
+        ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/line 8: expected/.test(result.stderr), result.stderr);
+            assert.ok(/your edits are in/.test(result.stdout), result.stdout);
+            assert.strictEqual(requests[requests.length - 1].method, "GET");
+        },
+    },
+    {
+        name : "events as timeclock entries",
+        setup : integration_setup_trips,
+        args : [ "--format", "timeclock" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const day = integration_date();
+            assert.strictEqual(result.stdout,
+                               "i " + day + " 09:00:00 mlab  ; code:\n" +
+                                   "o " + day + " 10:00:00\n" +
+                                   "i " + day + " 13:00:00 nexa  ; travel:\n" +
+                                   "o " + day + " 14:30:00\n");
+        },
+    },
+    {
+        name : "events overlapping others are added with a warning",
+        setup : integration_setup_events,
+        args : [
+            "--add", "mlab", "--duration", "45m", "--start",
+            integration_date() + " 10:00", "--time-zone", integration_zone()
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/'mlab' \(\S+ 10:00-10:45\) overlaps 'nexa #code'/
+                          .test(result.stderr),
+                      result.stderr);
+            const item = state.inserted[state.inserted.length - 1];
+            assert.strictEqual(Date.parse(item.resource.start.dateTime),
+                               Date.parse(integration_today(10, 0)));
+        },
+    },
+    {
+        name : "events overlapping others are shifted after all of them",
+        setup : integration_setup_events,
+        args : [
+            "--add", "mlab", "--duration", "45m", "--start",
+            integration_date() + " 10:00", "--on-conflict", "shift",
+            "--time-zone", integration_zone()
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const item = state.inserted[state.inserted.length - 1];
+            assert.strictEqual(Date.parse(item.resource.start.dateTime),
+                               Date.parse(integration_today(13, 0)));
+            assert.strictEqual(Date.parse(item.resource.end.dateTime),
+                               Date.parse(integration_today(13, 45)));
+        },
+    },
+    {
+        name : "events overlapping others are not added on conflict fail",
+        setup : function(dir) {
+            integration_setup_events(dir);
+            state.inserted = [];
+        },
+        args : [
+            "--add", "mlab", "--duration", "45m", "--start",
+            integration_date() + " 10:00", "--on-conflict", "fail",
+            "--time-zone", integration_zone()
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/'mlab' .* overlaps 'nexa #code'/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/--on-conflict shift/.test(result.stdout), result.stdout);
+            assert.strictEqual(state.inserted.length, 0);
+        },
+    },
+    {
+        name : "events as org-mode clock entries",
+        setup : integration_setup_trips,
+        args : [ "--format", "org" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const day = integration_date() + " " +
+                        new Date().toLocaleDateString("en-US",
+                                                      {weekday : "short"});
+            assert.strictEqual(result.stdout,
+                               "* mlab\n  :LOGBOOK:\n  CLOCK: [" + day +
+                                   " 09:00]--[" + day + " 10:00] =>  1:00\n" +
+                                   "  :END:\n* nexa\n  :LOGBOOK:\n" +
+                                   "  CLOCK: [" + day + " 13:00]--[" + day +
+                                   " 14:30] =>  1:30\n  :END:\n");
+        },
+    },
+    {
+        name : "time zone of added events can be overridden",
+        setup : integration_setup_events,
+        args : [
+            "--add", "ooni", "--duration", "1h", "--start", "2025-01-15 09:00",
+            "--time-zone", "America/New_York"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const item = state.inserted[state.inserted.length - 1];
+            assert.strictEqual(Date.parse(item.resource.start.dateTime),
+                               Date.parse("2025-01-15T14:00:00Z"));
+            assert.strictEqual(item.resource.end.timeZone, "America/New_York");
+        },
+    },
+    {
+        name : "unknown time zones are rejected",
+        setup : function(dir) {
+            integration_setup_events(dir);
+            state.inserted = [];
+        },
+        args : [
+            "--add", "ooni", "--duration", "1h", "--time-zone", "Mars/Olympus"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/unknown time zone: 'Mars\/Olympus'/.test(result.stderr),
+                      result.stderr);
+            assert.strictEqual(state.inserted.length, 0);
+        },
+    },
+    {
+        name : "chart scales bars to the longest one",
+        setup : integration_setup_trips,
+        args : [ "--format", "chart" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab #code          " + "\u2588".repeat(36) +
+                                   " 1.00\n" +
+                                   "nexa #travel @alice " +
+                                   "\u2588".repeat(54) + " 1.50\n");
+        },
+    },
+    {
+        name : "chart draws fractions of blocks",
+        args : [ "--format", "chart" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab @alice " + "\u2588".repeat(24) +
+                                   "\u258a 1.00\n" +
+                                   "nexa        " + "\u2588".repeat(24) +
+                                   "\u258a 1.00\n" +
+                                   "nexa #code  " + "\u2588".repeat(62) +
+                                   " 2.50\n");
+        },
+    },
+    {
+        name : "chart needs labels and numbers",
+        args : [ "--format", "chart", "--list", "--columns", "date,summary" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.strictEqual(
+                result.stderr,
+                "fatal: cannot chart table without text and numbers\n");
+        },
+    },
+    {
+        name : "list of events as json",
+        args : [
+            "--list", "--format", "json", "--days", "1", "--columns",
+            "hours,project,tags"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const lines = result.stdout.trim().split("\n").map(JSON.parse);
+            assert.deepStrictEqual(lines[0], {
+                hours : 2.5,
+                project : "nexa",
+                tags : "#code",
+            });
+            assert.strictEqual(lines.length, 3);
+        },
+    },
+    {
+        name : "footnotes tell about excluded events",
+        args : [
+            "--format", "csv", "--days", "1", "--field", "po=7", "--footnotes"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            assert.strictEqual(result.stderr,
+                               "Note: 4 events excluded from this report:\n" +
+                                   "  1 marked ~ignore\n" +
+                                   "  3 not matching --field\n");
+        },
+    },
+    {
+        name : "query window is sent to the server",
+        args : [ "--format", "csv", "--period", "2025-01" ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            const query = requests[requests.length - 1].query;
+            assert.strictEqual(new Date(query.timeMin).getMonth(), 0);
+            assert.strictEqual(new Date(query.timeMax).getMonth(), 1);
+        },
+    },
+    {
+        name : "events are read from ics file",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "cal.ics"), [
+                "BEGIN:VCALENDAR", "BEGIN:VEVENT",
+                "DTSTART:20250115T090000Z", "DURATION:PT1H30M",
+                "SUMMARY:nexa #code\\, review", "END:VEVENT", "BEGIN:VEVENT",
+                "DTSTART:20250215T090000Z", "DTEND:20250215T100000Z",
+                "SUMMARY:later", "END:VEVENT", "END:VCALENDAR", ""
+            ].join("\r\n"));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "ics:cal.ics", "--period", "2025-01", "--list",
+            "--format", "csv", "--columns", "date,hours,summary"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "2025-01-15,1.50,\"nexa #code, review\"\n");
+        },
+    },
+    {
+        name : "events are read from caldav",
+        setup : function(dir, urls) {
+            integration_setup_caldav(dir, urls.secure, state.caldav.password);
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "caldav", "--period", "2025-01", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "R&D,1.00\n");
+        },
+    },
+    {
+        name : "weeks starting on sunday are labeled as iso weeks",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-09T09:00:00Z", 60) +
+                    integration_local_event("nexa", "2025-02-10T09:00:00Z",
+                                            60) +
+                    integration_local_event("nexa", "2025-02-16T09:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--since", "2025-02-01",
+            "--until", "2025-02-28", "--aggregate", "weekly", "--week-start",
+            "sun", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "2025-W07,nexa,2.00\n2025-W08,nexa,1.00\n");
+        },
+    },
+    {
+        name : "daily totals collapse summaries",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-10T09:00:00Z", 90) +
+                    integration_local_event("mlab", "2025-02-10T11:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--total-by", "daily", "--format", "csv", "--csv-header"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "period,hours\n2025-02-10,2.50\n");
+        },
+    },
+    {
+        name : "events spanning midnight are split across days",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-10T22:00:00Z", 1680));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--split-days", "--total-by", "daily", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "2025-02-10,2.00\n" +
+                                                  "2025-02-11,24.00\n" +
+                                                  "2025-02-12,2.00\n");
+        },
+    },
+    {
+        name : "serve answers with totals as json",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #code", "2025-02-10T09:00:00Z",
+                                        90) +
+                    integration_local_event("mlab", "2025-03-10T09:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [ "--source", "local:events.jsonl", "--days", "1", "--serve",
+                 "0" ],
+        fetch : "/api/summary?period=2025-02&tag=code&percent=true",
+        check : function(result) {
+            assert.strictEqual(result.response.status, 200, result.stderr);
+            assert.strictEqual(result.response.type, "application/json");
+            assert.deepStrictEqual(JSON.parse(result.response.body), [
+                {summary : "nexa #code", hours : 1.5, percent : 100}
+            ]);
+        },
+    },
+    {
+        name : "serve reports invalid parameters",
+        args : [ "--source", "local:events.jsonl", "--serve", "0" ],
+        fetch : "/api/events?period=2025",
+        check : function(result) {
+            assert.strictEqual(result.response.status, 400, result.stderr);
+            assert.strictEqual(JSON.parse(result.response.body).code, 2);
+        },
+    },
+    {
+        name : "serve refuses unexpected hosts",
+        args : [ "--source", "local:events.jsonl", "--serve", "0" ],
+        fetch : {path : "/api/events", headers : {host : "evil.example.com"}},
+        check : function(result) {
+            assert.strictEqual(result.response.status, 403, result.stderr);
+            assert.ok(/unexpected host: 'evil.example.com'/.test(
+                          JSON.parse(result.response.body).message),
+                      result.response.body);
+        },
+    },
+    {
+        name : "serve binds the given address and accepts localhost",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-10T09:00:00Z", 60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--bind", "127.0.0.1", "--serve",
+            "0"
+        ],
+        fetch : {
+            path : "/api/summary?period=2025-02",
+            headers : {host : "localhost:$port"},
+        },
+        check : function(result) {
+            assert.ok(/^serving on http:\/\/127\.0\.0\.1:/m.test(result.stderr),
+                      result.stderr);
+            assert.strictEqual(result.response.status, 200, result.stderr);
+            assert.deepStrictEqual(JSON.parse(result.response.body),
+                                   [ {summary : "nexa", hours : 1} ]);
+        },
+    },
+    {
+        name : "tui requires a terminal",
+        args : [ "--tui" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/terminal/.test(result.stderr), result.stderr);
+        },
+    },
+    {
+        name : "watch rejects invalid intervals",
+        args : [ "--source", "local:events.jsonl", "--watch", "soon" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/--watch/.test(result.stderr), result.stderr);
+        },
+    },
+    {
+        name : "standup summarizes yesterday",
+        setup : function(dir) {
+            const yesterday = function(hour) {
+                let date = new Date();
+                date.setDate(date.getDate() - 1);
+                date.setHours(hour, 0, 0, 0);
+                return date.toISOString();
+            };
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                [
+                    {
+                        summary : "mlab #meeting @alice",
+                        start : yesterday(14),
+                        end : yesterday(15),
+                    },
+                    {
+                        summary : "nexa #development @neubot",
+                        start : yesterday(9),
+                        end : yesterday(12),
+                    },
+                    {
+                        summary : "nexa #review",
+                        start : integration_today(0, 0),
+                        end : integration_today(0, 30),
+                    },
+                ].map(function(evt) { return JSON.stringify(evt) + "\n"; })
+                    .join(""));
+        },
+        args : [ "--source", "local:events.jsonl", "--standup" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "- nexa: 3h development with neubot\n" +
+                                   "- mlab: 1h meeting with alice\n");
+        },
+    },
+    {
+        name : "prom format exposes tracked hours",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa \"x\"", "2025-02-10T09:00:00Z",
+                                        90));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--format", "prom"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(
+                result.stdout,
+                "# HELP weekly_tracked_hours The hours column of the " +
+                    "weekly report.\n" +
+                    "# TYPE weekly_tracked_hours gauge\n" +
+                    "weekly_tracked_hours{summary=\"nexa \\\"x\\\"\"} 1.5\n");
+        },
+    },
+    {
+        name : "duration filters drop short and long events",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-10T09:00:00Z", 5) +
+                    integration_local_event("nexa", "2025-02-10T10:00:00Z",
+                                            10) +
+                    integration_local_event("mlab", "2025-02-10T11:00:00Z",
+                                            60) +
+                    integration_local_event("oti", "2025-02-10T12:00:00Z",
+                                            480));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--format", "csv", "--min-duration", "10m", "--max-duration",
+            "4h", "--footnotes"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab,1.00\nnexa,0.17\n");
+            assert.ok(/1 shorter than --min-duration/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/1 longer than --max-duration/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "duplicate events are removed",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-10T09:00:00Z", 60,
+                                        {id : "e1"}) +
+                    integration_local_event("nexa", "2025-02-10T09:00:00Z", 60,
+                                            {id : "e1"}) +
+                    integration_local_event("nexa", "2025-02-10T11:00:00Z", 60,
+                                            {id : "e2"}) +
+                    integration_local_event("mlab", "2025-02-10T13:00:00Z",
+                                            60) +
+                    integration_local_event("mlab", "2025-02-10T13:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--format", "csv", "--dedup", "--verbose"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab,1.00\nnexa,2.00\n");
+            assert.strictEqual(result.stderr,
+                               "verbose: removed 2 duplicate events\n");
+        },
+    },
+    {
+        name : "repeated events are kept without --dedup",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-10T09:00:00Z", 60) +
+                    integration_local_event("nexa", "2025-02-10T09:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--format", "csv", "--verbose"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa,2.00\n");
+            assert.strictEqual(result.stderr, "");
+        },
+    },
+    {
+        name : "adjacent events with the same summary are coalesced",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-02-10T09:00:00Z", 30) +
+                    integration_local_event("nexa", "2025-02-10T09:35:00Z",
+                                            25) +
+                    integration_local_event("nexa", "2025-02-10T11:00:00Z",
+                                            30) +
+                    integration_local_event("mlab", "2025-02-10T10:00:00Z",
+                                            30));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--coalesce", "5m", "--list", "--columns", "start,end,summary",
+            "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "09:00,10:00,nexa\n" +
+                                                  "10:00,10:30,mlab\n" +
+                                                  "11:00,11:30,nexa\n");
+        },
+    },
+    {
+        name : "events of a project are not coalesced across others",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #code", "2025-02-10T09:00:00Z",
+                                        30) +
+                    integration_local_event("nexa", "2025-02-10T09:35:00Z",
+                                            25) +
+                    integration_local_event("mlab", "2025-02-10T10:01:00Z", 3) +
+                    integration_local_event("nexa", "2025-02-10T10:05:00Z",
+                                            25));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--coalesce", "5m", "--list", "--columns", "start,end,summary",
+            "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "09:00,10:00,nexa #code\n" +
+                                                  "10:01,10:04,mlab\n" +
+                                                  "10:05,10:30,nexa\n");
+        },
+    },
+    {
+        name : "stats summarize the period",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #code @alice",
+                                        "2025-02-10T09:00:00Z", 180) +
+                    integration_local_event("mlab", "2025-02-11T09:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--since", "2025-02-10",
+            "--until", "2025-02-14", "--stats", "--format", "json-array"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const stats = {};
+            JSON.parse(result.stdout).forEach(function(row) {
+                stats[row.statistic] = row.value;
+            });
+            assert.deepStrictEqual(stats, {
+                "hours" : "4.00",
+                "hours per tracked day" : "2.00",
+                "busiest weekday" : "Monday",
+                "longest event" : "nexa #code @alice (3.00 hours)",
+                "projects" : "2",
+                "tags" : "1",
+                "persons" : "1",
+                "working days" : "5",
+                "tracked percent" : "10.00",
+            });
+        },
+    },
+    {
+        name : "diff compares with the previous month",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-01-10T09:00:00Z", 180) +
+                    integration_local_event("mlab", "2025-01-13T09:00:00Z",
+                                            60) +
+                    integration_local_event("nexa", "2025-02-10T09:00:00Z",
+                                            60) +
+                    integration_local_event("mlab", "2025-02-11T09:00:00Z",
+                                            120) +
+                    integration_local_event("ooni", "2025-02-12T09:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02", "--diff",
+            "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab,1.00,2.00,1.00,\u25b2\n" +
+                                   "ooni,0.00,1.00,1.00,\u25b2\n" +
+                                   "nexa,3.00,1.00,-2.00,\u25bc\n");
+        },
+    },
+    {
+        name : "budget warns about projects over budget",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "projects.json"),
+                             JSON.stringify({
+                                 nexa : {budget : 2},
+                                 mlab : {budget : 10},
+                             }));
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #code", "2025-02-10T09:00:00Z",
+                                        180));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--budget", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab,10.00,0.00,10.00,0.00\n" +
+                                   "nexa,2.00,3.00,-1.00,150.00\n");
+            assert.ok(/project 'nexa' is over budget/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "repeated project and tag filters match any value",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #code", "2025-02-10T09:00:00Z",
+                                        30) +
+                    integration_local_event("mlab #meeting",
+                                            "2025-02-10T10:00:00Z", 30) +
+                    integration_local_event("ooni #code",
+                                            "2025-02-10T11:00:00Z", 30) +
+                    integration_local_event("nexa #review",
+                                            "2025-02-10T12:00:00Z", 30));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--project", "nexa", "--project", "mlab,ooni", "--tag", "code",
+            "--tag", "#Meeting", "--format", "csv", "--footnotes"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab #meeting,0.50\nnexa #code,0.50\n" +
+                                   "ooni #code,0.50\n");
+            assert.ok(/1 not matching --tag/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "regex filters match projects, tags, and summaries",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("mlab #neubot", "2025-02-10T09:00:00Z",
+                                        30) +
+                    integration_local_event("mlab-ndt #neubot",
+                                            "2025-02-10T10:00:00Z", 30) +
+                    integration_local_event("mlab-ooni review #ooni",
+                                            "2025-02-10T11:00:00Z", 30) +
+                    integration_local_event("nexa #neubot",
+                                            "2025-02-10T12:00:00Z", 30));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--project-regex", "^mlab", "--tag-regex", "^neu|^oo",
+            "--activity-regex", "ndt|review", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab-ndt #neubot,0.50\n" +
+                                   "mlab-ooni review #ooni,0.50\n");
+        },
+    },
+    {
+        name : "aliases and lowercasing merge projects",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "projects.json"),
+                             JSON.stringify({mlab : {aliases : [ "ml" ]}}));
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("Nexa", "2025-02-10T09:00:00Z", 30) +
+                    integration_local_event("nexa", "2025-02-10T10:00:00Z",
+                                            30) +
+                    integration_local_event("ML #ndt !po=7",
+                                            "2025-02-10T11:00:00Z", 30) +
+                    integration_local_event("mlab #ndt !po=7",
+                                            "2025-02-10T12:00:00Z", 30));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--lowercase", "--project", "mlab,nexa", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab #ndt !po=7,1.00\nnexa,1.00\n");
+        },
+    },
+    {
+        name : "sub-projects are rolled up to their client",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("acme/web #code",
+                                        "2025-02-10T09:00:00Z", 30) +
+                    integration_local_event("acme/app #code",
+                                            "2025-02-10T10:00:00Z", 30) +
+                    integration_local_event("nexa", "2025-02-10T11:00:00Z",
+                                            30));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--rollup", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "acme #code,1.00\nnexa,0.50\n");
+        },
+    },
+    {
+        name : "billable markers and projects select billable events",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "projects.json"),
+                             JSON.stringify({acme : {billable : true}}));
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("acme", "2025-02-10T09:00:00Z", 30) +
+                    integration_local_event("acme !internal",
+                                            "2025-02-10T10:00:00Z", 30) +
+                    integration_local_event("nexa !billable",
+                                            "2025-02-10T11:00:00Z", 30) +
+                    integration_local_event("nexa", "2025-02-10T12:00:00Z",
+                                            30));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--billable-only", "--billable-hours", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "acme,0.50,0.50\nnexa !billable,0.50,0.50\n");
+        },
+    },
+    {
+        name : "configured prefixes parse todo.txt summaries",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "config.json"),
+                             JSON.stringify({
+                                 "tag-prefix" : "+",
+                                 "person-prefix" : "@",
+                                 "field-prefix" : "%",
+                             }));
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("write paper +nexa @home %po=7 #1",
+                                        "2025-02-10T09:00:00Z", 60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02", "--list",
+            "--columns", "project,tags,persons", "--field", "po=7",
+            "--tag", "nexa", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "write paper #1,+nexa,@home\n");
+        },
+    },
+    {
+        name : "two characters prefixes are removed from tags and persons",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa ::code @@alice",
+                                        "2025-02-10T09:00:00Z", 60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--tag-prefix", "::", "--person-prefix", "@@", "--tag-regex",
+            "^code$", "--filter", "\"alice\" in persons && \"::code\" in tags",
+            "--format", "timeclock"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "i 2025-02-10 09:00:00 nexa  ; code:\n" +
+                                   "o 2025-02-10 10:00:00\n");
+        },
+    },
+    {
+        name : "prefixes starting other prefixes are refused",
+        args : [ "--tag-prefix", "@@", "--list" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(result.stderr.indexOf("prefixes must be distinct") >= 0,
+                      result.stderr);
+        },
+    },
+    {
+        name : "quoted tags and persons may contain spaces",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #\"code review\" " +
+                                            "@\"John Smith\"",
+                                        "2025-02-10T09:00:00Z", 60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02", "--top",
+            "5", "--by", "tag", "--columns", "tag,hours", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "#code review,1.00\n");
+        },
+    },
+    {
+        name : "filter expressions select events",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #neubot", "2025-02-10T09:00:00Z",
+                                        50) +
+                    integration_local_event("nexa #neubot",
+                                            "2025-02-10T10:00:00Z", 30) +
+                    integration_local_event("nexa #ooni",
+                                            "2025-02-10T11:00:00Z", 50) +
+                    integration_local_event("mlab #neubot",
+                                            "2025-02-10T12:00:00Z", 50));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-02",
+            "--filter",
+            "project == \"nexa\" && (duration > 45m || \"ooni\" in tags) " +
+                "&& !(\"ooni\" in tags)",
+            "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa #neubot,0.83\n");
+        },
+    },
+    {
+        name : "invalid filter tells where the problem is",
+        args : [ "--filter", "project == \"nexa\" &&" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/invalid filter: unexpected end of filter/.test(
+                          result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "json errors carry code, message, and hint",
+        args : [ "--format", "nonexistent", "--json-errors" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            const error = JSON.parse(result.stderr);
+            assert.strictEqual(error.code, 2);
+            assert.strictEqual(error.message, "unknown format: 'nonexistent'");
+            assert.ok(/^Available formats: /.test(error.hint), error.hint);
+            assert.strictEqual(result.stdout, "");
+        },
+    },
+    {
+        name : "events list attendees, color, and creator",
+        args : [
+            "--list", "--format", "csv", "--days", "1", "--columns",
+            "summary,attendees,color,creator", "--filter",
+            "\"room-1@example.com\" in attendees"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "mlab @alice,alice@example.com " +
+                                   "room-1@example.com,5,bob@example.com\n");
+        },
+    },
+    {
+        name : "large windows are fetched one month at a time",
+        args : [
+            "--format", "csv", "--since",
+            (new Date().getFullYear() - 2) + "-01-01", "--until",
+            integration_date()
+        ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout.split("\n").length, 4);
+            const since = new Date(new Date().getFullYear() - 2, 0, 1);
+            const first = requests.map(function(request) {
+                return request.query.timeMin;
+            }).lastIndexOf(since.toISOString());
+            const starts = requests.slice(first).filter(function(request) {
+                return /\/events$/.test(request.path) &&
+                       !request.query.pageToken;
+            }).map(function(request) { return request.query.timeMin; });
+            assert.ok(starts.length > 24, starts.length);
+            starts.forEach(function(start) {
+                assert.strictEqual(new Date(start).getDate(), 1, start);
+            });
+        },
+    },
+    {
+        name : "debug logs requests and pagination",
+        args : [ "--format", "csv", "--days", "1", "--debug" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const records = result.stderr.trim().split("\n").map(
+                function(line) {
+                    assert.ok(/^debug: /.test(line), line);
+                    return JSON.parse(line.slice(7));
+                });
+            assert.strictEqual(records[0].event, "http");
+            assert.strictEqual(records[0].status, 200);
+            assert.deepStrictEqual(records.map(function(record) {
+                return record.decision;
+            }).filter(Boolean), [
+                "fetching next page", "stopping, no more pages"
+            ]);
+        },
+    },
+    {
+        name : "declined and cancelled events are skipped",
+        input : [
+            Object.assign(integration_event("d1", "nexa", [ 9, 0 ], [ 10, 0 ]),
+                          {
+                              attendees : [
+                                  {email : "boss@example.com"},
+                                  {self : true, responseStatus : "declined"}
+                              ],
+                          }),
+            Object.assign(integration_event("d2", "nexa", [ 10, 0 ], [ 11, 0 ]),
+                          {status : "cancelled"}),
+            integration_event("d3", "nexa", [ 11, 0 ], [ 11, 30 ])
+        ].map(function(evt) { return JSON.stringify(evt) + "\n"; }).join(""),
+        args : [
+            "--source", "stdin", "--format", "csv", "--days", "1", "--footnotes"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa,0.50\n");
+            assert.ok(/2 declined or cancelled/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "declined events are included on request",
+        input : JSON.stringify(Object.assign(
+                    integration_event("d1", "nexa", [ 9, 0 ], [ 10, 0 ]),
+                    {status : "cancelled"})) + "\n",
+        args : [
+            "--source", "stdin", "--format", "csv", "--days", "1",
+            "--include-declined"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa,1.00\n");
+        },
+    },
+    {
+        name : "unauthorized requests suggest refreshing",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "tokens.json"),
+                             JSON.stringify({access_token : "expired"}));
+        },
+        args : [ "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 3);
+            assert.ok(/not authorized/.test(result.stderr), result.stderr);
+            assert.ok(/--refresh/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "failures of concurrent chunks are joined",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "tokens.json"),
+                             JSON.stringify({access_token : "expired"}));
+        },
+        args : [
+            "--format", "csv", "--since",
+            (new Date().getFullYear() - 2) + "-01-01", "--until",
+            integration_date(), "--concurrency", "3"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 3);
+            assert.ok(/fatal: 3 requests failed: .*not authorized/.test(
+                          result.stderr),
+                      result.stderr);
+            assert.ok(/--refresh/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "hung requests time out",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                             JSON.stringify("hung@example.com"));
+        },
+        args : [ "--format", "csv", "--timeout", "0.2" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 5);
+            assert.strictEqual(result.stderr,
+                               "fatal: calendar API timed out after 0.2 " +
+                                   "seconds\n");
+            assert.ok(/--timeout/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "missing calendars suggest selecting another one",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                             JSON.stringify("missing@example.com"));
+        },
+        args : [ "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.strictEqual(result.stderr, "fatal: calendar not found\n");
+            assert.ok(/--step3/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "rate limited requests are retried",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                             JSON.stringify("limited@example.com"));
+        },
+        args : [ "--format", "csv", "--debug" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa,1.00\n");
+            assert.ok(/"event":"retry","reason":"rate_limited"/.test(
+                          result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "exceeded quota is reported",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                             JSON.stringify("exhausted@example.com"));
+        },
+        args : [ "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 5);
+            assert.strictEqual(result.stderr, "fatal: quota exceeded\n");
+            assert.ok(/quota/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "fetched events are cached with --cache",
+        args : [ "--format", "csv", "--days", "1", "--cache" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const file = path.join(dir, "cache", "weekly", "events.json");
+            assert.strictEqual(fs.statSync(file).mode & 0o777, 0o600);
+            const cache = JSON.parse(fs.readFileSync(file, "utf8"));
+            assert.strictEqual(cache.entries.length, 1);
+            assert.strictEqual(cache.entries[0].key, "google:work@example.com");
+            assert.strictEqual(cache.entries[0].end, null);
+            assert.strictEqual(cache.entries[0].events.length, 4);
+        },
+    },
+    {
+        name : "fetched events are not cached by default",
+        args : [ "--format", "csv", "--days", "1" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(!fs.existsSync(
+                path.join(dir, "cache", "weekly", "events.json")));
+        },
+    },
+    {
+        name : "offline mode answers from the cache",
+        setup : function(dir) {
+            integration_setup_cache(dir, "google:missing@example.com");
+            // Any request would fail, since the calendar does not exist
+            fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                             JSON.stringify("missing@example.com"));
+        },
+        env : {TZ : "UTC"},
+        args : [ "--offline", "--period", "2025-01", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa,1.00\n");
+        },
+    },
+    {
+        name : "offline mode fails for windows not cached",
+        setup : function(dir) {
+            integration_setup_cache(dir, "google:other@example.com");
+        },
+        env : {TZ : "UTC"},
+        args : [ "--offline", "--period", "2025-01", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.strictEqual(result.stderr,
+                               "fatal: events between 2025-01-01 and " +
+                                   "2025-02-01 are not cached\n");
+            assert.ok(/--cache/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "deterministic mode fixes the clock",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "now.tmpl"), "{{now}} {{start}}");
+        },
+        env : {SOURCE_DATE_EPOCH : "86400", TZ : "UTC"},
+        args : [ "--deterministic", "--template", "now.tmpl", "--days", "2" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "1970-01-02 00:00 1970-01-01");
+        },
+    },
+    {
+        name : "output is written to file",
+        args : [ "--format", "csv", "--days", "1", "--output", "out/x.csv" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            assert.deepStrictEqual(fs.readdirSync(path.join(dir, "out")),
+                                   [ "x.csv" ]);
+            assert.strictEqual(
+                fs.readFileSync(path.join(dir, "out", "x.csv"), "utf8"),
+                "mlab @alice,1.00\nnexa,1.00\nnexa #code,2.50\n");
+        },
+    },
+    {
+        name : "init writes device info",
+        args : [ "--init" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const device = JSON.parse(fs.readFileSync(
+                path.join(dir, "private", "device.json"), "utf8"));
+            assert.strictEqual(device.user_code, "FAKE-CODE");
+            assert.strictEqual(requests[requests.length - 1].body.scope,
+                               "https://www.googleapis.com/auth/" +
+                                   "calendar.readonly");
+        },
+    },
+    {
+        name : "step2 writes tokens info",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "private", "device.json"),
+                JSON.stringify({device_code : "fake-device-code"}));
+        },
+        args : [ "--step2" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const tokens = JSON.parse(fs.readFileSync(
+                path.join(dir, "private", "tokens.json"), "utf8"));
+            assert.strictEqual(tokens.access_token, state.access_token);
+            assert.strictEqual(requests[requests.length - 1].body.code,
+                               "fake-device-code");
+        },
+    },
+    {
+        name : "refresh replaces the access token",
+        setup : function(dir) {
+            integration_setup_events(dir);
+            fs.writeFileSync(path.join(dir, "private", "tokens-events.json"),
+                             JSON.stringify({
+                                 access_token : "expired",
+                                 refresh_token : "fake-refresh-token",
+                             }));
+        },
+        args : [ "--refresh", "--grant", "events" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const tokens = JSON.parse(fs.readFileSync(
+                path.join(dir, "private", "tokens-events.json"), "utf8"));
+            assert.strictEqual(tokens.access_token, state.access_token);
+            assert.strictEqual(tokens.refresh_token, "fake-refresh-token");
+        },
+    },
+    {
+        name : "heatmap shades days by hours tracked",
+        setup : integration_setup_trips,
+        args : [ "--format", "heatmap" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const lines = result.stdout.split("\n");
+            const weekday = (new Date().getDay() + 6) % 7;
+            assert.strictEqual(lines[1 + weekday].slice(4), "\u2588");
+            lines.slice(1, 1 + weekday).forEach(function(line) {
+                assert.strictEqual(line.slice(4), "\u00b7");
+            });
+            assert.ok(/More \(max 2\.50 hours\/day\)/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "heatmap is light without tracked time",
+        setup : integration_setup_empty,
+        args : [ "--format", "heatmap" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const weekday = (new Date().getDay() + 6) % 7;
+            assert.strictEqual(result.stdout.split("\n")[1 + weekday].slice(4),
+                               "\u00b7");
+            assert.ok(!/undefined/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "timeline marks quarters of an hour by project",
+        args : [ "--format", "timeline" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               " ".repeat(11) + "09  10  11  12  13  14\n" +
+                                   integration_date() + " AAAAAAAAAA" +
+                                   "\u00b7\u00b7BBBB\u00b7\u00b7\u00b7\u00b7" +
+                                   "AAAA\n\nA nexa\nB mlab\n");
+        },
+    },
+    {
+        name : "color always colors box rows by project",
+        args : [ "--format", "box", "--color", "always" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const lines = result.stdout.split("\n");
+            assert.ok(/^\| \x1b\[1msummary/.test(lines[1]), lines[1]);
+            assert.ok(/^\| \x1b\[3[1-6]mnexa /.test(lines[4]), lines[4]);
+            assert.strictEqual(lines[4].slice(2, 7), lines[5].slice(2, 7));
+        },
+    },
+    {
+        name : "color is off when not printing to a terminal",
+        args : [ "--format", "box" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(!/\x1b/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "unknown color modes are refused",
+        args : [ "--format", "box", "--color", "sometimes" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/unknown color mode/.test(result.stderr), result.stderr);
+        },
+    },
+    {
+        name : "version info tells which private files exist",
+        args : [ "--version-info" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const info = JSON.parse(result.stdout);
+            assert.strictEqual(info.version, "1.0.0");
+            assert.strictEqual(info.files["private/tokens.json"], true);
+            assert.strictEqual(info.files["private/rates.json"], false);
+            assert.ok(info.formats.indexOf("box") >= 0, result.stdout);
+            assert.ok(!/fake-refresh-token/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "output is uploaded to webdav",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "webdav.json"),
+                             JSON.stringify(state.webdav));
+        },
+        args : [ "--format", "csv", "--output", "webdavs://$host/dav/x.csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(
+                state.uploads["/dav/x.csv"],
+                "mlab @alice,1.00\nnexa,1.00\nnexa #code,2.50\n");
+        },
+    },
+    {
+        name : "webdav credentials are not sent without tls",
+        setup : function(dir) {
+            state.uploads = {};
+            fs.writeFileSync(path.join(dir, "private", "webdav.json"),
+                             JSON.stringify(state.webdav));
+        },
+        args : [ "--format", "csv", "--output", "webdav://$host/dav/y.csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/without TLS/.test(result.stderr), result.stderr);
+            assert.deepStrictEqual(state.uploads, {});
+        },
+    },
+    {
+        name : "output is uploaded to s3",
+        env : {
+            AWS_ACCESS_KEY_ID : state.s3.access_key,
+            AWS_SECRET_ACCESS_KEY : "secret",
+            AWS_ENDPOINT_URL : "$server",
+        },
+        args : [ "--format", "csv", "--output", "s3://bucket/reports/x.csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(
+                state.uploads["/bucket/reports/x.csv"],
+                "mlab @alice,1.00\nnexa,1.00\nnexa #code,2.50\n");
+        },
+    },
+    {
+        name : "exports are uploaded to cloud storage",
+        env : {
+            GS_ACCESS_KEY_ID : state.s3.access_key,
+            GS_SECRET_ACCESS_KEY : "secret",
+            GS_ENDPOINT_URL : "$server",
+        },
+        args : [
+            "--export", "gs://bucket/archive.json", "--since",
+            integration_date(), "--until", integration_date()
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const archive = JSON.parse(state.uploads["/bucket/archive.json"]);
+            assert.strictEqual(archive.complete, true);
+            assert.strictEqual(archive.raw.length, 4);
+        },
+    },
+    {
+        name : "output is posted to a webhook",
+        args : [
+            "--format", "csv", "--days", "1", "--post-webhook",
+            "$server/hooks/x"
+        ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            assert.deepStrictEqual(state.webhooks.pop(), {
+                text : "mlab @alice,1.00\nnexa,1.00\nnexa #code,2.50\n",
+            });
+        },
+    },
+    {
+        name : "webhook payload is configurable",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "config.json"),
+                             JSON.stringify({
+                                 "webhook-template" : JSON.stringify({
+                                     username : "weekly",
+                                     attachments :
+                                         [ {text : "```{{text}}```"} ],
+                                 }),
+                             }));
+        },
+        args : [
+            "--format", "csv", "--days", "1", "--post-webhook",
+            "$server/hooks/x"
+        ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.deepStrictEqual(state.webhooks.pop(), {
+                username : "weekly",
+                attachments : [ {
+                    text : "```mlab @alice,1.00\nnexa,1.00\n" +
+                               "nexa #code,2.50\n```",
+                } ],
+            });
+        },
+    },
+    {
+        name : "statistics without --format are posted to a webhook",
+        args : [ "--days", "1", "--post-webhook", "$server/hooks/x" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            assert.ok(/'nexa #code'/.test(state.webhooks.pop().text));
+        },
+    },
+    {
+        name : "webhooks are only posted over https",
+        args : [
+            "--format", "csv", "--days", "1", "--post-webhook",
+            "$insecure/hooks/x"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/without https/.test(result.stderr), result.stderr);
+            assert.strictEqual(state.webhooks.length, 0);
+        },
+    },
+    {
+        name : "output is emailed",
+        setup : function(dir) {
+            integration_setup_smtp(dir, state.smtp.password);
+        },
+        args : [ "--format", "html", "--days", "1", "--email" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const email = state.emails.pop();
+            assert.strictEqual(email.from, "<me@example.com>");
+            assert.deepStrictEqual(email.to,
+                                   [ "<pm@example.com>", "<hr@example.com>" ]);
+            assert.ok(/^Content-Type: text\/html/m.test(email.data));
+            const body = email.data.split("\r\n\r\n")[1];
+            assert.ok(/nexa #code/.test(Buffer.from(body, "base64")),
+                      email.data);
+        },
+    },
+    {
+        name : "email reports invalid credentials",
+        setup : function(dir) { integration_setup_smtp(dir, "wrong"); },
+        args : [ "--format", "csv", "--days", "1", "--email" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 3, result.stderr);
+            assert.ok(/smtp\.json/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "statistics without --format are emailed",
+        setup : function(dir) {
+            integration_setup_smtp(dir, state.smtp.password);
+        },
+        args : [ "--days", "1", "--email" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+            const email = state.emails.pop();
+            assert.ok(/^Content-Type: text\/plain/m.test(email.data));
+            const body = email.data.split("\r\n\r\n")[1];
+            assert.ok(/'nexa #code'/.test(Buffer.from(body, "base64")),
+                      email.data);
+        },
+    },
+    {
+        name : "email refuses to authenticate without TLS",
+        setup : function(dir) {
+            integration_setup_smtp(dir, state.smtp.password);
+            state.smtp.plain = true;
+        },
+        args : [ "--format", "csv", "--days", "1", "--email" ],
+        check : function(result, requests, dir) {
+            state.smtp.plain = false;
+            assert.strictEqual(result.code, 4, result.stderr);
+            assert.ok(/without TLS/.test(result.stderr), result.stderr);
+            assert.ok(/secure/.test(result.stdout), result.stdout);
+            assert.strictEqual(state.emails.length, 0);
+        },
+    },
+    {
+        name : "sheet gets header and daily hours",
+        setup : integration_setup_sheets,
+        args : [ "--days", "1", "--sheet", "sheet-1" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const date = integration_date();
+            assert.deepStrictEqual(state.sheets["sheet-1"], [
+                [ "period", "summary", "hours" ],
+                [ date, "mlab @alice", "1.00" ],
+                [ date, "nexa", "1.00" ],
+                [ date, "nexa #code", "2.50" ],
+            ]);
+        },
+    },
+    {
+        name : "sheet rows are appended after existing ones",
+        setup : integration_setup_sheets,
+        args : [
+            "--days", "1", "--sheet", "sheet-2:Hours", "--project", "mlab"
+        ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.deepStrictEqual(state.sheets["sheet-2"].slice(2), [
+                [ integration_date(), "mlab @alice", "1.00" ],
+            ]);
+            assert.strictEqual(requests[requests.length - 1].path,
+                               "/v4/spreadsheets/sheet-2/values/" +
+                                   "'Hours'!A%3AC:append");
+        },
+    },
+    {
+        name : "sheet skips days already in the tab",
+        setup : integration_setup_sheets,
+        args : [ "--days", "1", "--sheet", "sheet-1" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Skipped 3 rows/.test(result.stdout), result.stdout);
+            assert.strictEqual(state.sheets["sheet-1"].length, 4);
+            assert.strictEqual(requests[requests.length - 1].method, "GET");
+        },
+    },
+    {
+        name : "sheet requires the sheets grant",
+        args : [ "--days", "1", "--sheet", "sheet-1" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4, result.stderr);
+            assert.ok(/tokens-sheets\.json/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/--init --grant sheets/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "jira dry run previews worklogs",
+        setup : integration_setup_jira,
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--push-jira", "--dry-run"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/PROJ-7/.test(result.stdout), result.stdout);
+            assert.ok(/would push 2 worklogs/.test(result.stdout));
+            assert.deepStrictEqual(state.worklogs, {"PROJ-7" : []});
+        },
+    },
+    {
+        name : "jira worklogs are pushed once",
+        setup : integration_setup_jira,
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--push-jira"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const worklogs = state.worklogs["PROJ-7"];
+            assert.strictEqual(worklogs.length, 2);
+            assert.strictEqual(worklogs[0].timeSpentSeconds, 5400);
+            assert.ok(/^nexa #proj-7 \[weekly:[0-9a-f]{12}\]$/.test(
+                          worklogs[0].comment),
+                      worklogs[0].comment);
+        },
+    },
+    {
+        name : "jira worklogs already pushed are skipped",
+        setup : integration_setup_jira,
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--push-jira"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Pushed 0 worklogs to Jira \(2 already pushed\)/.test(
+                          result.stdout),
+                      result.stdout);
+            assert.strictEqual(state.worklogs["PROJ-7"].length, 2);
+        },
+    },
+    {
+        name : "jira token is only sent over https",
+        setup : function(dir, urls) {
+            state.worklogs = {};
+            integration_setup_jira(dir, urls);
+            fs.writeFileSync(path.join(dir, "private", "jira.json"),
+                             JSON.stringify(Object.assign(
+                                 {url : urls.plain + "/jira/"}, state.jira)));
+        },
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--push-jira"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4, result.stderr);
+            assert.ok(/without https/.test(result.stderr), result.stderr);
+            assert.deepStrictEqual(state.worklogs, {});
+        },
+    },
+    {
+        name : "toggl time entries are pushed once",
+        setup : function(dir, urls) {
+            integration_setup_jira(dir, urls);
+            fs.writeFileSync(path.join(dir, "private", "toggl.json"),
+                             JSON.stringify(Object.assign({
+                                 url : urls.secure,
+                                 projects : {nexa : 7},
+                             }, state.toggl)));
+            state.time_entries.push({
+                start : "2025-01-10T16:00:00+00:00",
+                duration : 3600,
+                description : "mlab",
+            });
+        },
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--push-toggl"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Pushed 2 time entries to Toggl \(1 already pushed\)/
+                          .test(result.stdout),
+                      result.stdout);
+            assert.deepStrictEqual(state.time_entries[1], {
+                created_with : "weekly",
+                description : "nexa",
+                duration : 5400,
+                project_id : 7,
+                start : "2025-01-10T09:00:00.000Z",
+                tags : [ "proj-7" ],
+                workspace_id : 42,
+            });
+            assert.strictEqual(state.time_entries.length, 3);
+        },
+    },
+    {
+        name : "toggl token is only sent over https",
+        setup : function(dir, urls) {
+            state.requests = [];
+            integration_setup_jira(dir, urls);
+            fs.writeFileSync(path.join(dir, "private", "toggl.json"),
+                             JSON.stringify(Object.assign(
+                                 {url : urls.plain}, state.toggl)));
+        },
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--push-toggl"
+        ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 4, result.stderr);
+            assert.ok(/without https/.test(result.stderr), result.stderr);
+            assert.deepStrictEqual(requests, []);
+        },
+    },
+    {
+        name : "configured defaults are overridden by options",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "config.json"),
+                             JSON.stringify({format : "json", days : 1}));
+        },
+        args : [ "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,1.00\n" +
+                                              "nexa,1.00\n" +
+                                              "nexa #code,2.50\n");
+        },
+    },
+    {
+        name : "environment overrides configured defaults",
+        setup : function(dir) {
+            fs.renameSync(path.join(dir, "private"), path.join(dir, "conf"));
+            fs.writeFileSync(path.join(dir, "conf", "config.json"),
+                             JSON.stringify({format : "json", days : 1}));
+        },
+        env : {WEEKLY_CONFIG_DIR : "conf", WEEKLY_FORMAT : "csv"},
+        args : [],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,1.00\n" +
+                                              "nexa,1.00\n" +
+                                              "nexa #code,2.50\n");
+        },
+    },
+    {
+        name : "environment selects the period",
+        env : {WEEKLY_PERIOD : "2020-01"},
+        args : [ "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "");
+        },
+    },
+    {
+        name : "configured period is overridden by the command line window",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "config.json"),
+                             JSON.stringify({period : "2020-01"}));
+        },
+        args : [ "--format", "csv", "--days", "1" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,1.00\n" +
+                                              "nexa,1.00\n" +
+                                              "nexa #code,2.50\n");
+        },
+    },
+    {
+        name : "config set validates and stores defaults",
+        args : [ "--config", "set", "round-policy", "up" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.deepStrictEqual(
+                JSON.parse(fs.readFileSync(
+                    path.join(dir, "private", "config.json"), "utf8")),
+                {"round-policy" : "up"});
+        },
+    },
+    {
+        name : "bug report redacts secrets",
+        args : [ "--bugreport" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/## private\/tokens.json/.test(result.stdout));
+            assert.ok(!/fake-refresh-token/.test(result.stdout));
+            assert.ok(!/work@example.com/.test(result.stdout));
+            assert.ok(!/"secret"/.test(result.stdout));
+            assert.ok(!/"cwd"/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "bug report only keeps fields known to be safe",
+        setup : integration_setup_rates,
+        args : [ "--bugreport" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/"rate": 50/.test(result.stdout), result.stdout);
+            assert.ok(/"currency": "EUR"/.test(result.stdout), result.stdout);
+            assert.ok(result.stdout.indexOf("Acme") < 0, result.stdout);
+        },
+    },
+    {
+        name : "docs are generated from options",
+        args : [ "--docs", "dist" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const page = fs.readFileSync(path.join(dir, "dist", "weekly.1"),
+                                         "utf8");
+            assert.ok(/^\.B \\-\\-days \\fIn\\fR$/m.test(page), page);
+            const script = fs.readFileSync(
+                path.join(dir, "dist", "weekly.bash"), "utf8");
+            assert.ok(/compgen -W "up down nearest"/.test(script), script);
+            assert.ok(/compgen -W "warn shift fail"/.test(script), script);
+        },
+    },
+    {
+        name : "fish completion uses cached tags",
+        args : [ "--completion", "fish" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const regexp = new RegExp("^complete -c weekly -l expenses " +
+                                      "-x -a '\\(cat .*/weekly/tags ", "m");
+            assert.ok(regexp.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "doctor checks setup",
+        args : [ "--doctor" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/^ok - clock is synchronized$/m.test(result.stdout),
+                      result.stdout);
+            assert.ok(!/not ok/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "doctor tells how to fix expired token",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "tokens.json"),
+                             JSON.stringify({access_token : "expired"}));
+        },
+        args : [ "--doctor" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/^not ok - access token is valid: /m.test(result.stdout),
+                      result.stdout);
+            assert.ok(/--refresh/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "missing setup lists the remaining steps",
+        setup : function(dir) {
+            fs.unlinkSync(path.join(dir, "private", "tokens.json"));
+        },
+        args : [],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/not set up yet/.test(result.stderr), result.stderr);
+            assert.ok(/^  1\. run 'node index.js --init'/m.test(result.stdout),
+                      result.stdout);
+            assert.ok(/^  3\. run 'node index.js --step3'/m.test(result.stdout),
+                      result.stdout);
+            assert.ok(/--debug/.test(result.stdout), result.stdout);
+        },
+    },
+    {
+        name : "step3 without terminal fails listing calendars",
+        args : [ "--step3" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/requires a terminal/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/id: work@example\.com\n +summary: 'Work'\n/.test(
+                          result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "step3 selects calendar id",
+        setup : function(dir) {
+            fs.unlinkSync(path.join(dir, "private", "calendar.json"));
+        },
+        args : [ "--step3", "--calendar-id", "work@example.com" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(
+                JSON.parse(fs.readFileSync(
+                    path.join(dir, "private", "calendar.json"), "utf8")),
+                "work@example.com");
+        },
+    },
+    {
+        name : "unknown sources are refused",
+        args : [ "--source", "outlook" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/unknown source: 'outlook'/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/Available sources: google/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "projects configure colors and labels",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "projects.json"),
+                             JSON.stringify({
+                                 nexa : {color : "blue", label : "N"},
+                             }));
+        },
+        args : [ "--format", "box", "--color", "always" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/\| \x1b\[34mN nexa #code/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "projects with unknown colors are refused",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "projects.json"),
+                             JSON.stringify({nexa : {color : "pink"}}));
+        },
+        args : [ "--format", "box" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/unknown color for project 'nexa'/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "projects that are not objects are refused",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "projects.json"),
+                             JSON.stringify({nexa : null}));
+        },
+        args : [ "--format", "box" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/expected an object for project 'nexa'/.test(
+                          result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "ics times are read in the time zone of their TZID",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "cal.ics"), [
+                "BEGIN:VCALENDAR", "BEGIN:VEVENT",
+                "DTSTART;TZID=Europe/Rome:20250115T090000",
+                "DTEND;TZID=Europe/Rome:20250115T103000", "SUMMARY:nexa",
+                "END:VEVENT", "BEGIN:VEVENT",
+                "DTSTART;TZID=\"America/New_York\":20250116T090000",
+                "DURATION:PT1H", "SUMMARY:mlab", "END:VEVENT",
+                "END:VCALENDAR", ""
+            ].join("\r\n"));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "ics:cal.ics", "--period", "2025-01", "--list",
+            "--format", "csv", "--columns", "date,start,end,summary"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "2025-01-15,08:00,09:30,nexa\n" +
+                                   "2025-01-16,14:00,15:00,mlab\n");
+        },
+    },
+    {
+        name : "ics times in unknown time zones are refused",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "cal.ics"), [
+                "BEGIN:VCALENDAR", "BEGIN:VEVENT",
+                "DTSTART;TZID=Mars/Olympus:20250115T090000",
+                "DURATION:PT1H", "SUMMARY:nexa", "END:VEVENT",
+                "END:VCALENDAR", ""
+            ].join("\r\n"));
+        },
+        env : {TZ : "UTC"},
+        args : [ "--source", "ics:cal.ics", "--period", "2025-01" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4, result.stderr);
+            assert.ok(/unknown time zone: 'Mars\/Olympus'/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "team config is merged into private files",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "rates.json"),
+                             JSON.stringify({
+                                 vat : 22,
+                                 projects : {nexa : {rate : 50}},
+                             }));
+        },
+        args : [ "--team-config", "$server/team.json" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const read = function(name) {
+                return JSON.parse(fs.readFileSync(
+                    path.join(dir, "private", name), "utf8"));
+            };
+            assert.deepStrictEqual(read("rates.json"), {
+                vat : 22,
+                currency : "EUR",
+                projects : {nexa : {rate : 50, client : "Team"}},
+            });
+            assert.deepStrictEqual(read("projects.json"),
+                                   {nexa : {color : "blue"}});
+        },
+    },
+    {
+        name : "responses are recorded without secrets",
+        env : {WEEKLY_RECORD : "fixture.jsonl"},
+        args : [ "--init" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const lines = fs.readFileSync(path.join(dir, "fixture.jsonl"),
+                                          "utf8").trim().split("\n");
+            assert.strictEqual(lines.length, 1);
+            const record = JSON.parse(lines[0]);
+            assert.strictEqual(record.method, "POST");
+            assert.strictEqual(record.path, "/o/oauth2/device/code");
+            assert.strictEqual(record.status, 200);
+            assert.deepStrictEqual(JSON.parse(record.body), {
+                device_code : "<redacted>",
+                user_code : "<redacted>",
+                verification_url : "https://www.google.com/device",
+            });
+        },
+    },
+    {
+        name : "recorded responses are replayed",
+        setup : function(dir) {
+            // The server does not know this calendar, so only replayed
+            // responses can succeed
+            fs.writeFileSync(path.join(dir, "private", "calendar.json"),
+                             JSON.stringify("replayed@example.com"));
+            const record = function(page_token, status, body) {
+                let query = {
+                    timeMin : "2025-01-01T00:00:00.000Z",
+                    maxResults : 2500,
+                    timeMax : "2025-02-01T00:00:00.000Z",
+                };
+                if (page_token) {
+                    query.pageToken = page_token;
+                }
+                return JSON.stringify({
+                    method : "GET",
+                    path : "/calendar/v3/calendars/replayed@example.com/" +
+                               "events?" + querystring.stringify(query),
+                    status : status,
+                    body : JSON.stringify(body),
+                }) + "\n";
+            };
+            fs.writeFileSync(
+                path.join(dir, "fixture.jsonl"),
+                record(undefined, 200, {
+                    items : [ {
+                        summary : "nexa",
+                        start : {dateTime : "2025-01-10T09:00:00Z"},
+                        end : {dateTime : "2025-01-10T10:30:00Z"},
+                    } ],
+                    nextPageToken : "1",
+                }) + record("1", 200, {items : []}));
+        },
+        env : {TZ : "UTC", WEEKLY_REPLAY : "fixture.jsonl"},
+        args : [ "--period", "2025-01", "--format", "csv" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "nexa,1.50\n");
+        },
+    },
+    {
+        name : "team config is refused without https",
+        args : [ "--team-config", "$insecure/team.json" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/without https/.test(result.stderr), result.stderr);
+            assert.ok(!fs.existsSync(
+                          path.join(dir, "private", "projects.json")));
+        },
+    },
+    {
+        name : "team config must be an object",
+        setup : function(dir) {
+            state.team_config = [ state.team_config ];
+        },
+        args : [ "--team-config", "$server/team.json" ],
+        check : function(result, requests, dir) {
+            state.team_config = state.team_config[0];
+            assert.strictEqual(result.code, 4);
+            assert.ok(/invalid team configuration/.test(result.stderr),
+                      result.stderr);
+            assert.ok(!fs.existsSync(
+                          path.join(dir, "private", "projects.json")));
+        },
+    },
+    {
+        name : "team config with invalid projects changes no file",
+        setup : function(dir) {
+            state.team_config.projects = {nexa : null};
+        },
+        args : [ "--team-config", "$server/team.json" ],
+        check : function(result, requests, dir) {
+            state.team_config.projects = {nexa : {color : "blue"}};
+            assert.strictEqual(result.code, 4);
+            assert.ok(/expected an object for project 'nexa'/.test(
+                          result.stderr),
+                      result.stderr);
+            assert.ok(!fs.existsSync(
+                          path.join(dir, "private", "projects.json")));
+            assert.ok(!fs.existsSync(path.join(dir, "private", "rates.json")));
+        },
+    },
+    {
+        name : "caldav passwords are not sent without https",
+        setup : function(dir, urls) {
+            state.requests = [];
+            integration_setup_caldav(dir, urls.plain, state.caldav.password);
+        },
+        args : [ "--source", "caldav", "--period", "2025-01" ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/without https/.test(result.stderr), result.stderr);
+            assert.ok(!requests.some(function(request) {
+                return request.method === "REPORT";
+            }));
+        },
+    },
+    {
+        name : "caldav with wrong password is not authorized",
+        setup : function(dir, urls) {
+            integration_setup_caldav(dir, urls.secure, "wrong");
+        },
+        args : [ "--source", "caldav", "--period", "2025-01" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 3);
+            assert.ok(/not authorized/.test(result.stderr), result.stderr);
+            assert.ok(/private\/caldav\.json/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "events added offline are written to the journal",
+        env : {TZ : "UTC", XDG_DATA_HOME : "data"},
+        args : [
+            "--add", "nexa #train", "--duration", "1h", "--start",
+            "2025-01-17 09:00", "--offline"
+        ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/journal \(use --flush/.test(result.stdout),
+                      result.stdout);
+            const evt = JSON.parse(fs.readFileSync(
+                path.join(dir, "data", "weekly", "journal.jsonl"), "utf8"));
+            assert.strictEqual(evt.summary, "nexa #train");
+            assert.strictEqual(Date.parse(evt.start),
+                               Date.parse("2025-01-17T09:00:00Z"));
+        },
+    },
+    {
+        name : "flush adds the journal to the google calendar",
+        setup : function(dir) {
+            state.inserted = [];
+            integration_setup_events(dir);
+            fs.mkdirSync(path.join(dir, "data", "weekly"), {recursive : true});
+            fs.writeFileSync(
+                path.join(dir, "data", "weekly", "journal.jsonl"),
+                integration_local_event("nexa #train",
+                                        "2025-01-17T09:00:00Z", 60) +
+                    integration_local_event("mlab #train",
+                                            "2025-01-17T09:30:00Z", 30));
+        },
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--flush" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Flushed 2 events to the google calendar/.test(
+                          result.stdout),
+                      result.stdout);
+            assert.ok(/'mlab #train' .* overlaps 'nexa #train'/.test(
+                          result.stderr),
+                      result.stderr);
+            assert.deepStrictEqual(state.inserted.map(function(item) {
+                return item.resource.summary;
+            }), [ "nexa #train", "mlab #train" ]);
+            assert.ok(!fs.existsSync(
+                path.join(dir, "data", "weekly", "journal.jsonl")));
+        },
+    },
+    {
+        name : "flush skips the events already in the calendar",
+        setup : function(dir) {
+            integration_setup_events(dir);
+            fs.mkdirSync(path.join(dir, "data", "weekly"), {recursive : true});
+            fs.writeFileSync(
+                path.join(dir, "data", "weekly", "journal.jsonl"),
+                integration_local_event("nexa #train",
+                                        "2025-01-17T09:00:00Z", 60));
+        },
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--flush" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Flushed 0 events .* \(1 already there\)/.test(
+                          result.stdout),
+                      result.stdout);
+            assert.strictEqual(state.inserted.length, 2);
+        },
+    },
+    {
+        name : "flush refuses invalid journals",
+        setup : function(dir) {
+            fs.mkdirSync(path.join(dir, "data", "weekly"), {recursive : true});
+            fs.writeFileSync(
+                path.join(dir, "data", "weekly", "journal.jsonl"),
+                integration_local_event("x", "2025-01-17T09:00:00Z", 60) +
+                    "{\"summary\":\"x\"}\n");
+        },
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--flush" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/line 2: invalid start or end/.test(result.stderr),
+                      result.stderr);
+            assert.ok(fs.existsSync(
+                path.join(dir, "data", "weekly", "journal.jsonl")));
+        },
+    },
+    {
+        name : "edit day needs network access",
+        args : [ "--edit-day", "2025-01-15", "--offline" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/needs network access/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "release bundles are reproducible and carry build metadata",
+        args : [ "--version-info" ],
+        setup : function(dir) {
+            const env = Object.assign({}, process.env, {
+                SOURCE_DATE_EPOCH : "1700000000",
+                WEEKLY_BUILD_COMMIT : "0123456789abcdef",
+            });
+            [ "first", "second" ].forEach(function(out) {
+                child_process.execFileSync(
+                    process.execPath,
+                    [ release_build_path, "--bundle-only", "--out", out ],
+                    {cwd : dir, env : env});
+            });
+        },
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(JSON.parse(result.stdout).build, null);
+            const first = path.join(dir, "first", "weekly.js");
+            assert.ok(fs.readFileSync(first).equals(
+                fs.readFileSync(path.join(dir, "second", "weekly.js"))));
+            const info = JSON.parse(child_process.execFileSync(
+                process.execPath, [ first, "--version-info" ], {cwd : dir}));
+            assert.deepStrictEqual(info.build, {
+                version : "1.0.0",
+                commit : "0123456789abcdef",
+                date : "2023-11-14T22:13:20.000Z",
+                node : process.versions.node,
+            });
+            assert.strictEqual(info.files["private/tokens.json"], true);
+        },
+    },
+    {
+        name : "events are added to the local source",
+        setup : function() { state.requests = []; },
+        env : {TZ : "UTC", XDG_DATA_HOME : "data"},
+        args : [
+            "--add", "mlab #code", "--duration", "1h30", "--start",
+            "2025-01-15 09:00", "--source", "local"
+        ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.deepStrictEqual(requests, []);
+            const evt = JSON.parse(fs.readFileSync(
+                path.join(dir, "data", "weekly", "events.jsonl"), "utf8"));
+            assert.strictEqual(evt.summary, "mlab #code");
+            assert.strictEqual(Date.parse(evt.start),
+                               Date.parse("2025-01-15T09:00:00Z"));
+            assert.strictEqual(Date.parse(evt.end),
+                               Date.parse("2025-01-15T10:30:00Z"));
+        },
+    },
+    {
+        name : "local source reads the events in the window",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #code", "2025-01-15T09:00:00Z",
+                                        60) +
+                    integration_local_event("mlab", "2025-01-16T09:00:00Z",
+                                            30) +
+                    integration_local_event("nexa", "2025-02-01T09:00:00Z",
+                                            60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab,0.50\nnexa #code,1.00\n");
+        },
+    },
+    {
+        name : "local source refuses events ending before they start",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa", "2025-01-15T09:00:00Z", 60) +
+                    integration_local_event("mlab", "2025-01-16T09:00:00Z",
+                                            -30));
+        },
+        args : [ "--source", "local:events.jsonl", "--period", "2025-01" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/invalid 'events.jsonl': line 2: end before start/.test(
+                          result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "local events are pushed to google once",
+        setup : function(dir) {
+            state.inserted = [];
+            integration_setup_events(dir);
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #code", "2025-01-16T09:00:00Z",
+                                        60) +
+                    integration_local_event("mlab", "2025-01-16T11:00:00Z",
+                                            30));
+            const key = JSON.stringify([
+                "mlab", "2025-01-16T11:00:00.000Z", "2025-01-16T11:30:00.000Z"
+            ]);
+            state.inserted.push({
+                calendar : "work@example.com",
+                resource : {
+                    id : crypto.createHash("sha256")
+                             .update(key)
+                             .digest("hex")
+                             .slice(0, 32),
+                },
+            });
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--push-google", "--source", "local:events.jsonl", "--period",
+            "2025-01"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Pushed 1 events .* \(1 already there\)/.test(
+                          result.stdout),
+                      result.stdout);
+            assert.strictEqual(state.inserted.length, 2);
+            assert.strictEqual(state.inserted[1].resource.summary,
+                               "nexa #code");
+        },
+    },
+    {
+        name : "pushing local events can be previewed",
+        setup : function(dir) {
+            state.inserted = [];
+            integration_setup_events(dir);
+            fs.writeFileSync(path.join(dir, "events.jsonl"),
+                             integration_local_event(
+                                 "nexa #code", "2025-01-16T09:00:00Z", 60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--push-google", "--source", "local:events.jsonl", "--period",
+            "2025-01", "--dry-run"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/nexa #code/.test(result.stdout), result.stdout);
+            assert.ok(/would push 1 events/.test(result.stdout),
+                      result.stdout);
+            assert.deepStrictEqual(state.inserted, []);
+        },
+    },
+    {
+        name : "only the local source is pushed to google",
+        args : [ "--push-google", "--period", "2025-01" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/reads the local source/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "events are not added to locked months",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "private", "locks.json"),
+                             JSON.stringify([ "2025-01" ]));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--add", "mlab", "--duration", "1h", "--start", "2025-01-15 09:00",
+            "--source", "local:events.jsonl"
+        ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/locked month 2025-01/.test(result.stderr),
+                      result.stderr);
+            assert.ok(/--force/.test(result.stdout), result.stdout);
+            assert.ok(!fs.existsSync(path.join(dir, "events.jsonl")));
+        },
+    },
+    {
+        name : "locked days are not edited",
+        setup : function(dir) {
+            state.requests = [];
+            integration_setup_events(dir);
+            fs.writeFileSync(path.join(dir, "private", "locks.json"),
+                             JSON.stringify([ "2025-01" ]));
+        },
+        env : {EDITOR : "true"},
+        args : [ "--edit-day", "2025-01-15" ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/2025-01-15 is in the locked month/.test(result.stderr),
+                      result.stderr);
+            assert.deepStrictEqual(requests, []);
+        },
+    },
+    {
+        name : "months are locked",
+        args : [ "--lock", "2025-02" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.deepStrictEqual(
+                JSON.parse(fs.readFileSync(
+                    path.join(dir, "private", "locks.json"), "utf8")),
+                [ "2025-02" ]);
+        },
+    },
+    {
+        name : "events are imported from csv",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "import.csv"),
+                             "project,activity,tags,start,duration\n" +
+                                 "nexa,\"writing, paper\",code,2025-01-15 " +
+                                 "09:00,1h30\n" +
+                                 "mlab,,,2025-01-15 11:00,45\n");
+        },
+        env : {TZ : "UTC"},
+        args : [ "--import", "import.csv", "--source", "local:events.jsonl" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Imported 2 events/.test(result.stdout), result.stdout);
+            const events = fs.readFileSync(path.join(dir, "events.jsonl"),
+                                           "utf8")
+                               .trim()
+                               .split("\n")
+                               .map(JSON.parse);
+            assert.strictEqual(events[0].summary, "nexa writing, paper #code");
+            assert.strictEqual(Date.parse(events[0].start),
+                               Date.parse("2025-01-15T09:00:00Z"));
+            assert.strictEqual(Date.parse(events[0].end),
+                               Date.parse("2025-01-15T10:30:00Z"));
+            assert.strictEqual(events[1].summary, "mlab");
+        },
+    },
+    {
+        name : "events are imported into the google calendar once",
+        setup : function(dir) {
+            state.inserted = [];
+            integration_setup_events(dir);
+            fs.writeFileSync(path.join(dir, "import.csv"),
+                             "project,start,duration\n" +
+                                 "nexa,2025-01-20 09:00,1h\n" +
+                                 "nexa,2025-01-20 09:00,1h\n");
+        },
+        env : {TZ : "UTC"},
+        args : [ "--import", "import.csv", "--time-zone", "UTC" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Imported 1 events into the google calendar \(1 already/
+                          .test(result.stdout),
+                      result.stdout);
+            assert.strictEqual(state.inserted.length, 1);
+            assert.strictEqual(state.inserted[0].resource.summary, "nexa");
+            assert.strictEqual(
+                Date.parse(state.inserted[0].resource.start.dateTime),
+                Date.parse("2025-01-20T09:00:00Z"));
+        },
+    },
+    {
+        name : "invalid csv rows import nothing",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "import.csv"),
+                             "project,start,duration\n" +
+                                 "nexa,2025-01-15 09:00,1h\n" +
+                                 "mlab,yesterday,1h\n");
+        },
+        args : [ "--import", "import.csv", "--source", "local:events.jsonl" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/row 3: invalid start: 'yesterday'/.test(result.stderr),
+                      result.stderr);
+            assert.ok(!fs.existsSync(path.join(dir, "events.jsonl")));
+        },
+    },
+    {
+        name : "events are imported from timewarrior",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "timew.json"), JSON.stringify([
+                {
+                    id : 2,
+                    start : "20250115T090000Z",
+                    end : "20250115T103000Z",
+                    tags : [ "nexa", "code review", "@alice", "!po=7" ],
+                },
+                {id : 1, start : "20250115T110000Z", tags : [ "mlab" ]},
+            ]));
+        },
+        args : [
+            "--import", "timew.json", "--from", "timewarrior", "--source",
+            "local:events.jsonl"
+        ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/interval 2: still open/.test(result.stderr),
+                      result.stderr);
+            assert.ok(!fs.existsSync(path.join(dir, "events.jsonl")));
+        },
+    },
+    {
+        name : "timewarrior format exports intervals",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #\"code review\" @alice !po=7",
+                                        "2025-01-15T09:00:00Z", 90));
+        },
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--format", "timewarrior"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.deepStrictEqual(JSON.parse(result.stdout), [ {
+                start : "20250115T090000Z",
+                end : "20250115T103000Z",
+                tags : [ "nexa", "code review", "@alice", "!po=7" ],
+            } ]);
+        },
+    },
+    {
+        name : "projects lists totals and feeds completion",
+        args : [ "--projects", "--format", "csv" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const date = integration_date();
+            assert.strictEqual(result.stdout, "nexa,3.50," + date + ",2\n" +
+                                                  "mlab,1.00," + date + ",1\n");
+            let since = new Date();
+            since.setDate(since.getDate() - 89);
+            since.setHours(0, 0, 0, 0);
+            assert.strictEqual(requests[requests.length - 1].query.timeMin,
+                               since.toISOString());
+            assert.strictEqual(
+                fs.readFileSync(path.join(dir, "cache", "weekly", "projects"),
+                                "utf8"),
+                "nexa\nmlab\n");
+        },
+    },
+    {
+        name : "persons are listed with their totals",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                [
+                    [ "nexa #code @alice", "2025-01-10T09:00:00Z", 2 ],
+                    [ "nexa #code @alica", "2025-01-11T09:00:00Z", 1 ],
+                    [ "mlab #review @alice", "2025-01-12T09:00:00Z", 1 ],
+                ].map(function(item) {
+                    const start = new Date(item[1]);
+                    return JSON.stringify({
+                        summary : item[0],
+                        start : start.toISOString(),
+                        end : new Date(start.getTime() + item[2] * 3600000)
+                                  .toISOString(),
+                    }) + "\n";
+                }).join(""));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--persons", "--format", "csv"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "@alice,3.00,2025-01-12,2\n" +
+                                   "@alica,1.00,2025-01-11,1\n");
+        },
+    },
+    {
+        name : "search matches all words of the query",
+        setup : function(dir) {
+            fs.writeFileSync(
+                path.join(dir, "events.jsonl"),
+                integration_local_event("nexa #review", "2025-01-10T09:00:00Z",
+                                        60, {description : "Neubot release"}) +
+                    integration_local_event("nexa #code",
+                                            "2025-01-11T09:00:00Z", 60,
+                                            {description : "neubot fixes"}) +
+                    integration_local_event("mlab #review",
+                                            "2025-01-12T09:00:00Z", 60));
+        },
+        env : {TZ : "UTC"},
+        args : [
+            "--source", "local:events.jsonl", "--period", "2025-01",
+            "--search", "NEUBOT review", "--format", "csv", "--columns",
+            "date,summary,description"
+        ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout,
+                               "2025-01-10,nexa #review,Neubot release\n");
+        },
+    },
+    {
+        name : "open launches the browser at the event page",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "browser.sh"),
+                             "#!/bin/sh\necho \"$1\" >> opened.txt\n",
+                             {mode : 0o755});
+        },
+        env : {BROWSER : "./browser.sh"},
+        args : [ "--days", "1", "--open", "e3" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(
+                fs.readFileSync(path.join(dir, "opened.txt"), "utf8"),
+                "https://calendar.google.com/event?eid=e3\n");
+        },
+    },
+    {
+        name : "start-timer records the summary and the start",
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--start-timer", "nexa #code" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const timer = JSON.parse(fs.readFileSync(
+                path.join(dir, "data", "weekly", "timer.json"), "utf8"));
+            assert.strictEqual(timer.summary, "nexa #code");
+            assert.ok(Date.now() - Date.parse(timer.start) < 120000);
+        },
+    },
+    {
+        name : "stop-timer adds the timed event to the local source",
+        setup : function(dir) {
+            fs.mkdirSync(path.join(dir, "data", "weekly"), {recursive : true});
+            fs.writeFileSync(
+                path.join(dir, "data", "weekly", "timer.json"),
+                JSON.stringify({
+                    summary : "nexa #code",
+                    start : new Date(Date.now() - 90 * 60000).toISOString(),
+                }));
+        },
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--source", "local", "--stop-timer" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            const weekly = path.join(dir, "data", "weekly");
+            const evt = JSON.parse(
+                fs.readFileSync(path.join(weekly, "events.jsonl"), "utf8"));
+            assert.strictEqual(evt.summary, "nexa #code");
+            const minutes = (Date.parse(evt.end) - Date.parse(evt.start)) /
+                            60000;
+            assert.ok(minutes >= 89 && minutes <= 90, String(minutes));
+            assert.ok(!fs.existsSync(path.join(weekly, "timer.json")));
+        },
+    },
+    {
+        name : "stop-timer adds the timed event to the google calendar",
+        setup : function(dir) {
+            integration_setup_events(dir);
+            fs.mkdirSync(path.join(dir, "data", "weekly"), {recursive : true});
+            fs.writeFileSync(
+                path.join(dir, "data", "weekly", "timer.json"),
+                JSON.stringify({
+                    summary : "mlab #timer",
+                    start : new Date(Date.now() - 30 * 60000).toISOString(),
+                }));
+        },
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--stop-timer" ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/to the google calendar/.test(result.stdout),
+                      result.stdout);
+            const item = state.inserted[state.inserted.length - 1];
+            assert.strictEqual(item.resource.summary, "mlab #timer");
+            const weekly = path.join(dir, "data", "weekly");
+            assert.ok(!fs.existsSync(path.join(weekly, "events.jsonl")));
+            assert.ok(!fs.existsSync(path.join(weekly, "timer.json")));
+        },
+    },
+    {
+        name : "stop-timer requires a running timer",
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--stop-timer" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/no timer running/.test(result.stderr));
+        },
+    },
+    {
+        name : "status prints the event in progress",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "events.jsonl"),
+                             integration_local_event("nexa #code",
+                                                     integration_today(0, 0),
+                                                     24 * 60));
+        },
+        args : [ "--source", "local:events.jsonl", "--status" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/^nexa #code (\d+:\d\d), today \1\n$/.test(result.stdout),
+                      result.stdout);
+        },
+    },
+    {
+        name : "status prints the running timer",
+        setup : function(dir) {
+            fs.mkdirSync(path.join(dir, "data", "weekly"), {recursive : true});
+            fs.writeFileSync(path.join(dir, "data", "weekly", "timer.json"),
+                             JSON.stringify({
+                                 summary : "mlab #review",
+                                 start : integration_today(0, 0),
+                             }));
+            fs.writeFileSync(path.join(dir, "events.jsonl"), "");
+        },
+        env : {XDG_DATA_HOME : "data"},
+        args : [ "--source", "local:events.jsonl", "--status" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(
+                /^mlab #review (\d+:\d\d), today \1\n$/.test(result.stdout),
+                result.stdout);
+        },
+    },
+    {
+        name : "open without id requires search",
+        args : [ "--source", "local:events.jsonl", "--open" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/--open requires an event id/.test(result.stderr));
+        },
+    },
+    {
+        name : "events are paginated up to max events",
+        args : [ "--format", "csv", "--days", "1", "--max-events", "2" ],
+        check : function(result, requests) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout.split("\n").length, 3);
+            assert.ok(/stopped after fetching 2 events/.test(result.stderr),
+                      result.stderr);
+            assert.strictEqual(requests[requests.length - 1].query.maxResults,
+                               "2");
+        },
+    },
+    {
+        name : "events close to max events are warned about",
+        args : [ "--format", "csv", "--days", "1", "--max-events", "4" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/fetched 4 events .* close to the maximum of 4/.test(
+                          result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "raw events are read from stdin",
+        input : state.events["work@example.com"].map(function(evt) {
+            return JSON.stringify(evt) + "\n";
+        }).join(""),
+        args : [ "--source", "stdin", "--format", "csv", "--days", "1" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.strictEqual(result.stdout, "mlab @alice,1.00\n" +
+                                              "nexa,1.00\n" +
+                                              "nexa #code,2.50\n");
+        },
+    },
+    {
+        name : "raw events without times are refused",
+        input : JSON.stringify(state.events["work@example.com"][0]) +
+                    "\n{\"summary\":\"x\"}\n",
+        args : [ "--source", "stdin", "--format", "csv", "--days", "1" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 4);
+            assert.ok(/invalid event on stdin: line 2: expected start/.test(
+                          result.stderr),
+                      result.stderr);
+            assert.strictEqual(result.stdout, "");
+        },
+    },
+    {
+        name : "interrupted export is resumed",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "archive.json"), JSON.stringify({
+                version : 1,
+                window : {start : integration_today(0, 0), end : null},
+                complete : false,
+                raw : state.events["work@example.com"].slice(0, 2),
+                next_page_token : "2",
+            }));
+        },
+        args : [ "--export", "archive.json", "--since", integration_date() ],
+        check : function(result, requests, dir) {
+            assert.strictEqual(result.code, 0, result.stderr);
+            assert.ok(/Resuming export/.test(result.stdout), result.stdout);
+            assert.strictEqual(requests[requests.length - 1].query.pageToken,
+                               "2");
+            const archive = JSON.parse(
+                fs.readFileSync(path.join(dir, "archive.json"), "utf8"));
+            assert.strictEqual(archive.complete, true);
+            assert.strictEqual(archive.next_page_token, undefined);
+            assert.strictEqual(archive.raw.length, 4);
+            assert.strictEqual(archive.events[1].project, "mlab");
+        },
+    },
+    {
+        name : "export refuses archives of another window",
+        setup : function(dir) {
+            fs.writeFileSync(path.join(dir, "archive.json"), JSON.stringify({
+                version : 1,
+                window : {start : "2015-01-01T00:00:00.000Z", end : null},
+                complete : false,
+                raw : [],
+            }));
+        },
+        args : [ "--export", "archive.json", "--since", integration_date() ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/archives another window/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+    {
+        name : "until must follow since",
+        args : [ "--since", "2025-01-31", "--until", "2025-01-01" ],
+        check : function(result) {
+            assert.strictEqual(result.code, 2);
+            assert.ok(/--until is before --since/.test(result.stderr),
+                      result.stderr);
+        },
+    },
+];
+
+// Add a test for each form of duration, with the minutes it stands for, or
+// NaN when --round must reject it
+[
+    [ "1h30", 90 ],
+    [ "1.5h", 90 ],
+    [ "90m", 90 ],
+    [ "1:30", 90 ],
+    [ "90", 90 ],
+    [ "", NaN ],
+    [ "1:75", NaN ],
+    [ "-1h", NaN ],
+].forEach(function(row) {
+    tests.push({
+        name : "duration '" + row[0] + "' is " +
+                   (isNaN(row[1]) ? "rejected" : row[1] + " minutes"),
+        setup : integration_setup_trips,
+        args : [
+            "--round=" + row[0], "--round-policy", "up", "--format", "csv"
+        ],
+        check : function(result) {
+            if (isNaN(row[1])) {
+                assert.strictEqual(result.code, 2);
+                assert.ok(/invalid rounding increment/.test(result.stderr),
+                          result.stderr);
+                return;
+            }
+            assert.strictEqual(result.code, 0, result.stderr);
+            const hours = (row[1] / 60).toFixed(2);
+            assert.strictEqual(result.stdout,
+                               "mlab #code," + hours + "\n" +
+                                   "nexa #travel @alice," + hours + "\n");
+        },
+    });
+});
+
+// Run the tests sequentially and exit with failure if any of them fails
+function integration_main() {
+    const server = fakecalendar.create(state);
+    const secure = fakecalendar.create_secure(state);
+    const smtp = fakecalendar.create_smtp(state);
+    smtp.listen(0, "127.0.0.1");
+    server.listen(0, "127.0.0.1", function() {
+        state.smtp.port = smtp.address().port;
+        secure.listen(0, "127.0.0.1", function() {
+            integration_run_all({
+                plain : "http://127.0.0.1:" + server.address().port,
+                secure : "https://127.0.0.1:" + secure.address().port,
+            });
+        });
+    });
+}
+
+// Run all the tests against the fake server reachable at urls and exit
+function integration_run_all(urls) {
+    let failures = 0;
+    const next = function(index) {
+        if (index >= tests.length) {
+            console.log((failures > 0) ? "FAIL" : "PASS");
+            process.exit((failures > 0) ? 1 : 0);
+        }
+        const test = tests[index];
+        const dir = integration_setup();
+        if (test.setup) {
+            test.setup(dir, urls);
+        }
+        integration_run(urls, dir, test.args, test.env || {},
+                        test.input || "", test.fetch, function(result) {
+            try {
+                test.check(result, state.requests, dir);
+                console.log("ok - " + test.name);
+            } catch (error) {
+                failures += 1;
+                console.log("not ok - " + test.name + ": " + error.message);
+            }
+            next(index + 1);
+        });
+    };
+    next(0);
+}
+
+integration_main();
@@ -0,0 +1,321 @@
+// This software is free software. See AUTHORS and LICENSE for more
+// information on the copying conditions.
+
+// Build the release binaries of weekly, i.e. Node single executable
+// applications for each supported platform, containing index.js, its
+// dependencies, and the version metadata of the build. Run it from a clean
+// checkout with `npm run release-build`; see the README for details.
+
+"use strict";
+
+const child_process = require("child_process");
+const crypto = require("crypto");
+const fs = require("fs");
+const https = require("https");
+const path = require("path");
+
+const release_root = path.join(__dirname, "..");
+
+// Platforms for which binaries are built, by name, with the path of the
+// node executable in the official Node distribution
+const release_targets = {
+    "linux-x64" : {archive : "tar.gz", binary : "bin/node"},
+    "linux-arm64" : {archive : "tar.gz", binary : "bin/node"},
+    "darwin-x64" : {archive : "tar.gz", binary : "bin/node", macho : true},
+    "darwin-arm64" : {archive : "tar.gz", binary : "bin/node", macho : true},
+    "win-x64" : {archive : "exe", binary : "node.exe"},
+};
+
+// Fuse that Node looks for to tell whether it contains an application
+const release_sea_fuse = "NODE_SEA_FUSE_fce680ab2cc467b6e072b8b5df1996b2";
+
+// Print message and exit with failure
+function release_fatal(message) {
+    console.error("fatal: " + message);
+    process.exit(1);
+}
+
+// Run git with args inside the repository and return its trimmed output
+function release_git(args) {
+    return child_process
+        .execFileSync("git", args, {cwd : release_root, encoding : "utf8"})
+        .trim();
+}
+
+// Return the version metadata embedded into binaries: the version in
+// package.json, the commit, and the build date, which is the time of the
+// commit, unless SOURCE_DATE_EPOCH is set, so that building the same commit
+// twice produces the same binaries
+function release_build_info() {
+    const info = {
+        version : require(path.join(release_root, "package.json")).version,
+        commit : process.env.WEEKLY_BUILD_COMMIT,
+        date : process.env.SOURCE_DATE_EPOCH,
+        node : process.versions.node,
+    };
+    try {
+        if (!info.commit) {
+            info.commit = release_git([ "rev-parse", "HEAD" ]);
+            if (release_git([ "status", "--porcelain", "--untracked-files=no" ])
+                    .length > 0) {
+                info.commit += "-dirty";
+            }
+        }
+        if (!info.date) {
+            info.date = release_git([ "log", "-1", "--format=%ct" ]);
+        }
+    } catch (error) {
+        release_fatal("cannot read the commit: " + error.message + "\n" +
+                      "Set WEEKLY_BUILD_COMMIT and SOURCE_DATE_EPOCH when " +
+                      "building outside of a git checkout");
+    }
+    const seconds = parseInt(info.date, 10);
+    if (!(seconds >= 0)) {
+        release_fatal("invalid SOURCE_DATE_EPOCH: '" + info.date + "'");
+    }
+    info.date = new Date(seconds * 1000).toISOString();
+    return info;
+}
+
+// Return the modules to bundle, by the name used to require them, where
+// the value is the module source; the dependencies are resolved like Node
+// would, and their package.json is included when it exists, so that
+// --version-info can tell their version
+function release_modules(info) {
+    let modules = {
+        "./build-info.json" : JSON.stringify(info) + "\n",
+        "./index.js" : fs.readFileSync(path.join(release_root, "index.js"),
+                                       "utf8"),
+        "./package.json" : fs.readFileSync(
+            path.join(release_root, "package.json"), "utf8"),
+    };
+    const dependencies =
+        require(path.join(release_root, "package.json")).dependencies;
+    Object.keys(dependencies).forEach(function(name) {
+        const options = {paths : [ release_root ]};
+        modules[name] =
+            fs.readFileSync(require.resolve(name, options), "utf8");
+        try {
+            modules[name + "/package.json"] = fs.readFileSync(
+                require.resolve(name + "/package.json", options), "utf8");
+        } catch (error) {
+            // The version of this dependency will be unknown
+        }
+    });
+    return modules;
+}
+
+// Return a single script, which only requires Node builtin modules, running
+// index.js as the main module with the given modules (see release_modules),
+// which are sorted by name, so that the script does not depend on the order
+// in which they are found
+function release_bundle(modules) {
+    let script = "\"use strict\";\n";
+    script += "// Generated by tools/release-build.js; do not edit\n";
+    script += "const release_sources = {\n";
+    Object.keys(modules).sort().forEach(function(name) {
+        const source = /\.json$/.test(name)
+                           ? "module.exports = " + modules[name].trim() + ";"
+                           : modules[name].replace(/^#!.*/, "");
+        script += JSON.stringify(name) +
+                  " : function(module, exports, require) {\n" + source +
+                  "\n},\n";
+    });
+    script += "};\n";
+    script += "const release_cache = {};\n";
+    script += "function release_require(name) {\n";
+    script += "    if (release_sources[name] === undefined) {\n";
+    script += "        return require(name);\n";
+    script += "    }\n";
+    script += "    if (release_cache[name] === undefined) {\n";
+    script += "        const module = {exports : {}};\n";
+    script += "        release_cache[name] = module;\n";
+    script += "        release_sources[name](module, module.exports,\n";
+    script += "                              release_require);\n";
+    script += "    }\n";
+    script += "    return release_cache[name].exports;\n";
+    script += "}\n";
+    script += "release_require.main = {exports : {}};\n";
+    script += "release_cache[\"./index.js\"] = release_require.main;\n";
+    script += "release_sources[\"./index.js\"](release_require.main,\n";
+    script += "                                release_require.main.exports,\n";
+    script += "                                release_require);\n";
+    return script;
+}
+
+// Download address into file, unless it already exists, and call callback
+function release_download(address, file, callback) {
+    if (fs.existsSync(file)) {
+        callback();
+        return;
+    }
+    console.log("Downloading " + address);
+    https.get(address, function(response) {
+        if (response.statusCode !== 200) {
+            response.resume();
+            release_fatal("cannot download '" + address + "': " +
+                          response.statusCode);
+        }
+        let chunks = [];
+        response.on("data", function(data) { chunks.push(data); });
+        response.on("end", function() {
+            fs.writeFileSync(file + ".tmp", Buffer.concat(chunks));
+            fs.renameSync(file + ".tmp", file);
+            callback();
+        });
+    }).on("error", function(error) {
+        release_fatal("cannot download '" + address + "': " + error.message);
+    });
+}
+
+// Return the sha256 of the content of file, as hex
+function release_sha256(file) {
+    return crypto.createHash("sha256")
+        .update(fs.readFileSync(file))
+        .digest("hex");
+}
+
+// Download, into cache, the node executable of target (see
+// release_targets) having the same version of the node running this
+// script, verify it against the checksums published with it, and pass its
+// path to callback
+function release_node_binary(cache, target, callback) {
+    const version = "v" + process.versions.node;
+    const base = "https://nodejs.org/dist/" + version + "/";
+    const spec = release_targets[target];
+    const name = (spec.archive === "exe")
+                     ? target + "/" + spec.binary
+                     : "node-" + version + "-" + target + "." + spec.archive;
+    const sums = path.join(cache, "SHASUMS256-" + version + ".txt");
+    const file = path.join(cache, name.replace("/", "-"));
+    release_download(base + "SHASUMS256.txt", sums, function() {
+        const expected = fs.readFileSync(sums, "utf8").split("\n").map(
+            function(line) { return line.split(/\s+/); }).find(function(row) {
+            return row[1] === name;
+        });
+        if (!expected) {
+            release_fatal("no checksum for '" + name + "'");
+        }
+        release_download(base + name, file, function() {
+            if (release_sha256(file) !== expected[0]) {
+                fs.unlinkSync(file);
+                release_fatal("checksum mismatch for '" + name + "'");
+            }
+            if (spec.archive === "exe") {
+                callback(file);
+                return;
+            }
+            const member = "node-" + version + "-" + target + "/" + spec.binary;
+            const binary = path.join(cache, "node-" + version + "-" + target);
+            if (!fs.existsSync(binary)) {
+                fs.writeFileSync(binary, child_process.execFileSync(
+                    "tar", [ "-xzOf", file, member ],
+                    {maxBuffer : 512 * 1024 * 1024}));
+            }
+            callback(binary);
+        });
+    });
+}
+
+// Write into blob the single executable application preparation blob of
+// the script at main, without snapshots and code cache, which depend on the
+// platform building it rather than on the target
+function release_blob(main, blob) {
+    const config = blob + ".json";
+    fs.writeFileSync(config, JSON.stringify({
+        main : main,
+        output : blob,
+        disableExperimentalSEAWarning : true,
+        useSnapshot : false,
+        useCodeCache : false,
+    }));
+    child_process.execFileSync(process.execPath,
+                               [ "--experimental-sea-config", config ],
+                               {stdio : "inherit"});
+    fs.unlinkSync(config);
+}
+
+// Build the binary of each target into out, one after the other, and then
+// write the checksums of all binaries into out/SHA256SUMS
+function release_build(out, targets, info, blob) {
+    let postject;
+    try {
+        postject = require("postject");
+    } catch (error) {
+        release_fatal("cannot load postject; run 'npm install' first");
+    }
+    const cache = path.join(out, "cache");
+    fs.mkdirSync(cache, {recursive : true});
+    let sums = [];
+    const next = function(index) {
+        if (index >= targets.length) {
+            fs.writeFileSync(path.join(out, "SHA256SUMS"), sums.join(""));
+            console.log("Written checksums at '" +
+                        path.join(out, "SHA256SUMS") + "'");
+            return;
+        }
+        const target = targets[index];
+        const spec = release_targets[target];
+        release_node_binary(cache, target, function(binary) {
+            const name = "weekly-v" + info.version + "-" + target +
+                         ((spec.archive === "exe") ? ".exe" : "");
+            const file = path.join(out, name);
+            fs.copyFileSync(binary, file);
+            postject
+                .inject(file, "NODE_SEA_BLOB", fs.readFileSync(blob), {
+                    sentinelFuse : release_sea_fuse,
+                    machoSegmentName : spec.macho ? "NODE_SEA" : undefined,
+                })
+                .then(function() {
+                    fs.chmodSync(file, 0o755);
+                    sums.push(release_sha256(file) + "  " + name + "\n");
+                    console.log("Written '" + file + "'");
+                    next(index + 1);
+                }, function(error) {
+                    release_fatal("cannot build '" + file +
+                                  "': " + error.message);
+                });
+        });
+    };
+    next(0);
+}
+
+// Parse the command line: --out <dir> (default: dist), --target <names>
+// (comma separated, default: all), and --bundle-only, which only writes the
+// bundled script, e.g. to inspect it or to run it with node
+function release_main() {
+    let options = {out : "dist", targets : Object.keys(release_targets)};
+    const args = process.argv.slice(2);
+    for (let index = 0; index < args.length; ++index) {
+        if (args[index] === "--out" && index + 1 < args.length) {
+            options.out = args[++index];
+        } else if (args[index] === "--target" && index + 1 < args.length) {
+            options.targets = args[++index].split(",");
+        } else if (args[index] === "--bundle-only") {
+            options.bundle_only = true;
+        } else {
+            release_fatal("usage: node tools/release-build.js [--out <dir>] " +
+                          "[--target <names>] [--bundle-only]");
+        }
+    }
+    options.targets.forEach(function(target) {
+        if (!release_targets[target]) {
+            release_fatal("unknown target: '" + target + "' (available: " +
+                          Object.keys(release_targets).join(", ") + ")");
+        }
+    });
+    const info = release_build_info();
+    fs.mkdirSync(options.out, {recursive : true});
+    const bundle = path.join(options.out, "weekly.js");
+    fs.writeFileSync(bundle, release_bundle(release_modules(info)));
+    console.log("Written '" + bundle + "' (" + info.version + ", " +
+                info.commit + ", " + info.date + ")");
+    if (options.bundle_only) {
+        return;
+    }
+    const blob = path.join(options.out, "weekly.blob");
+    release_blob(bundle, blob);
+    release_build(options.out, options.targets, info, blob);
+}
+
+release_main();